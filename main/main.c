@@ -767,6 +767,25 @@ static int compare_versions(const char *v1, const char *v2)
  * Check if OTA update is available (using HEAD request)
  * Returns: 1 if update available, 0 if up to date, -1 on error
  */
+/**
+ * Identify this device to the OTA server (used for canary rollouts and
+ * update windows)
+ */
+static void get_device_id(char *out, size_t len)
+{
+    uint8_t mac[6];
+    esp_read_mac(mac, ESP_MAC_WIFI_STA);
+    snprintf(out, len, "%02X:%02X:%02X:%02X:%02X:%02X",
+             mac[0], mac[1], mac[2], mac[3], mac[4], mac[5]);
+}
+
+static esp_err_t ota_http_client_init(esp_http_client_handle_t client)
+{
+    char device_id[18];
+    get_device_id(device_id, sizeof(device_id));
+    return esp_http_client_set_header(client, "X-Device-ID", device_id);
+}
+
 static int check_ota_available(char *new_version, size_t version_len, bool *force_update)
 {
     ESP_LOGI(OTA_TAG, "Checking version at: %s", OTA_VERSION_CHECK_URL);
@@ -786,6 +805,7 @@ static int check_ota_available(char *new_version, size_t version_len, bool *forc
         ESP_LOGE(OTA_TAG, "Failed to initialize HTTP client");
         return -1;
     }
+    ota_http_client_init(client);
 
     // Open connection
     esp_err_t err = esp_http_client_open(client, 0);
@@ -903,6 +923,7 @@ static void perform_ota_update(void)
 
     esp_https_ota_config_t ota_config = {
         .http_config = &config,
+        .http_client_init_cb = ota_http_client_init,
     };
 
     esp_https_ota_handle_t ota_handle = NULL;
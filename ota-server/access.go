@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// resolveAccessControl checks the server-wide access settings. Probes are
+// exempt by default so orchestrators keep working.
+func resolveAccessControl(cfg *Config) error {
+	if (cfg.BasicAuthUser == "") != (cfg.BasicAuthPassword == "") {
+		return fmt.Errorf("basic auth needs both a user and a password")
+	}
+	for i, cidr := range cfg.AllowedNetworks {
+		normalized, err := normalizeCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("allowed network: %w", err)
+		}
+		cfg.AllowedNetworks[i] = normalized
+	}
+	if cfg.AccessExempt == nil {
+		cfg.AccessExempt = []string{"/health", "/ready"}
+	}
+	for i, path := range cfg.AccessExempt {
+		cfg.AccessExempt[i] = strings.TrimSpace(path)
+	}
+	return nil
+}
+
+// restrictAccess puts the whole server behind the configured CIDR
+// allowlist and Basic Auth credentials, answering 403 and 401. Paths in
+// config.AccessExempt skip both. Requests with the admin bearer token pass
+// Basic Auth, since both use the Authorization header.
+func restrictAccess(handler http.Handler) http.Handler {
+	if len(config.AllowedNetworks) == 0 && config.BasicAuthUser == "" {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if slices.Contains(config.AccessExempt, r.URL.Path) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		if len(config.AllowedNetworks) > 0 && !inNetworks(clientIP(r), config.AllowedNetworks) {
+			slog.Warn("🔒 Rejected request: address not allowed", "event", "access_denied",
+				"method", r.Method, "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if config.BasicAuthUser != "" && !basicAuthorized(r) {
+			slog.Warn("🔒 Rejected request: bad or missing credentials", "event", "access_denied",
+				"method", r.Method, "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Basic realm="OTA server", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// basicAuthorized reports whether r carries the configured Basic Auth
+// credentials or the admin bearer token.
+func basicAuthorized(r *http.Request) bool {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return config.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) == 1
+	}
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(config.BasicAuthUser)) == 1
+	passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(config.BasicAuthPassword)) == 1
+	return userOK && passwordOK
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const defaultRetainedVersions = 5
+
+// RetainedVersion is an archived build kept for rollback and pinned
+// downloads.
+type RetainedVersion struct {
+	Commit  string    `json:"commit"`
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	BuiltAt time.Time `json:"builtAt"`
+}
+
+// archiveName is the store name of the archived build of commit.
+func archiveName(commit string) string {
+	base := strings.TrimSuffix(config.FirmwareFile, ".bin")
+	return fmt.Sprintf("%s-%s.bin", base, commit[:min(8, len(commit))])
+}
+
+// archiveFirmware copies the build at builtPath into the store under its
+// commit and prunes archives beyond the retention limit.
+func archiveFirmware(builtPath, commit string) error {
+	file, err := os.Open(builtPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	name := archiveName(commit)
+	if err := firmwareStore.Put(name, file); err != nil {
+		return err
+	}
+	info, err := firmwareStore.Stat(name)
+	if err != nil {
+		return err
+	}
+
+	state.Lock()
+	versions := state.RetainedVersions[:0:0]
+	for _, v := range state.RetainedVersions {
+		if v.Name != name {
+			versions = append(versions, v)
+		}
+	}
+	state.RetainedVersions = append(versions, RetainedVersion{Commit: commit, Name: name, Size: info.Size, BuiltAt: time.Now()})
+	state.Unlock()
+
+	pruneRetainedVersions(config.RetainVersions)
+	return nil
+}
+
+// pruneRetainedVersions removes the oldest archived builds beyond limit,
+// but keeps the stable build a canary falls back on and the builds assigned
+// to OTA slots. It returns how many were removed.
+func pruneRetainedVersions(limit int) int {
+	state.Lock()
+	var pruned []RetainedVersion
+	kept := state.RetainedVersions[:0:0]
+	over := len(state.RetainedVersions) - limit
+	for _, v := range state.RetainedVersions {
+		if over > 0 && !commitMatches(v.Commit, state.StableCommit) && !slotHolds(v.Commit) {
+			pruned = append(pruned, v)
+			over--
+			continue
+		}
+		kept = append(kept, v)
+	}
+	state.RetainedVersions = kept
+	state.Unlock()
+
+	for _, v := range pruned {
+		if err := firmwareStore.Remove(v.Name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("⚠️  Could not prune archived firmware", "name", v.Name, "error", err)
+			continue
+		}
+		if err := firmwareStore.Remove(signatureName(v.Name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("⚠️  Could not prune signature", "name", v.Name, "error", err)
+		}
+		slog.Info("🗑️  Pruned archived firmware", "event", "archive_pruned", "name", v.Name, "commit", v.Commit)
+	}
+	return len(pruned)
+}
+
+// loadRetainedVersions rebuilds the archive list from the store on
+// startup. Only the short commit is known from the file name.
+func loadRetainedVersions() {
+	infos, err := firmwareStore.List()
+	if err != nil {
+		slog.Warn("⚠️  Could not list archived firmware", "error", err)
+		return
+	}
+
+	prefix := strings.TrimSuffix(config.FirmwareFile, ".bin") + "-"
+	var versions []RetainedVersion
+	for _, info := range infos {
+		commit, ok := strings.CutPrefix(info.Name, prefix)
+		if !ok {
+			continue
+		}
+		versions = append(versions, RetainedVersion{
+			Commit:  strings.TrimSuffix(commit, ".bin"),
+			Name:    info.Name,
+			Size:    info.Size,
+			BuiltAt: info.ModTime,
+		})
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].BuiltAt.Before(versions[j].BuiltAt) })
+
+	state.Lock()
+	state.RetainedVersions = versions
+	state.Unlock()
+	slog.Info("🗄️  Found archived firmware versions", "count", len(versions))
+}
+
+// errAmbiguousCommit is returned when an abbreviated commit matches more
+// than one retained build.
+var errAmbiguousCommit = errors.New("ambiguous commit")
+
+// commitMatches reports whether query names the retained commit. Builds
+// found on disk at startup are only known by the 8 digits in their archive
+// name, so a longer query matches if it starts with those.
+func commitMatches(retained, query string) bool {
+	if len(query) <= len(retained) {
+		return strings.HasPrefix(retained, query)
+	}
+	return strings.HasPrefix(query, retained)
+}
+
+// retainedIndex returns the index in state.RetainedVersions of the build
+// commit names, or -1 if there is none. Callers must hold state.
+func retainedIndex(commit string) (int, error) {
+	found := -1
+	for i, v := range state.RetainedVersions {
+		if !commitMatches(v.Commit, commit) {
+			continue
+		}
+		if found >= 0 {
+			first := state.RetainedVersions[found].Commit
+			return -1, fmt.Errorf("%w: %s matches retained builds %s and %s, give more digits",
+				errAmbiguousCommit, commit, first[:min(8, len(first))], v.Commit[:min(8, len(v.Commit))])
+		}
+		found = i
+	}
+	return found, nil
+}
+
+// findRetainedVersion looks up an archived build by full or abbreviated
+// commit hash. It fails with errAmbiguousCommit rather than guess when the
+// hash matches several builds.
+func findRetainedVersion(commit string) (RetainedVersion, error) {
+	query, ok := parseCommitParam(commit)
+	if !ok {
+		return RetainedVersion{}, fmt.Errorf("no retained firmware for commit %s", commit)
+	}
+	state.RLock()
+	defer state.RUnlock()
+	i, err := retainedIndex(query)
+	if err != nil {
+		return RetainedVersion{}, err
+	}
+	if i < 0 {
+		return RetainedVersion{}, fmt.Errorf("no retained firmware for commit %s", query)
+	}
+	return state.RetainedVersions[i], nil
+}
+
+// retainedLookupStatus is the HTTP status for a failed retained build
+// lookup.
+func retainedLookupStatus(err error) int {
+	if errors.Is(err, errAmbiguousCommit) {
+		return http.StatusBadRequest
+	}
+	return http.StatusNotFound
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestRetainedVersionLookup(t *testing.T) {
+	useTestFirmware(t, testImage("1.0.0", 'A', 1024))
+	const (
+		full  = "abcdef1234567890abcdef1234567890abcdef12"
+		other = "abcdef1999999999999999999999999999999999"
+		short = "0123abcd" // found on disk at startup, only the archive name's digits are known
+	)
+	state.Lock()
+	state.RetainedVersions = []RetainedVersion{{Commit: short, Name: "a"}, {Commit: full, Name: "b"}, {Commit: other, Name: "c"}}
+	state.Unlock()
+
+	tests := []struct {
+		target, current string
+		want            string
+		ambiguous       bool
+	}{
+		{target: full, want: "b"},
+		{target: "abcdef12", want: "b"},
+		{target: "abcdef19", want: "c"},
+		{target: "abcdef1", ambiguous: true},
+		{target: "0123abcd", want: "a"},
+		{target: "0123abc", want: "a"},
+		{target: "0123abcd" + full[8:], want: "a"},
+		{target: "0123abce"},
+		{target: "not-a-commit"},
+		{target: "previous", current: full, want: "a"},
+		{target: "previous", current: other, want: "b"},
+		{target: "previous", current: "0123abcd" + full[8:]},
+		{target: "previous", current: "abcdef1", ambiguous: true},
+		{target: "previous", current: "fedcba9876543210fedcba9876543210fedcba98"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target+"@"+tt.current, func(t *testing.T) {
+			v, err := resolveRollbackTarget(tt.target, tt.current)
+			switch {
+			case tt.ambiguous:
+				if !errors.Is(err, errAmbiguousCommit) || retainedLookupStatus(err) != http.StatusBadRequest {
+					t.Errorf("got %+v, %v; want an ambiguity error", v, err)
+				}
+			case tt.want == "":
+				if err == nil || errors.Is(err, errAmbiguousCommit) {
+					t.Errorf("got %+v, %v; want not found", v, err)
+				}
+			case err != nil || v.Name != tt.want:
+				t.Errorf("got %+v, %v; want %s", v, err, tt.want)
+			}
+		})
+	}
+}
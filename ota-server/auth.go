@@ -0,0 +1,39 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// requireAdmin checks the request's bearer token against the configured
+// admin token and writes an error response when it doesn't match. Mutating
+// endpoints are disabled entirely while no token is configured, which main
+// only allows for mirrors.
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	expected := config.AdminToken
+	if expected == "" {
+		slog.Warn("🔒 Rejected admin request: no admin token configured", "event", "auth_rejected",
+			"method", r.Method, "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+		http.Error(w, "Admin endpoints disabled: OTA_ADMIN_TOKEN not set", http.StatusForbidden)
+		return false
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		slog.Warn("🔒 Rejected admin request: missing token", "event", "auth_rejected",
+			"method", r.Method, "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized: send Authorization: Bearer <OTA_ADMIN_TOKEN>", http.StatusUnauthorized)
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+		slog.Warn("🔒 Rejected admin request: invalid token", "event", "auth_rejected",
+			"method", r.Method, "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, "Unauthorized: invalid admin token", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
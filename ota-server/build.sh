@@ -2,25 +2,39 @@
 set -e
 
 echo "🔨 Building ESP32 Beacon Firmware..."
-echo "Project: /project"
+# Channel builds point PROJECT_DIR at their worktree under /project
+PROJECT_DIR=${PROJECT_DIR:-/project}
+echo "Project: $PROJECT_DIR"
 
-cd /project
+cd "$PROJECT_DIR"
+
+# Build directory; targets given separate workspaces can build in parallel
+BUILD_DIR=${BUILD_DIR:-build}
 
 # Source IDF environment
 . $IDF_PATH/export.sh
 
 # Clean build cache if it exists (to avoid path conflicts)
-if [ -d "build" ]; then
+if [ -d "$BUILD_DIR" ]; then
     echo "🧹 Cleaning previous build cache..."
-    idf.py fullclean
+    idf.py -B "$BUILD_DIR" fullclean
 fi
 
 # Build the project
-idf.py build
+idf.py -B "$BUILD_DIR" build
+
+# Report toolchain versions so the OTA server can record build provenance
+echo "IDF_VERSION=$(idf.py --version)"
+CC=$(sed -n 's/^CMAKE_C_COMPILER:[A-Z]*=//p' $BUILD_DIR/CMakeCache.txt)
+echo "COMPILER_VERSION=$("$CC" --version | head -n1)"
 
-# Copy firmware to output directory
-echo "📦 Copying firmware to /firmware..."
-cp build/esp32-ibeacon-transmitter.bin /firmware/beacon_firmware.bin
+# Copy firmware to the output path; the OTA server publishes it from there
+OUTPUT=${OUTPUT:-/firmware/beacon_firmware.bin}
+echo "📦 Copying firmware to $OUTPUT..."
+mkdir -p "$(dirname "$OUTPUT")"
+# Copy to a temp file and rename so a partial image is never visible
+cp "$BUILD_DIR"/esp32-ibeacon-transmitter.bin "$OUTPUT.tmp"
+mv -f "$OUTPUT.tmp" "$OUTPUT"
 
 echo "✅ Build complete!"
-ls -lh /firmware/beacon_firmware.bin
+ls -lh "$OUTPUT"
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Build backends: builder containers, or commands run directly on a host
+// that has the toolchain installed.
+const (
+	buildBackendDocker = "docker"
+	buildBackendLocal  = "local"
+)
+
+// resolveBuildBackend defaults and checks the backend. It runs before
+// resolveTargets, whose defaults depend on it.
+func resolveBuildBackend(cfg *Config) error {
+	switch cfg.BuildBackend {
+	case "":
+		cfg.BuildBackend = buildBackendDocker
+	case buildBackendDocker, buildBackendLocal:
+	default:
+		return fmt.Errorf("build backend must be %q or %q, got %q", buildBackendDocker, buildBackendLocal, cfg.BuildBackend)
+	}
+	return nil
+}
+
+// dockerVolumes returns the mounts for builder containers. By default the
+// project is mounted at /project and the firmware volume at /firmware,
+// where build.sh expects them.
+func dockerVolumes() []string {
+	if len(config.DockerVolumes) > 0 {
+		return config.DockerVolumes
+	}
+	return []string{hostProjectPath() + ":/project", "ota-server_firmware-data:/firmware"}
+}
+
+// buildCommand returns the command that builds target into its output
+// directory on the firmware volume. A Docker build writes to /firmware
+// inside the container and is told where target.Source is with
+// PROJECT_DIR; a local build writes straight to config.FirmwarePath and
+// runs in target.Source.
+func buildCommand(ctx context.Context, target FirmwareTarget, container string) (*exec.Cmd, error) {
+	if config.BuildBackend == buildBackendLocal {
+		outDir := filepath.Join(config.FirmwarePath, target.outputDir())
+		if err := os.MkdirAll(outDir, 0755); err != nil {
+			return nil, err
+		}
+		source := filepath.Join(config.ProjectPath, target.Source)
+		cmd := exec.CommandContext(ctx, target.Command[0], target.Command[1:]...)
+		cmd.Dir = source
+		cmd.Env = append(os.Environ(),
+			"OUTPUT="+filepath.Join(outDir, target.Output),
+			"TARGET="+target.Name,
+			"PROJECT_PATH="+source)
+		if target.Workspace != "" {
+			cmd.Env = append(cmd.Env, "BUILD_DIR="+target.Workspace)
+		}
+		cmd.Env = append(cmd.Env, target.Env...)
+		return cmd, nil
+	}
+
+	args := []string{"run", "--rm", "--name", container}
+	for _, volume := range dockerVolumes() {
+		args = append(args, "-v", volume)
+	}
+	args = append(args,
+		"-e", "OUTPUT=/firmware/"+target.outputDir()+"/"+target.Output,
+		"-e", "TARGET="+target.Name,
+	)
+	if target.Workspace != "" {
+		args = append(args, "-e", "BUILD_DIR="+target.Workspace)
+	}
+	if target.Source != "" {
+		args = append(args, "-e", "PROJECT_DIR=/project/"+filepath.ToSlash(target.Source))
+	}
+	for _, env := range target.Env {
+		args = append(args, "-e", env)
+	}
+	if target.Entrypoint != "" {
+		args = append(args, "--entrypoint", target.Entrypoint)
+	}
+	args = append(args, config.DockerArgs...)
+	args = append(append(args, target.Image), target.Command...)
+	return exec.CommandContext(ctx, "docker", args...), nil
+}
+
+// probeBuildBackend checks that builds can start: that every target's
+// build command exists for the local backend, or that the Docker daemon
+// answers.
+func probeBuildBackend(ctx context.Context) error {
+	if config.BuildBackend == buildBackendLocal {
+		for _, target := range config.Targets {
+			command := target.Command[0]
+			if filepath.Base(command) != command && !filepath.IsAbs(command) {
+				command = filepath.Join(config.ProjectPath, command)
+			}
+			if _, err := exec.LookPath(command); err != nil {
+				return fmt.Errorf("target %s: build command: %w", target.Name, err)
+			}
+		}
+		return nil
+	}
+
+	if _, err := exec.LookPath("docker"); err != nil {
+		return fmt.Errorf("docker build backend: %w", err)
+	}
+	if out, err := exec.CommandContext(ctx, "docker", "version", "--format", "{{.Server.Version}}").CombinedOutput(); err != nil {
+		return fmt.Errorf("docker daemon unreachable: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// checkBuildBackend makes sure builds can run at all, so a misconfigured
+// deployment fails at startup rather than on the first build. A missing
+// builder image is only a warning, since it can be built after startup.
+func checkBuildBackend() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	if err := probeBuildBackend(ctx); err != nil || config.BuildBackend == buildBackendLocal {
+		return err
+	}
+	checked := map[string]bool{}
+	for _, target := range config.Targets {
+		if checked[target.Image] {
+			continue
+		}
+		checked[target.Image] = true
+		if err := exec.CommandContext(ctx, "docker", "image", "inspect", target.Image).Run(); err != nil {
+			slog.Warn("⚠️  Builder image not found, builds will fail until it exists", "image", target.Image, "target", target.Name)
+		}
+	}
+	return nil
+}
+
+// How long a backend probe result is reused, so probes and dashboards
+// polling /status don't run docker on every request.
+const (
+	backendHealthTTL     = 30 * time.Second
+	backendHealthTimeout = 5 * time.Second
+)
+
+// BackendHealth is the last probe of the build backend, shown in /status.
+type BackendHealth struct {
+	Backend   string    `json:"backend"`
+	OK        bool      `json:"ok"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checkedAt"`
+}
+
+var backendProbe struct {
+	sync.Mutex
+	last BackendHealth
+}
+
+// lastBackendHealth is the latest probe, for readers that mustn't wait
+// for one.
+var lastBackendHealth atomic.Pointer[BackendHealth]
+
+// cachedBackendHealth returns the last probe without waiting for a new
+// one, or nil if there hasn't been one. Page loads use it so they never
+// wait on docker; backendHealthMonitor keeps it fresh.
+func cachedBackendHealth() *BackendHealth {
+	return lastBackendHealth.Load()
+}
+
+// backendHealthMonitor probes the build backend every backendHealthTTL, so
+// cachedBackendHealth is never much older than a probe /status would run.
+func backendHealthMonitor() {
+	for {
+		buildBackendHealth()
+		time.Sleep(backendHealthTTL)
+	}
+}
+
+// buildBackendHealth probes the build backend, reusing a result younger
+// than backendHealthTTL. Concurrent callers wait for one probe.
+func buildBackendHealth() BackendHealth {
+	backendProbe.Lock()
+	defer backendProbe.Unlock()
+	if time.Since(backendProbe.last.CheckedAt) < backendHealthTTL {
+		return backendProbe.last
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), backendHealthTimeout)
+	defer cancel()
+	health := BackendHealth{Backend: config.BuildBackend, OK: true, CheckedAt: time.Now()}
+	if err := probeBuildBackend(ctx); err != nil {
+		health.OK, health.Error = false, err.Error()
+	}
+	// Log changes, and a backend that is down from the start
+	if first := backendProbe.last.CheckedAt.IsZero(); first && !health.OK || !first && health.OK != backendProbe.last.OK {
+		if health.OK {
+			slog.Info("✅ Build backend available", "event", "backend_up", "backend", health.Backend)
+		} else {
+			slog.Warn("⚠️  Build backend unavailable, builds will fail", "event", "backend_down", "backend", health.Backend,
+				"error", health.Error)
+		}
+	}
+	backendProbe.last = health
+	lastBackendHealth.Store(&health)
+	return health
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+// errBuildAborted is returned by runTargetBuild when the build was
+// cancelled through /build/cancel rather than failing or timing out.
+var errBuildAborted = errors.New("build aborted")
+
+// cancelBuildHandler aborts the running build, killing its container. The
+// build is recorded as aborted in the history. With restart=1 the same
+// build is queued again.
+func cancelBuildHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	if !parseSmallForm(w, r) {
+		return
+	}
+
+	state.Lock()
+	cancel, running := state.CancelBuild, state.RunningBuild
+	state.Unlock()
+	if cancel == nil {
+		// A rollback also holds the build slot but can't be cancelled
+		http.Error(w, "No build running", http.StatusConflict)
+		return
+	}
+
+	slog.Warn("🛑 Build cancel requested", "event", "build_cancel", "reason", running.Reason, "ref", running.Ref,
+		"remote_addr", r.RemoteAddr)
+	cancel()
+
+	w.WriteHeader(http.StatusAccepted)
+	if r.FormValue("restart") != "1" {
+		fmt.Fprintf(w, "Build aborted")
+		return
+	}
+	running.Reason = buildReasonManual
+	position, _ := enqueueBuild(running)
+	fmt.Fprintf(w, "Build aborted, restart queued at position %d", position)
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxBuildLogs     = 5
+	maxBuildLogBytes = 512 << 10
+
+	// Each build's full output is also kept on disk, for as long as its
+	// history entry, so /logs can serve it by commit
+	buildLogDir          = ".logs"
+	maxBuildLogFileBytes = 16 << 20
+)
+
+// BuildLog captures the output of one build. Only the last
+// maxBuildLogBytes are kept; readers can follow it while the build runs.
+// The output also goes to File in buildLogDir, if it could be created.
+type BuildLog struct {
+	mu      sync.Mutex
+	changed *sync.Cond
+	Started time.Time
+	File    string
+	done    bool
+	size    int64  // total bytes ever written
+	data    []byte // the last len(data) of those bytes
+	file    *os.File
+}
+
+var (
+	buildLogsMu sync.Mutex
+	buildLogs   []*BuildLog // oldest first
+)
+
+// startBuildLog begins a new log for a build of commit, dropping the
+// oldest beyond maxBuildLogs.
+func startBuildLog(commit string) *BuildLog {
+	l := &BuildLog{Started: time.Now()}
+	l.changed = sync.NewCond(&l.mu)
+	l.createFile(commit)
+
+	buildLogsMu.Lock()
+	defer buildLogsMu.Unlock()
+	buildLogs = append(buildLogs, l)
+	if over := len(buildLogs) - maxBuildLogs; over > 0 {
+		buildLogs = append([]*BuildLog(nil), buildLogs[over:]...)
+	}
+	return l
+}
+
+// recentBuildLog returns the log of the build n builds back (0 is the
+// latest), or nil.
+func recentBuildLog(n int) *BuildLog {
+	buildLogsMu.Lock()
+	defer buildLogsMu.Unlock()
+	if n < 0 || n >= len(buildLogs) {
+		return nil
+	}
+	return buildLogs[len(buildLogs)-1-n]
+}
+
+// createFile opens the log's file, named by start time and commit. A
+// failure only loses the copy on disk.
+func (l *BuildLog) createFile(commit string) {
+	dir := filepath.Join(config.FirmwarePath, buildLogDir)
+	name := l.Started.UTC().Format("20060102T150405.000")
+	if commit != "" {
+		name += "-" + commit[:min(8, len(commit))]
+	}
+	name += ".log"
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		slog.Warn("⚠️  Could not save build log", "event", "build_log_failed", "error", err)
+		return
+	}
+	file, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		slog.Warn("⚠️  Could not save build log", "event", "build_log_failed", "error", err)
+		return
+	}
+	l.File, l.file = name, file
+}
+
+func (l *BuildLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil && l.size < maxBuildLogFileBytes {
+		chunk := p[:min(len(p), int(maxBuildLogFileBytes-l.size))]
+		if _, err := l.file.Write(chunk); err != nil {
+			slog.Warn("⚠️  Could not save build log", "event", "build_log_failed", "file", l.File, "error", err)
+			l.file.Close()
+			l.file = nil
+		}
+	}
+	l.data = append(l.data, p...)
+	l.size += int64(len(p))
+	if over := len(l.data) - maxBuildLogBytes; over > 0 {
+		l.data = append([]byte(nil), l.data[over:]...)
+	}
+	l.changed.Broadcast()
+	return len(p), nil
+}
+
+// finish appends the build result and wakes any followers.
+func (l *BuildLog) finish(err error) {
+	if err != nil {
+		fmt.Fprintf(l, "\n==> Build failed: %v\n", err)
+	} else {
+		fmt.Fprintf(l, "\n==> Build succeeded\n")
+	}
+	l.mu.Lock()
+	l.done = true
+	if l.file != nil {
+		if l.size > maxBuildLogFileBytes {
+			fmt.Fprintf(l.file, "\n==> Log truncated at %d bytes\n", maxBuildLogFileBytes)
+		}
+		l.file.Close()
+		l.file = nil
+	}
+	l.changed.Broadcast()
+	l.mu.Unlock()
+}
+
+// removeBuildLogFile deletes a saved build log, e.g. once its history
+// entry is evicted.
+func removeBuildLogFile(name string) {
+	if name == "" {
+		return
+	}
+	if err := os.Remove(filepath.Join(config.FirmwarePath, buildLogDir, name)); err != nil && !os.IsNotExist(err) {
+		slog.Warn("⚠️  Could not remove build log", "event", "build_log_failed", "file", name, "error", err)
+	}
+}
+
+// pruneBuildLogFiles deletes saved build logs no history entry refers to,
+// such as those of builds interrupted by a restart.
+func pruneBuildLogFiles() {
+	entries, err := os.ReadDir(filepath.Join(config.FirmwarePath, buildLogDir))
+	if err != nil {
+		return
+	}
+	state.RLock()
+	kept := make(map[string]bool, len(state.History))
+	for _, record := range state.History {
+		kept[record.LogFile] = true
+	}
+	state.RUnlock()
+	for _, entry := range entries {
+		if !kept[entry.Name()] {
+			removeBuildLogFile(entry.Name())
+		}
+	}
+}
+
+// historyBuildLog finds the history entry selected by ?index=N (as listed
+// by /history, newest first) or ?commit=<hash> (its latest build) and
+// returns it with its saved log's path.
+func historyBuildLog(r *http.Request) (record BuildRecord, path string, ok bool) {
+	state.RLock()
+	defer state.RUnlock()
+	found := -1
+	if commit, valid := parseCommitParam(r.URL.Query().Get("commit")); valid {
+		for i := len(state.History) - 1; i >= 0; i-- {
+			if strings.HasPrefix(state.History[i].Commit, commit) {
+				found = i
+				break
+			}
+		}
+	} else if n, err := strconv.Atoi(r.URL.Query().Get("index")); err == nil && n >= 0 && n < len(state.History) {
+		found = len(state.History) - 1 - n
+	}
+	if found < 0 || state.History[found].LogFile == "" {
+		return BuildRecord{}, "", false
+	}
+	record = state.History[found]
+	return record, filepath.Join(config.FirmwarePath, buildLogDir, record.LogFile), true
+}
+
+// readFrom returns the retained bytes at or after offset, the offset to
+// read from next, and whether the log is complete. If offset has already
+// been trimmed away, reading resumes at the oldest retained byte.
+func (l *BuildLog) readFrom(offset int64) (chunk []byte, next int64, done bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	start := l.size - int64(len(l.data))
+	if offset < start {
+		offset = start
+	}
+	return append([]byte(nil), l.data[offset-start:]...), l.size, l.done
+}
+
+// wait blocks until the log grows past offset, finishes, or ctx ends.
+func (l *BuildLog) wait(ctx context.Context, offset int64) {
+	stop := context.AfterFunc(ctx, func() {
+		l.mu.Lock()
+		l.changed.Broadcast()
+		l.mu.Unlock()
+	})
+	defer stop()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for l.size <= offset && !l.done && ctx.Err() == nil {
+		l.changed.Wait()
+	}
+}
+
+// logsHandler serves the output of a recent build as plain text:
+// ?back=N selects an older build and ?follow=1 streams a running build
+// until it finishes. ?commit=<hash> or ?index=N serve the saved log of a
+// build in /history instead.
+func logsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Has("commit") || r.URL.Query().Has("index") {
+		serveSavedBuildLog(w, r)
+		return
+	}
+
+	back, _ := strconv.Atoi(r.URL.Query().Get("back"))
+	l := recentBuildLog(back)
+	if l == nil {
+		http.Error(w, "No build log available", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Build-Started", l.Started.Format(time.RFC3339))
+
+	chunk, offset, done := l.readFrom(0)
+	w.Write(chunk)
+	if done || r.URL.Query().Get("follow") == "" {
+		return
+	}
+
+	// Stream the rest with chunked transfer until the build completes
+	streamWithoutDeadline(w)
+	flusher, _ := w.(http.Flusher)
+	for !done && r.Context().Err() == nil {
+		if flusher != nil {
+			flusher.Flush()
+		}
+		l.wait(r.Context(), offset)
+		chunk, offset, done = l.readFrom(offset)
+		if _, err := w.Write(chunk); err != nil {
+			return
+		}
+	}
+}
+
+// serveSavedBuildLog serves the log file of a finished build in /history.
+func serveSavedBuildLog(w http.ResponseWriter, r *http.Request) {
+	if query := r.URL.Query(); query.Has("commit") {
+		if _, ok := requireCommitParam(w, "commit", query.Get("commit")); !ok {
+			return
+		}
+	}
+	record, path, ok := historyBuildLog(r)
+	if !ok {
+		http.Error(w, "No saved log for that build", http.StatusNotFound)
+		return
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		http.Error(w, "No saved log for that build", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		http.Error(w, "Failed to read build log", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", record.LogFile))
+	w.Header().Set("X-Build-Started", record.StartTime.Format(time.RFC3339))
+	w.Header().Set("X-Build-Commit", record.Commit)
+	http.ServeContent(w, r, "", info.ModTime(), file)
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// runBuildOnce builds the checked-out tree through buildFirmware, exactly
+// as the server would, and prints the result for CI. It returns the
+// process exit code: 1 if the build or image validation failed.
+func runBuildOnce() int {
+	loadState()
+	if err := buildFirmware(BuildRequest{Reason: buildReasonCLI}); err != nil {
+		fmt.Fprintf(os.Stderr, "build failed: %v\n", err)
+		return 1
+	}
+
+	state.RLock()
+	defer state.RUnlock()
+	fmt.Printf("firmware=%s\n", filepath.Join(config.FirmwarePath, config.FirmwareFile))
+	fmt.Printf("version=%s\n", state.FirmwareVersion)
+	fmt.Printf("commit=%s\n", state.LastGitCommit)
+	fmt.Printf("size=%d\n", state.FirmwareSize)
+	fmt.Printf("sha256=%s\n", state.FirmwareChecksum.SHA256)
+	return 0
+}
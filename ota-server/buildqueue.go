@@ -0,0 +1,91 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+// Build triggers, recorded in BuildRequest.Reason and the build history.
+const (
+	buildReasonStartup = "startup"
+	buildReasonGit     = "git"
+	buildReasonManual  = "manual"
+	buildReasonCLI     = "cli"
+	buildReasonUpload  = "upload"
+
+	// Not queued: an operator republished a retained build
+	buildReasonRollback = "rollback"
+)
+
+// BuildRequest is a build waiting in the queue.
+type BuildRequest struct {
+	Reason   string    `json:"reason"`
+	Ref      string    `json:"ref,omitempty"`     // empty for the tracked branch
+	Commit   string    `json:"commit,omitempty"`  // Ref resolved by resolveBuildRef
+	Channel  string    `json:"channel,omitempty"` // release channel to publish to
+	QueuedAt time.Time `json:"queuedAt"`
+}
+
+// sameBuild reports whether two requests would build the same tree.
+func (b BuildRequest) sameBuild(other BuildRequest) bool {
+	return b.Ref == other.Ref && b.Commit == other.Commit && b.Channel == other.Channel
+}
+
+// buildWake tells the build worker that ServerState.BuildQueue has work.
+// One buffered slot is enough: the worker drains the whole queue each time.
+var buildWake = make(chan struct{}, 1)
+
+// enqueueBuild adds a build to the queue and returns its 1-based position.
+// A request for a tree that is already queued is coalesced with it and
+// gets that entry's position instead.
+func enqueueBuild(req BuildRequest) (position int, coalesced bool) {
+	req.QueuedAt = time.Now()
+
+	state.Lock()
+	for i, queued := range state.BuildQueue {
+		if queued.sameBuild(req) {
+			state.Unlock()
+			slog.Info("📥 Build already queued", "event", "build_coalesced", "reason", req.Reason, "ref", req.Ref, "position", i+1)
+			return i + 1, true
+		}
+	}
+	state.BuildQueue = append(state.BuildQueue, req)
+	position = len(state.BuildQueue)
+	state.Unlock()
+
+	slog.Info("📥 Build queued", "event", "build_queued", "reason", req.Reason, "ref", req.Ref, "position", position)
+	select {
+	case buildWake <- struct{}{}:
+	default:
+	}
+	return position, false
+}
+
+// buildWorker runs queued builds one at a time, in order.
+func buildWorker() {
+	for range buildWake {
+		for {
+			state.Lock()
+			if len(state.BuildQueue) == 0 {
+				state.Unlock()
+				break
+			}
+			req := state.BuildQueue[0]
+			state.BuildQueue = state.BuildQueue[1:]
+			paused := state.Maintenance.Paused
+			state.Unlock()
+
+			if paused {
+				slog.Info("⏸️  Maintenance mode, dropping queued build", "event", "build_dropped", "reason", req.Reason, "ref", req.Ref)
+				continue
+			}
+
+			switch {
+			case req.Channel != "":
+				buildChannel(req)
+			default:
+				buildFirmware(req)
+			}
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Channel and ref builds check out their commit in a git worktree of
+// their own under this directory of the project, so they never touch the
+// tracked branch's checkout.
+const worktreeDir = ".ota-worktrees"
+
+// refWorktree is the worktree ref builds use. Channel names can't start
+// with an underscore, so it never clashes with a channel's.
+const refWorktree = "_ref"
+
+// resolveBuildRef fetches from origin and resolves a branch, tag or commit
+// to a commit hash. Branches are looked up on origin first, so a stale
+// local branch doesn't shadow the remote one. Callers must hold gitCheck.
+func resolveBuildRef(ref string, branchOnly bool) (string, error) {
+	if ref == "" || strings.HasPrefix(ref, "-") {
+		return "", fmt.Errorf("invalid ref %q", ref)
+	}
+	if err := gitFetch("--quiet", "origin"); err != nil {
+		return "", err
+	}
+
+	candidates := []string{"origin/" + ref}
+	if !branchOnly {
+		candidates = append(candidates, ref)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), gitTimeout)
+	defer cancel()
+	for _, candidate := range candidates {
+		output, err := exec.CommandContext(ctx, "git", "-C", config.ProjectPath, "rev-parse", "--verify", "--quiet", candidate+"^{commit}").Output()
+		if err == nil {
+			return strings.TrimSpace(string(output)), nil
+		}
+	}
+	return "", fmt.Errorf("unknown ref %q", ref)
+}
+
+// checkoutWorktree checks out commit in the worktree called name, adding
+// it on first use, and returns its path relative to the project. Callers
+// must hold gitCheck: worktrees share the checkout's refs and objects.
+func checkoutWorktree(name, commit string) (string, error) {
+	rel := filepath.Join(worktreeDir, name)
+	dir := filepath.Join(config.ProjectPath, rel)
+	if err := excludeWorktrees(); err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), gitTimeout)
+	defer cancel()
+	args := []string{"-C", dir, "checkout", "--quiet", "--force", "--detach", commit}
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err != nil {
+		// Forget a worktree whose directory was removed, and start over
+		// from a directory left without one
+		exec.CommandContext(ctx, "git", "-C", config.ProjectPath, "worktree", "prune").Run()
+		if err := os.RemoveAll(dir); err != nil {
+			return "", err
+		}
+		args = []string{"-C", config.ProjectPath, "worktree", "add", "--quiet", "--force", "--detach", dir, commit}
+	}
+	if output, err := exec.CommandContext(ctx, "git", args...).CombinedOutput(); err != nil {
+		return "", fmt.Errorf("git %s: %v: %s", args[2], err, strings.TrimSpace(string(output)))
+	}
+	return rel, nil
+}
+
+// excludeWorktrees keeps worktreeDir out of the project's git status.
+func excludeWorktrees() error {
+	output, err := exec.Command("git", "-C", config.ProjectPath, "rev-parse", "--git-path", "info/exclude").Output()
+	if err != nil {
+		return fmt.Errorf("git rev-parse: %v", err)
+	}
+	exclude := strings.TrimSpace(string(output))
+	if !filepath.IsAbs(exclude) {
+		exclude = filepath.Join(config.ProjectPath, exclude)
+	}
+	pattern := "/" + worktreeDir + "/"
+	data, err := os.ReadFile(exclude)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == pattern {
+			return nil
+		}
+	}
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		pattern = "\n" + pattern
+	}
+	if err := os.MkdirAll(filepath.Dir(exclude), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(exclude, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintln(f, pattern)
+	return err
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestManualRefBuildRequiresPublish(t *testing.T) {
+	useTestFirmware(t, testImage("1.0.0", 'A', 4096))
+	config.AdminToken = "secret"
+
+	tests := []struct {
+		name string
+		form string
+	}{
+		{name: "ref", form: "ref=v1.2.0"},
+		{name: "branch", form: "branch=feature/scan-interval"},
+		{name: "publish not set", form: "branch=feature&publish=false"},
+		{name: "publish not a bool", form: "branch=feature&publish=yes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/build", strings.NewReader(tt.form))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.Header.Set("Authorization", "Bearer secret")
+			w := httptest.NewRecorder()
+			manualBuildHandler(w, r)
+			if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "publish=true") {
+				t.Errorf("status %d (%q), want 400 asking for publish=true", w.Code, w.Body.String())
+			}
+			state.RLock()
+			queued := len(state.BuildQueue)
+			state.RUnlock()
+			if queued != 0 {
+				t.Errorf("%d builds queued, want none", queued)
+			}
+		})
+	}
+}
+
+// testRepo creates a git repository with one commit per message and
+// returns its path and the commits, oldest first.
+func testRepo(t *testing.T, messages ...string) (string, []string) {
+	t.Helper()
+	dir := t.TempDir()
+	git := func(args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, output)
+		}
+		return strings.TrimSpace(string(output))
+	}
+	git("init", "--quiet", "--initial-branch=main")
+	var commits []string
+	for _, message := range messages {
+		if err := os.WriteFile(filepath.Join(dir, "VERSION"), []byte(message), 0644); err != nil {
+			t.Fatal(err)
+		}
+		git("add", "VERSION")
+		git("commit", "--quiet", "-m", message)
+		commits = append(commits, git("rev-parse", "HEAD"))
+	}
+	return dir, commits
+}
+
+func TestCheckoutWorktree(t *testing.T) {
+	useTestFirmware(t, testImage("1.0.0", 'A', 4096))
+	project, commits := testRepo(t, "1.0.0", "1.1.0")
+	config.ProjectPath = project
+
+	tests := []struct {
+		name   string
+		commit string
+		setup  func(dir string)
+	}{
+		{name: "first build adds the worktree", commit: commits[0]},
+		{name: "later builds reuse it", commit: commits[1]},
+		{name: "local edits are discarded", commit: commits[0], setup: func(dir string) {
+			os.WriteFile(filepath.Join(dir, "VERSION"), []byte("edited"), 0644)
+		}},
+		{name: "a deleted worktree is added again", commit: commits[1], setup: func(dir string) {
+			os.RemoveAll(dir)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := filepath.Join(project, worktreeDir, "beta")
+			if tt.setup != nil {
+				tt.setup(dir)
+			}
+			rel, err := checkoutWorktree("beta", tt.commit)
+			if err != nil {
+				t.Fatalf("checkoutWorktree: %v", err)
+			}
+			if rel != filepath.Join(worktreeDir, "beta") {
+				t.Errorf("path = %s, want %s/beta", rel, worktreeDir)
+			}
+			head, _ := exec.Command("git", "-C", dir, "rev-parse", "HEAD").Output()
+			if got := strings.TrimSpace(string(head)); got != tt.commit {
+				t.Errorf("worktree HEAD = %.8s, want %.8s", got, tt.commit)
+			}
+			if got := getCurrentCommit(); got != commits[1] {
+				t.Errorf("project HEAD moved to %.8s", got)
+			}
+			if status, _ := exec.Command("git", "-C", project, "status", "--porcelain").Output(); len(status) > 0 {
+				t.Errorf("project has changes: %s", status)
+			}
+		})
+	}
+
+	exclude, _ := os.ReadFile(filepath.Join(project, ".git", "info", "exclude"))
+	if n := strings.Count(string(exclude), "/"+worktreeDir+"/"); n != 1 {
+		t.Errorf("worktree directory excluded %d times, want once", n)
+	}
+}
+
+func TestRefBuildUsesWorktree(t *testing.T) {
+	useTestFirmware(t, testImage("1.0.0", 'A', 4096))
+	project, commits := testRepo(t, "1.0.0", "1.1.0")
+	config.ProjectPath = project
+	imagePath := filepath.Join(t.TempDir(), "image.bin")
+	if err := os.WriteFile(imagePath, testImage("1.0.0", 'B', 4096), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config.BuildBackend = buildBackendLocal
+	config.Targets = []FirmwareTarget{{Name: "beacon", Output: config.FirmwareFile,
+		Command: []string{"sh", "-c", `test "$(cat VERSION)" = 1.0.0 && cp "$IMAGE" "$OUTPUT"`},
+		Env:     []string{"IMAGE=" + imagePath}}}
+
+	if err := buildFirmware(BuildRequest{Reason: "manual", Ref: "v1.0.0", Commit: commits[0]}); err != nil {
+		t.Fatalf("ref build failed: %v", err)
+	}
+	if got := getCurrentCommit(); got != commits[1] {
+		t.Errorf("project HEAD moved to %.8s", got)
+	}
+	state.RLock()
+	published := state.LastGitCommit
+	state.RUnlock()
+	if published != commits[0] {
+		t.Errorf("published commit %.8s, want %.8s", published, commits[0])
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"hash/fnv"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// inCanary places a device in the canary group by hashing its ID into
+// 100 buckets, so a device stays in the same group across builds. Devices
+// that don't identify themselves always get the stable build.
+func inCanary(id string, percent int) bool {
+	if id == "" {
+		return false
+	}
+	h := fnv.New32a()
+	h.Write([]byte(strings.ToLower(id)))
+	return int(h.Sum32()%100) < percent
+}
+
+// advanceRollout records a newly published build. With staged rollouts
+// enabled and a stable build to fall back on, it becomes the canary;
+// otherwise it is stable straight away. Callers must hold state.Lock.
+func advanceRollout(commit string) {
+	if config.CanaryPercent >= 100 || state.StableCommit == "" {
+		state.StableCommit, state.CanaryCommit = commit, ""
+		return
+	}
+	state.CanaryCommit = commit
+	slog.Info("🐤 Canary build", "event", "canary_started", "commit", commit[:min(8, len(commit))],
+		"percent", config.CanaryPercent, "stable", state.StableCommit[:min(8, len(state.StableCommit))])
+}
+
+// stableBuildFor returns the retained stable build when a canary is out
+// and the requesting device is not in the canary group. Otherwise the
+// request should get the current build and ok is false.
+func stableBuildFor(r *http.Request) (stable RetainedVersion, ok bool) {
+	state.RLock()
+	canary, stableCommit := state.CanaryCommit, state.StableCommit
+	state.RUnlock()
+
+	if canary == "" || inCanary(deviceID(r), config.CanaryPercent) {
+		return RetainedVersion{}, false
+	}
+	stable, err := findRetainedVersion(stableCommit)
+	if err != nil {
+		slog.Warn("⚠️  Stable build is no longer retained, serving canary", "stable", stableCommit, "error", err)
+		return RetainedVersion{}, false
+	}
+	return stable, true
+}
+
+// promoteHandler makes the canary build stable for every device, or with
+// slot=<label> makes that OTA slot the active one.
+func promoteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	if !parseSmallForm(w, r) {
+		return
+	}
+	if slot := r.FormValue("slot"); slot != "" {
+		promoteSlot(w, r, slot)
+		return
+	}
+
+	state.Lock()
+	canary := state.CanaryCommit
+	if canary == "" {
+		state.Unlock()
+		http.Error(w, "No canary build to promote", http.StatusConflict)
+		return
+	}
+	previous := state.StableCommit
+	state.StableCommit, state.CanaryCommit = canary, ""
+	state.Unlock()
+	saveState()
+
+	slog.Info("🚀 Promoted canary to stable", "event", "canary_promoted", "commit", canary[:min(8, len(canary))],
+		"previous", previous[:min(8, len(previous))], "remote_addr", r.RemoteAddr)
+
+	writeJSON(w, map[string]string{"stable": canary, "previous": previous})
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Enough for a release note; a longer backlog is summarised by the count.
+const maxChangelogEntries = 50
+
+// How long pendingChangelog reuses a result while neither the served
+// commit nor the last git check has changed. Other fetches, such as a
+// /check, can also move origin/<branch>, so the result still expires.
+const changelogTTL = time.Minute
+
+// changelogCache holds the last git log pendingChangelog ran, so the
+// dashboard's auto-refresh doesn't run one on every load.
+var changelogCache struct {
+	sync.Mutex
+	from    string
+	checked time.Time
+	at      time.Time
+	changes Changelog
+	err     error
+}
+
+// ChangelogEntry is one commit between the served firmware and origin.
+type ChangelogEntry struct {
+	Commit  string    `json:"commit"`
+	Short   string    `json:"short"`
+	Author  string    `json:"author"`
+	Date    time.Time `json:"date"`
+	Subject string    `json:"subject"`
+}
+
+// CommitInfo says what a commit is: its subject, author and date.
+type CommitInfo struct {
+	Subject string    `json:"subject"`
+	Author  string    `json:"author"`
+	Date    time.Time `json:"date"`
+}
+
+// commitInfo reads a commit's subject, author and date from the checkout.
+// A commit the checkout doesn't have gets the zero CommitInfo.
+func commitInfo(commit string) CommitInfo {
+	if commit == "" || strings.HasPrefix(commit, "-") {
+		return CommitInfo{}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), gitTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, "git", "-C", config.ProjectPath, "show", "-s", "--format=%an%x1f%aI%x1f%s", commit).Output()
+	if err != nil {
+		slog.Debug("📜 Commit details unavailable", "commit", commit, "error", err)
+		return CommitInfo{}
+	}
+	fields := strings.SplitN(strings.TrimSpace(string(output)), "\x1f", 3)
+	if len(fields) != 3 {
+		return CommitInfo{}
+	}
+	date, _ := time.Parse(time.RFC3339, fields[1])
+	return CommitInfo{Subject: fields[2], Author: fields[0], Date: date}
+}
+
+// Changelog is the /changelog document.
+type Changelog struct {
+	From      string           `json:"from"`
+	To        string           `json:"to"`
+	Total     int              `json:"total"`
+	Truncated bool             `json:"truncated,omitempty"`
+	Commits   []ChangelogEntry `json:"commits"`
+}
+
+// pendingChangelog lists the commits on origin/<branch> that the served
+// firmware doesn't include, newest first. It reads the remote-tracking ref
+// left by the last git check rather than fetching.
+func pendingChangelog() (Changelog, error) {
+	state.RLock()
+	from, uploaded, checked := state.LastGitCommit, state.Upload != nil, state.LastCheckTime
+	state.RUnlock()
+	if uploaded || from == "" {
+		return readChangelog(from, uploaded)
+	}
+
+	changelogCache.Lock()
+	defer changelogCache.Unlock()
+	if c := &changelogCache; c.from == from && c.checked.Equal(checked) && time.Since(c.at) < changelogTTL {
+		return c.changes, c.err
+	}
+	changes, err := readChangelog(from, false)
+	changelogCache.from, changelogCache.checked, changelogCache.at = from, checked, time.Now()
+	changelogCache.changes, changelogCache.err = changes, err
+	return changes, err
+}
+
+// readChangelog runs the git log behind pendingChangelog.
+func readChangelog(from string, uploaded bool) (Changelog, error) {
+	changes := Changelog{From: from, To: "origin/" + config.GitBranch, Commits: []ChangelogEntry{}}
+	if uploaded {
+		return changes, fmt.Errorf("the served firmware was uploaded, not built from a commit")
+	}
+	if from == "" {
+		return changes, fmt.Errorf("no firmware built yet")
+	}
+
+	// Fields are separated by US and commits by RS, which can't appear in
+	// author names or subjects
+	ctx, cancel := context.WithTimeout(context.Background(), gitTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, "git", "-C", config.ProjectPath, "log", "--format=%H%x1f%an%x1f%aI%x1f%s%x1e",
+		from+"..refs/remotes/"+changes.To).Output()
+	if err != nil {
+		return changes, fmt.Errorf("git log %s..%s: %w", from[:min(8, len(from))], changes.To, err)
+	}
+	for _, record := range strings.Split(string(output), "\x1e") {
+		fields := strings.Split(strings.TrimSpace(record), "\x1f")
+		if len(fields) != 4 {
+			continue
+		}
+		changes.Total++
+		if len(changes.Commits) == maxChangelogEntries {
+			changes.Truncated = true
+			continue
+		}
+		date, _ := time.Parse(time.RFC3339, fields[2])
+		changes.Commits = append(changes.Commits, ChangelogEntry{
+			Commit:  fields[0],
+			Short:   fields[0][:min(8, len(fields[0]))],
+			Author:  fields[1],
+			Date:    date,
+			Subject: fields[3],
+		})
+	}
+	return changes, nil
+}
+
+// changelogHandler returns the commits waiting to be built as JSON.
+func changelogHandler(w http.ResponseWriter, r *http.Request) {
+	changes, err := pendingChangelog()
+	if err != nil {
+		slog.Debug("📜 Changelog unavailable", "error", err)
+		http.Error(w, "Changelog unavailable: "+err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, changes)
+}
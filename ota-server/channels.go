@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+)
+
+// ReleaseChannel is a ref the git monitor follows besides config.GitBranch,
+// built into its own firmware file. A channel follows either a branch or
+// the newest tag matching a glob, e.g. "v*" for a stable channel that only
+// moves on releases.
+type ReleaseChannel struct {
+	Name   string `json:"name"`
+	Branch string `json:"branch"`
+	Tags   string `json:"tags"`
+	Output string `json:"output"`
+}
+
+func (c ReleaseChannel) follows() string {
+	if c.Tags != "" {
+		return "tags " + c.Tags
+	}
+	return "branch " + c.Branch
+}
+
+// ChannelStatus is the last check and the last build of one channel.
+// Remote is the commit the channel's ref pointed at when last checked.
+type ChannelStatus struct {
+	Name       string    `json:"name"`
+	Follows    string    `json:"follows"`
+	URL        string    `json:"url"`
+	Ref        string    `json:"ref,omitempty"`
+	Commit     string    `json:"commit,omitempty"`
+	Version    string    `json:"version,omitempty"`
+	Size       int64     `json:"size"`
+	LastBuild  time.Time `json:"lastBuild"`
+	Error      string    `json:"error,omitempty"`
+	Remote     string    `json:"remote,omitempty"`
+	LastCheck  time.Time `json:"lastCheck"`
+	CheckError string    `json:"checkError,omitempty"`
+}
+
+// resolveChannels fills in channel defaults and checks the list. Channel
+// names share the /firmware?channel= namespace with the tracked branch,
+// and outputs share the store with the targets.
+func resolveChannels(cfg *Config) error {
+	names := map[string]bool{cfg.GitBranch: true}
+	outputs := map[string]bool{}
+	for _, t := range cfg.Targets {
+		outputs[t.Output] = true
+	}
+	for i := range cfg.Channels {
+		c := &cfg.Channels[i]
+		if !targetNamePattern.MatchString(c.Name) {
+			return fmt.Errorf("channel %d: invalid name %q", i, c.Name)
+		}
+		if (c.Branch == "") == (c.Tags == "") {
+			return fmt.Errorf("channel %s: set exactly one of branch or tags", c.Name)
+		}
+		if strings.HasPrefix(c.Branch, "-") || strings.HasPrefix(c.Tags, "-") {
+			return fmt.Errorf("channel %s: invalid ref", c.Name)
+		}
+		if _, err := path.Match(c.Tags, ""); err != nil {
+			return fmt.Errorf("channel %s: tags: %w", c.Name, err)
+		}
+		if c.Output == "" {
+			c.Output = c.Name + "_" + cfg.FirmwareFile
+		}
+		if !strings.HasSuffix(c.Output, ".bin") || strings.Contains(c.Output, "/") {
+			return fmt.Errorf("channel %s: output must be a plain .bin name, got %q", c.Name, c.Output)
+		}
+		if names[c.Name] || outputs[c.Output] {
+			return fmt.Errorf("channel %s: duplicate name or output", c.Name)
+		}
+		names[c.Name], outputs[c.Output] = true, true
+	}
+	return nil
+}
+
+func findChannel(name string) (ReleaseChannel, bool) {
+	for _, c := range config.Channels {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return ReleaseChannel{}, false
+}
+
+// initChannelStatus seeds per-channel status from the configured channels.
+func initChannelStatus() {
+	state.Lock()
+	defer state.Unlock()
+	state.Channels = make([]ChannelStatus, len(config.Channels))
+	for i, c := range config.Channels {
+		state.Channels[i] = ChannelStatus{Name: c.Name, Follows: c.follows(), URL: "/firmware?channel=" + c.Name}
+		if info, err := firmwareStore.Stat(c.Output); err == nil {
+			state.Channels[i].Size = info.Size
+		}
+	}
+}
+
+// restoreChannelStatus takes the last builds of channels that are still
+// configured from the saved state. Callers must hold state.Lock.
+func restoreChannelStatus(saved []ChannelStatus) {
+	for _, s := range saved {
+		for i := range state.Channels {
+			if c := &state.Channels[i]; c.Name == s.Name {
+				c.Ref, c.Commit, c.Version, c.LastBuild, c.Error = s.Ref, s.Commit, s.Version, s.LastBuild, s.Error
+				c.Remote, c.LastCheck = s.Remote, s.LastCheck
+			}
+		}
+	}
+}
+
+// channelStatus returns a channel's status. Callers must hold state.RLock.
+func channelStatus(name string) ChannelStatus {
+	for _, c := range state.Channels {
+		if c.Name == name {
+			return c
+		}
+	}
+	return ChannelStatus{}
+}
+
+// latestChannelRef returns the ref a channel should be built from and its
+// commit: the remote-tracking branch, or the highest matching tag by
+// version order. Callers must hold gitCheck and have fetched.
+func latestChannelRef(c ReleaseChannel) (ref, commit string, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), gitTimeout)
+	defer cancel()
+	ref = "refs/remotes/origin/" + c.Branch
+	if c.Tags != "" {
+		output, err := exec.CommandContext(ctx, "git", "-C", config.ProjectPath, "for-each-ref", "--sort=-v:refname", "--count=1",
+			"--format=%(refname)", "refs/tags/"+c.Tags).Output()
+		if err != nil {
+			return "", "", fmt.Errorf("git for-each-ref: %w", err)
+		}
+		if ref = strings.TrimSpace(string(output)); ref == "" {
+			return "", "", nil
+		}
+	}
+	output, err := exec.CommandContext(ctx, "git", "-C", config.ProjectPath, "rev-parse", "--verify", "--quiet", ref+"^{commit}").Output()
+	if err != nil {
+		return "", "", fmt.Errorf("unknown ref %s", ref)
+	}
+	ref = strings.TrimPrefix(strings.TrimPrefix(ref, "refs/remotes/"), "refs/tags/")
+	return ref, strings.TrimSpace(string(output)), nil
+}
+
+// startChannelMonitors starts a monitor for every channel, independent of
+// the tracked branch's git monitor, so a slow fetch or broken ref on one
+// branch doesn't hold up the others. Builds still go through the one build
+// queue, so only one runs at a time.
+func startChannelMonitors() {
+	for _, c := range config.Channels {
+		go monitorChannel(c)
+	}
+}
+
+// monitorChannel checks c on startup and then on the git monitor's
+// cadence, see nextCheck.
+// A check that panics is logged and the next one runs as usual.
+func monitorChannel(c ReleaseChannel) {
+	var next time.Time
+	for {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					slog.Error("💥 Channel monitor panicked", "event", "monitor_panic", "channel", c.Name, "panic", fmt.Sprint(r))
+				}
+			}()
+			checkChannel(c)
+		}()
+		next = nextCheck(next, time.Now())
+		time.Sleep(time.Until(next))
+	}
+}
+
+// checkChannel fetches c's ref and queues a build if it has moved past the
+// channel's last build. The outcome is recorded in the channel's status.
+func checkChannel(c ReleaseChannel) {
+	if buildsPaused() {
+		return
+	}
+	// Fetches share the checkout's object store and refs with every other
+	// monitor
+	gitCheck.Lock()
+	ref, commit, err := fetchChannel(c)
+	gitCheck.Unlock()
+
+	state.Lock()
+	built := ""
+	for i := range state.Channels {
+		if s := &state.Channels[i]; s.Name == c.Name {
+			s.LastCheck, s.CheckError, built = time.Now(), "", s.Commit
+			if err != nil {
+				s.CheckError = err.Error()
+			} else {
+				s.Remote = commit
+			}
+		}
+	}
+	state.Unlock()
+
+	if err != nil {
+		slog.Error("❌ Channel check failed", "event", "channel_fetch_failed", "channel", c.Name, "follows", c.follows(), "error", err)
+		return
+	}
+	if commit == "" || commit == built {
+		return
+	}
+	slog.Info("📡 Channel moved", "event", "channel_update", "channel", c.Name, "ref", ref, "commit", commit[:min(8, len(commit))])
+	enqueueBuild(BuildRequest{Reason: buildReasonGit, Channel: c.Name, Ref: ref, Commit: commit})
+}
+
+// fetchChannel fetches just c's branch, or the tags for a tag channel, and
+// resolves its latest ref. Callers must hold gitCheck.
+func fetchChannel(c ReleaseChannel) (ref, commit string, err error) {
+	args := []string{"--quiet", "--force", "--tags", "origin"}
+	if c.Branch != "" {
+		args = []string{"--quiet", "--force", "--no-tags", "origin", "+refs/heads/" + c.Branch + ":refs/remotes/origin/" + c.Branch}
+	}
+	if err := gitFetch(args...); err != nil {
+		return "", "", err
+	}
+	return latestChannelRef(c)
+}
+
+// buildChannel builds a channel's commit with the primary target and
+// publishes it as the channel's output. The commit is checked out in the
+// channel's own worktree, so the tracked branch's checkout, firmware,
+// rollout and history of published images are left alone. It is only
+// called by the build worker.
+func buildChannel(req BuildRequest) error {
+	channel, ok := findChannel(req.Channel)
+	if !ok {
+		slog.Warn("⚠️  Dropping build for unknown channel", "channel", req.Channel)
+		return fmt.Errorf("unknown channel %q", req.Channel)
+	}
+	target := config.Targets[0]
+	target.Output = channel.Output
+
+	// Like buildFirmware, hold the build slot so rollbacks and uploads wait
+	// for the build and the serve policy applies while it runs
+	state.Lock()
+	for state.BuildInProgress {
+		buildDone.Wait()
+	}
+	if shuttingDown.Load() {
+		state.Unlock()
+		slog.Warn("⚠️  Shutting down, not starting a channel build", "channel", channel.Name)
+		return errors.New("shutting down")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	state.BuildInProgress = true
+	state.RunningBuild, state.CancelBuild = req, cancel
+	state.Unlock()
+	defer func() {
+		cancel()
+		state.Lock()
+		state.BuildInProgress = false
+		state.RunningBuild, state.CancelBuild = BuildRequest{}, nil
+		buildDone.Broadcast()
+		state.Unlock()
+		saveState()
+	}()
+
+	slog.Info("🔨 Starting channel build...", "event", "channel_build_started", "channel", channel.Name, "ref", req.Ref)
+	startTime := time.Now()
+
+	dockerHost.Lock()
+	defer dockerHost.Unlock()
+
+	var output strings.Builder
+	buildLog := startBuildLog(req.Commit)
+	attempts := 0
+	var signer string
+	err := ensureDiskSpace()
+	if err == nil {
+		gitCheck.Lock()
+		target.Source, err = checkoutWorktree(channel.Name, req.Commit)
+		gitCheck.Unlock()
+	}
+	if err == nil {
+		signer, err = verifySignature(ctx, req.Ref, req.Commit)
+	}
+	if err == nil {
+		_, attempts, err = runTargetBuildWithRetry(ctx, target, io.MultiWriter(&output, buildLog))
+	}
+	if err == nil {
+		err = publishTarget(target)
+	}
+	buildLog.finish(err)
+
+	toolchain := parseToolchain([]byte(output.String()))
+	record := BuildRecord{
+		Commit:          req.Commit,
+		Ref:             req.Ref,
+		Channel:         channel.Name,
+		Trigger:         req.Reason,
+		StartTime:       startTime,
+		DurationSeconds: time.Since(startTime).Seconds(),
+		Success:         err == nil,
+		Aborted:         errors.Is(err, errBuildAborted),
+		Attempts:        attempts,
+		IDFVersion:      toolchain.IDFVersion,
+		CompilerVersion: toolchain.CompilerVersion,
+		LogFile:         buildLog.File,
+		Signer:          signer,
+	}
+	if err != nil {
+		record.Error = err.Error()
+		slog.Error("❌ Channel build failed", "event", "channel_build_failed", "channel", channel.Name, "ref", req.Ref,
+			"error", err, "output", output.String())
+	}
+
+	state.Lock()
+	defer state.Unlock()
+	for i := range state.Channels {
+		c := &state.Channels[i]
+		if c.Name != channel.Name {
+			continue
+		}
+		c.LastBuild, c.Error = time.Now(), record.Error
+		if err != nil {
+			break
+		}
+		c.Ref, c.Commit = req.Ref, req.Commit
+		if obj, err := firmwareStore.Open(channel.Output); err == nil {
+			c.Size, c.Version = obj.Size, readFirmwareVersion(obj.Content)
+			record.FirmwareSize = obj.Size
+			obj.Close()
+		}
+		slog.Info("✅ Channel build completed", "event", "channel_build_completed", "channel", channel.Name, "ref", req.Ref,
+			"commit", req.Commit[:min(8, len(req.Commit))], "version", c.Version)
+	}
+	appendBuildRecord(record)
+	return err
+}
+
+// channelFirmwareHandler serves /firmware?channel=<name>. The tracked
+// branch's channel is the regular firmware.
+func channelFirmwareHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("channel")
+	if name == config.GitBranch {
+		serveFirmware(w, r)
+		return
+	}
+	channel, ok := findChannel(name)
+	if !ok {
+		http.Error(w, "Unknown channel "+name, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("X-OTA-Channel", channel.Name)
+	servePublishedFirmware(w, r, channel.Name, channel.Output)
+}
+
+// firmwareQueryHandler serves /firmware?channel=<name> and
+// /firmware?slot=<label>, and takes uploads with PUT and POST.
+func firmwareQueryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut || r.Method == http.MethodPost {
+		uploadFirmwareHandler(w, r)
+		return
+	}
+	if r.URL.Query().Has("channel") {
+		channelFirmwareHandler(w, r)
+		return
+	}
+	slotFirmwareHandler(w, r)
+}
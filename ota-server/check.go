@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UpdateCheck compares the checkout with config.GitBranch on origin.
+type UpdateCheck struct {
+	Branch  string `json:"branch"`
+	Local   string `json:"local"`
+	Remote  string `json:"remote"`
+	Behind  int    `json:"behind"`
+	Pending bool   `json:"pending"`
+
+	CheckedAt time.Time `json:"checkedAt"`
+}
+
+// checkCacheTTL is how long /check answers from its last fetch, so clients
+// polling it can't make the server fetch from origin on every request.
+const checkCacheTTL = 1 * time.Minute
+
+// lastCheck is the last /check result, guarded by gitCheck. checkAndBuild
+// clears it when it moves the checkout.
+var lastCheck UpdateCheck
+
+// fetchUpdates fetches config.GitBranch into origin/<branch> and reports
+// whether the checkout is behind it. Only that remote-tracking ref changes;
+// the working tree and HEAD are left alone. While a ref build has the
+// checkout detached, the branch it was on is compared instead of HEAD.
+// Callers must hold gitCheck.
+func fetchUpdates() (UpdateCheck, error) {
+	check := UpdateCheck{Branch: config.GitBranch}
+	refspec := fmt.Sprintf("+refs/heads/%s:refs/remotes/origin/%s", config.GitBranch, config.GitBranch)
+	if err := gitFetch("--quiet", "--no-tags", "origin", refspec); err != nil {
+		return check, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), gitTimeout)
+	defer cancel()
+	remote, err := exec.CommandContext(ctx, "git", "-C", config.ProjectPath, "rev-parse", "--verify", "--quiet", "refs/remotes/origin/"+config.GitBranch+"^{commit}").Output()
+	if err != nil {
+		return check, fmt.Errorf("git rev-parse origin/%s: %v", config.GitBranch, err)
+	}
+	local, err := exec.CommandContext(ctx, "git", "-C", config.ProjectPath, "rev-parse", "--verify", "--quiet", "HEAD^{commit}").Output()
+	if err != nil {
+		return check, fmt.Errorf("git rev-parse HEAD: %v", err)
+	}
+	check.Local = strings.TrimSpace(string(local))
+	check.Remote = strings.TrimSpace(string(remote))
+
+	count, err := exec.CommandContext(ctx, "git", "-C", config.ProjectPath, "rev-list", "--count", check.Local+".."+check.Remote).Output()
+	if err != nil {
+		return check, fmt.Errorf("git rev-list: %v", err)
+	}
+	check.Behind, _ = strconv.Atoi(strings.TrimSpace(string(count)))
+	check.Pending = check.Local != check.Remote && check.Behind > 0
+	return check, nil
+}
+
+// checkHandler reports whether a rebuild is pending without pulling or
+// building, so CI can decide whether to schedule one. A result less than
+// checkCacheTTL old is served without fetching again.
+func checkHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	gitCheck.Lock()
+	check, err, cached := lastCheck, error(nil), time.Since(lastCheck.CheckedAt) < checkCacheTTL
+	if !cached {
+		check, err = fetchUpdates()
+		check.CheckedAt = time.Now()
+		if err == nil {
+			lastCheck = check
+		}
+	}
+	gitCheck.Unlock()
+	if err != nil {
+		slog.Error("❌ Update check failed", "event", "update_check_failed", "error", err)
+		http.Error(w, "Update check failed: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	check.Local = check.Local[:min(8, len(check.Local))]
+	check.Remote = check.Remote[:min(8, len(check.Remote))]
+	slog.Info("🔍 Update check", "event", "update_check", "local", check.Local, "remote", check.Remote,
+		"behind", check.Behind, "cached", cached, "remote_addr", r.RemoteAddr)
+	writeJSON(w, check)
+}
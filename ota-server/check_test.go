@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCheckHandlerCachesFetch(t *testing.T) {
+	useTestFirmware(t, testImage("1.0.0", 'A', 4096))
+	origin, commits := testRepo(t, "1.0.0", "1.1.0")
+	project := filepath.Join(t.TempDir(), "project")
+	for _, args := range [][]string{{"clone", "--quiet", origin, project}, {"-C", project, "reset", "--quiet", "--hard", commits[0]}} {
+		if output, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, output)
+		}
+	}
+	config.ProjectPath, config.GitBranch = project, "main"
+	gitCheck.Lock()
+	lastCheck = UpdateCheck{}
+	gitCheck.Unlock()
+
+	check := func() (int, UpdateCheck) {
+		w := httptest.NewRecorder()
+		checkHandler(w, httptest.NewRequest(http.MethodGet, "/check", nil))
+		var got UpdateCheck
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, got
+	}
+
+	code, first := check()
+	if code != http.StatusOK || !first.Pending || first.Behind != 1 || first.Remote != commits[1][:8] {
+		t.Fatalf("first check: status %d, %+v", code, first)
+	}
+
+	// With origin gone a fetch fails, so a successful answer must be cached
+	if err := os.RemoveAll(origin); err != nil {
+		t.Fatal(err)
+	}
+	code, second := check()
+	if code != http.StatusOK || second != first {
+		t.Fatalf("cached check: status %d, %+v, want %+v", code, second, first)
+	}
+
+	gitCheck.Lock()
+	lastCheck.CheckedAt = time.Now().Add(-checkCacheTTL)
+	gitCheck.Unlock()
+	if code, _ := check(); code != http.StatusBadGateway {
+		t.Fatalf("expired cache: status %d, want %d", code, http.StatusBadGateway)
+	}
+}
+
+func TestNextCheck(t *testing.T) {
+	savedConfig := config
+	t.Cleanup(func() { config = savedConfig })
+	now := time.Date(2024, 5, 1, 12, 30, 0, 0, time.Local)
+
+	tests := []struct {
+		name     string
+		schedule string
+		last     time.Time
+		want     time.Time
+	}{
+		{name: "first check", want: now.Add(time.Hour)},
+		{name: "keeps the cadence", last: now.Add(-10 * time.Minute), want: now.Add(50 * time.Minute)},
+		{name: "overdue check", last: now.Add(-2 * time.Hour), want: now.Add(time.Hour)},
+		{name: "schedule", schedule: "0 1-5 * * *", last: now.Add(-10 * time.Minute),
+			want: time.Date(2024, 5, 2, 1, 0, 0, 0, time.Local)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config = defaultConfig()
+			config.CheckInterval = time.Hour
+			if tt.schedule != "" {
+				schedule, err := parseCronSchedule(tt.schedule)
+				if err != nil {
+					t.Fatal(err)
+				}
+				config.schedule = schedule
+			}
+			if got := nextCheck(tt.last, now); !got.Equal(tt.want) {
+				t.Errorf("next check %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
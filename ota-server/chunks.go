@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const defaultChunkSize = 64 << 10
+
+// Chunk describes one fixed-size slice of the firmware image. Devices fetch
+// it with "Range: bytes=<offset>-<offset+length-1>" and check the SHA256.
+type Chunk struct {
+	Index  int    `json:"index"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+	SHA256 string `json:"sha256"`
+}
+
+// ChunkManifest lists the chunks of a firmware image. Devices send ETag as
+// If-Range with every chunk after the first, so the download is only
+// counted against the rate limits once.
+type ChunkManifest struct {
+	Version   string    `json:"version"`
+	ETag      string    `json:"etag"`
+	Size      int64     `json:"size"`
+	ChunkSize int64     `json:"chunkSize"`
+	ModTime   time.Time `json:"modTime"`
+	Chunks    []Chunk   `json:"chunks"`
+}
+
+var chunkCache struct {
+	sync.Mutex
+	manifest *ChunkManifest
+}
+
+// chunkManifest returns the chunk manifest for the stored firmware image
+// name. It is computed after each build and recomputed only if the image
+// has changed. The image is opened once, so the size, modification time
+// and digests all describe the same bytes even if a build publishes
+// meanwhile.
+func chunkManifest(name string) (*ChunkManifest, error) {
+	obj, err := firmwareStore.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+	info := obj.FirmwareInfo
+
+	chunkCache.Lock()
+	defer chunkCache.Unlock()
+
+	size := config.ChunkSize
+	if m := chunkCache.manifest; m != nil && m.ModTime.Equal(info.ModTime) && m.Size == info.Size && m.ChunkSize == size {
+		return m, nil
+	}
+
+	m := &ChunkManifest{
+		Version:   readFirmwareVersion(obj.Content),
+		Size:      info.Size,
+		ChunkSize: size,
+		ModTime:   info.ModTime,
+	}
+	image := sha256.New()
+	buf := make([]byte, size)
+	for offset := int64(0); offset < info.Size; offset += size {
+		n, err := io.ReadFull(io.NewSectionReader(obj.Content, offset, size), buf)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		image.Write(buf[:n])
+		sum := sha256.Sum256(buf[:n])
+		m.Chunks = append(m.Chunks, Chunk{
+			Index:  len(m.Chunks),
+			Offset: offset,
+			Length: int64(n),
+			SHA256: hex.EncodeToString(sum[:]),
+		})
+	}
+
+	m.ETag = FirmwareDigest{SHA256: hex.EncodeToString(image.Sum(nil)), ModTime: m.ModTime}.ETag()
+
+	chunkCache.manifest = m
+	return m, nil
+}
+
+func chunksHandler(w http.ResponseWriter, r *http.Request) {
+	m, err := chunkManifest(config.FirmwareFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		http.Error(w, "Firmware not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("❌ Failed to build chunk manifest", "error", err)
+		http.Error(w, "Failed to read firmware", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, m)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// resolveCommitSigning checks that REQUIRE_SIGNED_COMMITS has a keyring to
+// verify against.
+func resolveCommitSigning(cfg *Config) error {
+	if !cfg.RequireSignedCommits {
+		return nil
+	}
+	if cfg.CommitKeyring == "" {
+		return errors.New("REQUIRE_SIGNED_COMMITS needs COMMIT_KEYRING, a GnuPG home directory with the trusted keys")
+	}
+	if info, err := os.Stat(cfg.CommitKeyring); err != nil || !info.IsDir() {
+		return fmt.Errorf("commit keyring %s is not a directory", cfg.CommitKeyring)
+	}
+	return nil
+}
+
+// verifySignature checks the signature of the tag ref, when ref names a
+// tag, or else of commit, against config.CommitKeyring, and returns the
+// signer as "<uid> (<key id>)". It returns "" and no error when signed
+// commits aren't required.
+func verifySignature(ctx context.Context, ref, commit string) (signer string, err error) {
+	if !config.RequireSignedCommits {
+		return "", nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, gitTimeout)
+	defer cancel()
+	what, args := "commit "+commit[:min(8, len(commit))], []string{"verify-commit", "--raw", commit}
+	if ref != "" && exec.CommandContext(ctx, "git", "-C", config.ProjectPath, "rev-parse", "--verify", "--quiet", "refs/tags/"+ref).Run() == nil {
+		what, args = "tag "+ref, []string{"verify-tag", "--raw", "refs/tags/" + ref}
+	}
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-C", config.ProjectPath}, args...)...)
+	cmd.Env = append(os.Environ(), "GNUPGHOME="+config.CommitKeyring)
+	output, runErr := cmd.CombinedOutput()
+
+	// --raw prints gpg's status lines, e.g. "[GNUPG:] GOODSIG <key id> <uid>"
+	status := map[string]string{}
+	for _, line := range strings.Split(string(output), "\n") {
+		if rest, ok := strings.CutPrefix(line, "[GNUPG:] "); ok {
+			keyword, args, _ := strings.Cut(rest, " ")
+			status[keyword] = args
+		}
+	}
+	if args, ok := status["GOODSIG"]; ok && runErr == nil {
+		keyID, uid, _ := strings.Cut(args, " ")
+		return fmt.Sprintf("%s (%s)", uid, keyID), nil
+	}
+	switch {
+	case status["BADSIG"] != "":
+		return "", fmt.Errorf("%s has a bad signature", what)
+	case status["EXPKEYSIG"] != "":
+		return "", fmt.Errorf("%s is signed with an expired key", what)
+	case status["REVKEYSIG"] != "":
+		return "", fmt.Errorf("%s is signed with a revoked key", what)
+	case status["NO_PUBKEY"] != "":
+		return "", fmt.Errorf("%s is signed by key %s, which is not in the keyring", what, status["NO_PUBKEY"])
+	case len(status) == 0 && ctx.Err() == nil:
+		return "", fmt.Errorf("%s is not signed", what)
+	}
+	return "", fmt.Errorf("could not verify %s: %v: %s", what, runErr, strings.TrimSpace(string(output)))
+}
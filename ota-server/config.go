@@ -0,0 +1,623 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the server's deployment settings. Defaults are overridden
+// by the JSON file given with -config (or OTA_CONFIG), and that in turn by
+// environment variables, so one binary can serve several branches.
+type Config struct {
+	Port            string        `json:"port"`
+	FirmwarePath    string        `json:"firmwarePath"`
+	FirmwareFile    string        `json:"firmwareFile"`
+	ProjectPath     string        `json:"projectPath"`
+	GitBranch       string        `json:"gitBranch"`
+	GitRepoURL      string        `json:"gitRepoUrl"`
+	AdminToken      string        `json:"adminToken"`
+	SigningKey      string        `json:"signingKey"`
+	NotifyWebhook   string        `json:"notifyWebhook"`
+	LogFormat       string        `json:"logFormat"`
+	LogLevel        string        `json:"logLevel"`
+	TLSPort         string        `json:"tlsPort"`
+	TLSCert         string        `json:"tlsCert"`
+	TLSKey          string        `json:"tlsKey"`
+	TLSSelfSigned   bool          `json:"tlsSelfSigned"`
+	TLSRedirect     bool          `json:"tlsRedirect"`
+	CheckInterval   time.Duration `json:"-"`
+	BuildTimeout    time.Duration `json:"-"`
+	ShutdownTimeout time.Duration `json:"-"`
+	BuildDebounce   time.Duration `json:"-"`
+
+	// Cron expression for git checks instead of CheckInterval, see cron.go
+	CheckSchedule string `json:"checkSchedule"`
+	schedule      *cronSchedule
+
+	// App partition size in bytes and the share of it that warns, see
+	// firmwareSizeUsage; bigger images fail the build
+	MaxFirmwareSize         int64 `json:"maxFirmwareSize"`
+	FirmwareSizeWarnPercent int   `json:"firmwareSizeWarnPercent"`
+
+	// Build on startup even if the published firmware is up to date
+	ForceInitialBuild bool `json:"forceInitialBuild"`
+
+	// Probe the build backend from /health and /ready, see buildBackendHealth
+	HealthCheckBackend bool `json:"healthCheckBackend"`
+
+	// Long-polling /version?wait=, see waitForUpdate; a 0 LongPollMax disables it
+	LongPollMax     time.Duration `json:"-"`
+	LongPollWaiters int           `json:"longPollWaiters"`
+
+	// HTTP server timeouts, see newHTTPServer; 0 disables one
+	HTTPReadHeaderTimeout time.Duration `json:"-"`
+	HTTPReadTimeout       time.Duration `json:"-"`
+	HTTPWriteTimeout      time.Duration `json:"-"`
+	HTTPIdleTimeout       time.Duration `json:"-"`
+
+	// Firmware download limits in requests per minute; 0 disables them
+	DownloadRate       int      `json:"downloadRate"`
+	DownloadBurst      int      `json:"downloadBurst"`
+	GlobalDownloadRate int      `json:"globalDownloadRate"`
+	RateLimitExempt    []string `json:"rateLimitExempt"`
+
+	// Server-wide access control, see access.go; empty settings disable it
+	BasicAuthUser     string   `json:"basicAuthUser"`
+	BasicAuthPassword string   `json:"basicAuthPassword"`
+	AllowedNetworks   []string `json:"allowedNetworks"`
+	AccessExempt      []string `json:"accessExempt"`
+
+	// Cross-origin access to the read-only endpoints, see cors.go; off
+	// without origins
+	CORSOrigins []string `json:"corsOrigins"`
+	CORSMethods []string `json:"corsMethods"`
+
+	// Build backend, see buildbackend.go; Docker settings apply to every target
+	BuildBackend  string   `json:"buildBackend"`
+	DockerVolumes []string `json:"dockerVolumes"`
+	DockerArgs    []string `json:"dockerArgs"`
+
+	// Targets built at once, see buildTargets
+	BuildParallelism int `json:"buildParallelism"`
+
+	// Shell commands run around each build, see runBuildHook
+	PreBuildHook  string `json:"preBuildHook"`
+	PostBuildHook string `json:"postBuildHook"`
+	HookFailure   string `json:"hookFailure"`
+
+	// Refuse to build commits or tags without a good signature from a key
+	// in the CommitKeyring GnuPG home, see verifySignature
+	RequireSignedCommits bool   `json:"requireSignedCommits"`
+	CommitKeyring        string `json:"commitKeyring"`
+
+	// Share of devices, by hashed device ID, that get a new build before it
+	// is promoted, see advanceRollout; 100 sends every build to everyone
+	CanaryPercent int `json:"canaryPercent"`
+
+	// Archived builds kept for rollback and pinned downloads, see
+	// pruneRetainedVersions
+	RetainVersions int `json:"retainVersions"`
+
+	// Where images live, see newFirmwareStore: "local", or "http" to mirror
+	// the primary at MirrorURL, refreshed every MirrorSync
+	FirmwareStore string        `json:"firmwareStore"`
+	MirrorURL     string        `json:"mirrorUrl"`
+	MirrorSync    time.Duration `json:"-"`
+
+	// Daily update windows by group and the server-side device to group
+	// mapping, see updateWindowFor; ForceUpdate ignores the windows and
+	// tells devices to update, ForceUpdateFor does so only for the listed
+	// groups and device IDs
+	UpdateWindows  map[string]string `json:"updateWindows"`
+	DeviceGroups   map[string]string `json:"deviceGroups"`
+	ForceUpdate    bool              `json:"forceUpdate"`
+	ForceUpdateFor []string          `json:"forceUpdateFor"`
+	groupWindows   map[string]updateWindow
+
+	// Secret GitHub signs webhook deliveries with; /webhook is off without it
+	WebhookSecret string `json:"webhookSecret"`
+
+	// Dashboard template replacing the embedded one, see rootHandler
+	DashboardTemplate string `json:"dashboardTemplate"`
+	dashboard         *template.Template
+
+	// Size of the slices in the /chunks manifest, in bytes
+	ChunkSize int64 `json:"chunkSize"`
+
+	// Where /flags are loaded from and saved to; empty keeps them in memory
+	FeatureFlagsFile string `json:"featureFlagsFile"`
+
+	// How firmware requests are answered during a build, see applyServePolicy
+	BuildServePolicy string        `json:"buildServePolicy"`
+	BuildHoldTimeout time.Duration `json:"-"`
+
+	// Periodic Docker image and build cache pruning, see pruneMonitor; a 0
+	// interval disables it
+	DockerPruneInterval  time.Duration `json:"-"`
+	DockerPruneRetention time.Duration `json:"-"`
+
+	// How long a commit may sit on origin unbuilt before the served
+	// firmware counts as stale, see firmwareStale
+	StaleAfter time.Duration `json:"-"`
+
+	// Free space builds need on the firmware and project paths, see
+	// ensureDiskSpace; 0 disables the check
+	MinFreeDiskMB        int  `json:"minFreeDiskMb"`
+	DockerPruneOnLowDisk bool `json:"dockerPruneOnLowDisk"`
+
+	// StatsD host:port rollout metrics are pushed to, see metricsPusher;
+	// empty disables pushing
+	MetricsPushAddr     string        `json:"metricsPushAddr"`
+	MetricsPushInterval time.Duration `json:"-"`
+	MetricsPushPrefix   string        `json:"metricsPushPrefix"`
+
+	Targets  []FirmwareTarget `json:"targets"`
+	Channels []ReleaseChannel `json:"channels"`
+}
+
+// config is the resolved configuration. It is set once in main before any
+// goroutines or handlers start and is read-only afterwards.
+var config = defaultConfig()
+
+func defaultConfig() Config {
+	return Config{
+		Port:            "8080",
+		FirmwarePath:    "/firmware",
+		FirmwareFile:    "beacon_firmware.bin",
+		ProjectPath:     "/project",
+		GitBranch:       "main",
+		LogFormat:       "pretty",
+		LogLevel:        "info",
+		TLSPort:         "8443",
+		CheckInterval:   1 * time.Hour,
+		BuildTimeout:    15 * time.Minute,
+		ShutdownTimeout: 60 * time.Second,
+		BuildDebounce:   30 * time.Second,
+
+		HTTPReadHeaderTimeout: 10 * time.Second,
+		HTTPReadTimeout:       30 * time.Second,
+		HTTPWriteTimeout:      5 * time.Minute,
+		HTTPIdleTimeout:       2 * time.Minute,
+
+		BuildParallelism: 1,
+
+		MaxFirmwareSize:         defaultMaxFirmwareSize,
+		FirmwareSizeWarnPercent: 90,
+
+		LongPollMax:     5 * time.Minute,
+		LongPollWaiters: 256,
+
+		CanaryPercent:  100,
+		RetainVersions: defaultRetainedVersions,
+		FirmwareStore:  firmwareStoreLocal,
+		MirrorSync:     5 * time.Minute,
+
+		dashboard:        defaultDashboard,
+		ChunkSize:        defaultChunkSize,
+		BuildServePolicy: servePolicyServeOld,
+		BuildHoldTimeout: defaultHoldTimeout,
+
+		DockerPruneRetention: 7 * 24 * time.Hour,
+		MinFreeDiskMB:        defaultMinFreeMB,
+		StaleAfter:           defaultStaleAfter,
+
+		MetricsPushInterval: 1 * time.Minute,
+		MetricsPushPrefix:   "ota",
+	}
+}
+
+// loadConfig resolves the configuration from defaults, the optional JSON
+// file at path, and then the environment; README.md lists the variables.
+func loadConfig(path string) (Config, error) {
+	cfg := defaultConfig()
+
+	var interval, buildTimeout, shutdownTimeout, debounce string
+	var readHeaderTimeout, readTimeout, writeTimeout, idleTimeout, longPollMax string
+	var mirrorSync, holdTimeout, pruneInterval, pruneRetention, staleAfter, pushInterval string
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return Config{}, err
+		}
+		file := struct {
+			*Config
+			CheckInterval   string `json:"checkInterval"`
+			BuildTimeout    string `json:"buildTimeout"`
+			ShutdownTimeout string `json:"shutdownTimeout"`
+			BuildDebounce   string `json:"buildDebounce"`
+
+			HTTPReadHeaderTimeout string `json:"httpReadHeaderTimeout"`
+			HTTPReadTimeout       string `json:"httpReadTimeout"`
+			HTTPWriteTimeout      string `json:"httpWriteTimeout"`
+			HTTPIdleTimeout       string `json:"httpIdleTimeout"`
+			LongPollMax           string `json:"longPollMax"`
+
+			MirrorSync           string `json:"mirrorSync"`
+			BuildHoldTimeout     string `json:"buildHoldTimeout"`
+			DockerPruneInterval  string `json:"dockerPruneInterval"`
+			DockerPruneRetention string `json:"dockerPruneRetention"`
+			StaleAfter           string `json:"staleAfter"`
+			MetricsPushInterval  string `json:"metricsPushInterval"`
+		}{Config: &cfg}
+		if err := json.Unmarshal(data, &file); err != nil {
+			return Config{}, fmt.Errorf("%s: %w", path, err)
+		}
+		interval, buildTimeout, shutdownTimeout = file.CheckInterval, file.BuildTimeout, file.ShutdownTimeout
+		debounce = file.BuildDebounce
+		readHeaderTimeout, readTimeout = file.HTTPReadHeaderTimeout, file.HTTPReadTimeout
+		writeTimeout, idleTimeout = file.HTTPWriteTimeout, file.HTTPIdleTimeout
+		longPollMax = file.LongPollMax
+		mirrorSync, holdTimeout = file.MirrorSync, file.BuildHoldTimeout
+		pruneInterval, pruneRetention = file.DockerPruneInterval, file.DockerPruneRetention
+		staleAfter, pushInterval = file.StaleAfter, file.MetricsPushInterval
+	}
+
+	for env, field := range map[string]*string{
+		"PORT":                 &cfg.Port,
+		"FIRMWARE_PATH":        &cfg.FirmwarePath,
+		"FIRMWARE_FILE":        &cfg.FirmwareFile,
+		"PROJECT_PATH":         &cfg.ProjectPath,
+		"GIT_BRANCH":           &cfg.GitBranch,
+		"GIT_REPO_URL":         &cfg.GitRepoURL,
+		"CHECK_SCHEDULE":       &cfg.CheckSchedule,
+		"BASIC_AUTH_USER":      &cfg.BasicAuthUser,
+		"BASIC_AUTH_PASSWORD":  &cfg.BasicAuthPassword,
+		"OTA_ADMIN_TOKEN":      &cfg.AdminToken,
+		"FIRMWARE_SIGNING_KEY": &cfg.SigningKey,
+		"NOTIFY_WEBHOOK_URL":   &cfg.NotifyWebhook,
+		"LOG_FORMAT":           &cfg.LogFormat,
+		"LOG_LEVEL":            &cfg.LogLevel,
+		"BUILD_BACKEND":        &cfg.BuildBackend,
+		"PRE_BUILD_HOOK":       &cfg.PreBuildHook,
+		"POST_BUILD_HOOK":      &cfg.PostBuildHook,
+		"HOOK_FAILURE":         &cfg.HookFailure,
+		"COMMIT_KEYRING":       &cfg.CommitKeyring,
+		"TLS_PORT":             &cfg.TLSPort,
+		"TLS_CERT_FILE":        &cfg.TLSCert,
+		"TLS_KEY_FILE":         &cfg.TLSKey,
+		"CHECK_INTERVAL":       &interval,
+		"BUILD_TIMEOUT":        &buildTimeout,
+		"SHUTDOWN_TIMEOUT":     &shutdownTimeout,
+		"BUILD_DEBOUNCE":       &debounce,
+
+		"HTTP_READ_HEADER_TIMEOUT": &readHeaderTimeout,
+		"HTTP_READ_TIMEOUT":        &readTimeout,
+		"HTTP_WRITE_TIMEOUT":       &writeTimeout,
+		"HTTP_IDLE_TIMEOUT":        &idleTimeout,
+		"LONG_POLL_MAX":            &longPollMax,
+
+		"FIRMWARE_STORE":         &cfg.FirmwareStore,
+		"FIRMWARE_MIRROR_URL":    &cfg.MirrorURL,
+		"FIRMWARE_MIRROR_SYNC":   &mirrorSync,
+		"GITHUB_WEBHOOK_SECRET":  &cfg.WebhookSecret,
+		"DASHBOARD_TEMPLATE":     &cfg.DashboardTemplate,
+		"FEATURE_FLAGS_FILE":     &cfg.FeatureFlagsFile,
+		"BUILD_SERVE_POLICY":     &cfg.BuildServePolicy,
+		"BUILD_HOLD_TIMEOUT":     &holdTimeout,
+		"DOCKER_PRUNE_INTERVAL":  &pruneInterval,
+		"DOCKER_PRUNE_RETENTION": &pruneRetention,
+		"STALE_FIRMWARE_AFTER":   &staleAfter,
+		"METRICS_PUSH_ADDR":      &cfg.MetricsPushAddr,
+		"METRICS_PUSH_INTERVAL":  &pushInterval,
+		"METRICS_PUSH_PREFIX":    &cfg.MetricsPushPrefix,
+	} {
+		if value := os.Getenv(env); value != "" {
+			*field = value
+		}
+	}
+
+	for env, field := range map[string]*bool{
+		"TLS_SELF_SIGNED":      &cfg.TLSSelfSigned,
+		"TLS_REDIRECT_HTTP":    &cfg.TLSRedirect,
+		"FORCE_INITIAL_BUILD":  &cfg.ForceInitialBuild,
+		"HEALTH_CHECK_BACKEND": &cfg.HealthCheckBackend,
+
+		"REQUIRE_SIGNED_COMMITS": &cfg.RequireSignedCommits,
+		"FORCE_OTA_UPDATE":       &cfg.ForceUpdate,
+
+		"DOCKER_PRUNE_ON_LOW_DISK": &cfg.DockerPruneOnLowDisk,
+	} {
+		if value := os.Getenv(env); value != "" {
+			parsed, err := strconv.ParseBool(value)
+			if err != nil {
+				return Config{}, fmt.Errorf("%s: %w", env, err)
+			}
+			*field = parsed
+		}
+	}
+
+	for env, field := range map[string]*int{
+		"DOWNLOAD_RATE_LIMIT":        &cfg.DownloadRate,
+		"DOWNLOAD_RATE_BURST":        &cfg.DownloadBurst,
+		"DOWNLOAD_GLOBAL_RATE_LIMIT": &cfg.GlobalDownloadRate,
+		"BUILD_PARALLELISM":          &cfg.BuildParallelism,
+		"LONG_POLL_WAITERS":          &cfg.LongPollWaiters,
+		"FIRMWARE_SIZE_WARN_PERCENT": &cfg.FirmwareSizeWarnPercent,
+		"FIRMWARE_RETAIN":            &cfg.RetainVersions,
+		"CANARY_PERCENT":             &cfg.CanaryPercent,
+		"MIN_FREE_DISK_MB":           &cfg.MinFreeDiskMB,
+	} {
+		if value := os.Getenv(env); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil {
+				return Config{}, fmt.Errorf("%s: %w", env, err)
+			}
+			*field = parsed
+		}
+	}
+	if value := os.Getenv("FIRMWARE_MAX_SIZE"); value != "" {
+		// Accepts hex like the partition table, e.g. 0x1E0000
+		size, err := strconv.ParseInt(value, 0, 64)
+		if err != nil {
+			return Config{}, fmt.Errorf("FIRMWARE_MAX_SIZE: %w", err)
+		}
+		cfg.MaxFirmwareSize = size
+	}
+	if value := os.Getenv("OTA_CHUNK_SIZE"); value != "" {
+		size, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return Config{}, fmt.Errorf("OTA_CHUNK_SIZE: %w", err)
+		}
+		cfg.ChunkSize = size
+	}
+	for env, field := range map[string]*map[string]string{
+		"UPDATE_WINDOWS": &cfg.UpdateWindows,
+		"DEVICE_GROUPS":  &cfg.DeviceGroups,
+	} {
+		if value := os.Getenv(env); value != "" {
+			parsed, err := parseAssignments(value)
+			if err != nil {
+				return Config{}, fmt.Errorf("%s: %w", env, err)
+			}
+			*field = parsed
+		}
+	}
+	if value := os.Getenv("DOWNLOAD_RATE_EXEMPT"); value != "" {
+		cfg.RateLimitExempt = strings.Split(value, ",")
+	}
+	if value := os.Getenv("ALLOWED_NETWORKS"); value != "" {
+		cfg.AllowedNetworks = strings.Split(value, ",")
+	}
+	if value := os.Getenv("FORCE_OTA_UPDATE_FOR"); value != "" {
+		cfg.ForceUpdateFor = strings.Split(value, ",")
+	}
+	if value := os.Getenv("ACCESS_EXEMPT_PATHS"); value != "" {
+		cfg.AccessExempt = strings.Split(value, ",")
+	}
+	if value := os.Getenv("CORS_ORIGINS"); value != "" {
+		cfg.CORSOrigins = strings.Split(value, ",")
+	}
+	if value := os.Getenv("CORS_METHODS"); value != "" {
+		cfg.CORSMethods = strings.Split(value, ",")
+	}
+	if value := os.Getenv("DOCKER_VOLUMES"); value != "" {
+		cfg.DockerVolumes = strings.Split(value, ",")
+	}
+	if value := os.Getenv("DOCKER_ARGS"); value != "" {
+		cfg.DockerArgs = strings.Fields(value)
+	}
+	if err := resolveRateLimits(&cfg); err != nil {
+		return Config{}, err
+	}
+	if err := resolveAccessControl(&cfg); err != nil {
+		return Config{}, err
+	}
+	if err := resolveCORS(&cfg); err != nil {
+		return Config{}, err
+	}
+	if cfg.CheckSchedule != "" {
+		schedule, err := parseCronSchedule(cfg.CheckSchedule)
+		if err != nil {
+			return Config{}, err
+		}
+		cfg.schedule = schedule
+	}
+
+	for name, d := range map[string]struct {
+		value  string
+		field  *time.Duration
+		zeroOK bool
+	}{
+		"check interval":   {interval, &cfg.CheckInterval, false},
+		"build timeout":    {buildTimeout, &cfg.BuildTimeout, false},
+		"shutdown timeout": {shutdownTimeout, &cfg.ShutdownTimeout, false},
+		"build debounce":   {debounce, &cfg.BuildDebounce, true},
+
+		"HTTP read header timeout": {readHeaderTimeout, &cfg.HTTPReadHeaderTimeout, true},
+		"HTTP read timeout":        {readTimeout, &cfg.HTTPReadTimeout, true},
+		"HTTP write timeout":       {writeTimeout, &cfg.HTTPWriteTimeout, true},
+		"HTTP idle timeout":        {idleTimeout, &cfg.HTTPIdleTimeout, true},
+		"long poll max":            {longPollMax, &cfg.LongPollMax, true},
+
+		"mirror sync":            {mirrorSync, &cfg.MirrorSync, false},
+		"build hold timeout":     {holdTimeout, &cfg.BuildHoldTimeout, false},
+		"Docker prune interval":  {pruneInterval, &cfg.DockerPruneInterval, true},
+		"Docker prune retention": {pruneRetention, &cfg.DockerPruneRetention, false},
+		"stale firmware after":   {staleAfter, &cfg.StaleAfter, false},
+		"metrics push interval":  {pushInterval, &cfg.MetricsPushInterval, false},
+	} {
+		if d.value != "" {
+			parsed, err := time.ParseDuration(d.value)
+			if err != nil {
+				return Config{}, fmt.Errorf("%s: %w", name, err)
+			}
+			*d.field = parsed
+		}
+		if *d.field < 0 || (*d.field == 0 && !d.zeroOK) {
+			return Config{}, fmt.Errorf("%s must be positive, got %v", name, *d.field)
+		}
+	}
+	if _, err := newLogHandler(cfg.LogFormat, cfg.LogLevel, os.Stderr); err != nil {
+		return Config{}, err
+	}
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		return Config{}, fmt.Errorf("TLS needs both a certificate and a key file")
+	}
+	if cfg.TLSRedirect && cfg.TLSCert == "" && !cfg.TLSSelfSigned {
+		return Config{}, fmt.Errorf("redirecting HTTP to HTTPS needs TLS to be configured")
+	}
+	if cfg.MaxFirmwareSize < espImageHeaderLen+espSegmentHeaderLen {
+		return Config{}, fmt.Errorf("firmware max size is too small, got %d bytes", cfg.MaxFirmwareSize)
+	}
+	if cfg.FirmwareSizeWarnPercent < 1 || cfg.FirmwareSizeWarnPercent > 100 {
+		return Config{}, fmt.Errorf("firmware size warning must be 1-100 percent, got %d", cfg.FirmwareSizeWarnPercent)
+	}
+	if cfg.LongPollWaiters < 0 {
+		return Config{}, fmt.Errorf("long poll waiters must not be negative, got %d", cfg.LongPollWaiters)
+	}
+	if cfg.BuildParallelism < 1 {
+		return Config{}, fmt.Errorf("build parallelism must be at least 1, got %d", cfg.BuildParallelism)
+	}
+	if cfg.CanaryPercent < 0 || cfg.CanaryPercent > 100 {
+		return Config{}, fmt.Errorf("canary percent must be 0-100, got %d", cfg.CanaryPercent)
+	}
+	if cfg.MinFreeDiskMB < 0 {
+		return Config{}, fmt.Errorf("minimum free disk space must not be negative, got %d MB", cfg.MinFreeDiskMB)
+	}
+	if cfg.RetainVersions < 1 {
+		return Config{}, fmt.Errorf("retained versions must be at least 1, got %d", cfg.RetainVersions)
+	}
+	if cfg.ChunkSize < 1 {
+		return Config{}, fmt.Errorf("chunk size must be positive, got %d", cfg.ChunkSize)
+	}
+	if cfg.MetricsPushAddr != "" {
+		if _, _, err := net.SplitHostPort(cfg.MetricsPushAddr); err != nil {
+			return Config{}, fmt.Errorf("metrics push address must be host:port: %w", err)
+		}
+	}
+	if cfg.MetricsPushPrefix == "" {
+		return Config{}, fmt.Errorf("metrics push prefix must not be empty")
+	}
+	if err := resolveFirmwareStore(&cfg); err != nil {
+		return Config{}, err
+	}
+	if err := resolveUpdateWindows(&cfg); err != nil {
+		return Config{}, err
+	}
+	if err := resolveServePolicy(&cfg); err != nil {
+		return Config{}, err
+	}
+	dashboard, err := loadDashboardTemplate(cfg.DashboardTemplate)
+	if err != nil {
+		return Config{}, fmt.Errorf("dashboard template: %w", err)
+	}
+	cfg.dashboard = dashboard
+	if err := resolveBuildBackend(&cfg); err != nil {
+		return Config{}, err
+	}
+	if err := resolveHooks(&cfg); err != nil {
+		return Config{}, err
+	}
+	if err := resolveCommitSigning(&cfg); err != nil {
+		return Config{}, err
+	}
+	if err := resolveTargets(&cfg); err != nil {
+		return Config{}, err
+	}
+	if err := resolveChannels(&cfg); err != nil {
+		return Config{}, err
+	}
+	if !strings.HasSuffix(cfg.FirmwareFile, ".bin") || strings.Contains(cfg.FirmwareFile, "/") {
+		return Config{}, fmt.Errorf("firmware file must be a plain .bin name, got %q", cfg.FirmwareFile)
+	}
+	return cfg, nil
+}
+
+// String describes the configuration for logging, without the admin token,
+// the webhook secret, the notification webhook URL, which often embeds a
+// secret, or the values of environment variables in DockerArgs.
+func (c Config) String() string {
+	names := make([]string, len(c.Targets))
+	for i, t := range c.Targets {
+		names[i] = t.Name
+	}
+	channels := make([]string, len(c.Channels))
+	for i, ch := range c.Channels {
+		channels[i] = ch.Name
+	}
+	return strings.Join([]string{
+		fmt.Sprintf("port=%s firmwarePath=%s firmwareFile=%s projectPath=%s gitBranch=%s gitRepoUrl=%s",
+			c.Port, c.FirmwarePath, c.FirmwareFile, c.ProjectPath, c.GitBranch, redactedURL(c.GitRepoURL)),
+		fmt.Sprintf("checkInterval=%v checkSchedule=%q buildTimeout=%v shutdownTimeout=%v buildDebounce=%v",
+			c.CheckInterval, c.CheckSchedule, c.BuildTimeout, c.ShutdownTimeout, c.BuildDebounce),
+		fmt.Sprintf("maxFirmwareSize=%d sizeWarn=%d%% forceInitialBuild=%t healthCheckBackend=%t",
+			c.MaxFirmwareSize, c.FirmwareSizeWarnPercent, c.ForceInitialBuild, c.HealthCheckBackend),
+		fmt.Sprintf("adminToken=%t signingKey=%s notifyWebhook=%t webhookSecret=%t logFormat=%s logLevel=%s tls=%s",
+			c.AdminToken != "", c.SigningKey, c.NotifyWebhook != "", c.WebhookSecret != "", c.LogFormat, c.LogLevel, c.tlsMode()),
+		fmt.Sprintf("httpTimeouts=%v/%v/%v/%v longPoll=%v/%d",
+			c.HTTPReadHeaderTimeout, c.HTTPReadTimeout, c.HTTPWriteTimeout, c.HTTPIdleTimeout, c.LongPollMax, c.LongPollWaiters),
+		fmt.Sprintf("downloadRate=%d/min burst=%d globalDownloadRate=%d/min rateLimitExempt=%s",
+			c.DownloadRate, c.DownloadBurst, c.GlobalDownloadRate, strings.Join(c.RateLimitExempt, ",")),
+		fmt.Sprintf("basicAuth=%t allowedNetworks=%s accessExempt=%s corsOrigins=%s corsMethods=%s",
+			c.BasicAuthUser != "", strings.Join(c.AllowedNetworks, ","), strings.Join(c.AccessExempt, ","),
+			strings.Join(c.CORSOrigins, ","), strings.Join(c.CORSMethods, ",")),
+		fmt.Sprintf("buildBackend=%s dockerVolumes=%s dockerArgs=%s buildParallelism=%d",
+			c.BuildBackend, strings.Join(c.DockerVolumes, ","), redactedDockerArgs(c.DockerArgs), c.BuildParallelism),
+		fmt.Sprintf("preBuildHook=%t postBuildHook=%t hookFailure=%s requireSignedCommits=%t commitKeyring=%s",
+			c.PreBuildHook != "", c.PostBuildHook != "", c.HookFailure, c.RequireSignedCommits, c.CommitKeyring),
+		fmt.Sprintf("canaryPercent=%d retainVersions=%d firmwareStore=%s mirrorUrl=%s mirrorSync=%v",
+			c.CanaryPercent, c.RetainVersions, c.FirmwareStore, redactedURL(c.MirrorURL), c.MirrorSync),
+		fmt.Sprintf("updateWindows=%d deviceGroups=%d forceUpdate=%t forceUpdateFor=%s dashboardTemplate=%s chunkSize=%d featureFlagsFile=%s",
+			len(c.UpdateWindows), len(c.DeviceGroups), c.ForceUpdate, strings.Join(c.ForceUpdateFor, ","), c.DashboardTemplate,
+			c.ChunkSize, c.FeatureFlagsFile),
+		fmt.Sprintf("buildServePolicy=%s buildHoldTimeout=%v dockerPrune=%v/%v minFreeDisk=%dMB dockerPruneOnLowDisk=%t",
+			c.BuildServePolicy, c.BuildHoldTimeout, c.DockerPruneInterval, c.DockerPruneRetention, c.MinFreeDiskMB,
+			c.DockerPruneOnLowDisk),
+		fmt.Sprintf("staleAfter=%v metricsPush=%s/%v/%s", c.StaleAfter, c.MetricsPushAddr, c.MetricsPushInterval, c.MetricsPushPrefix),
+		fmt.Sprintf("targets=%s channels=%s", strings.Join(names, ","), strings.Join(channels, ",")),
+	}, " ")
+}
+
+// redactedDockerArgs joins DockerArgs for logging with the values of
+// environment assignments, e.g. "-e TOKEN=secret" or "--env=TOKEN=secret",
+// replaced the way url.URL.Redacted hides passwords. Other flags are
+// shown as given.
+func redactedDockerArgs(args []string) string {
+	redacted := make([]string, len(args))
+	for i, arg := range args {
+		flag, assignment := "", arg
+		if rest, ok := strings.CutPrefix(arg, "--env="); ok {
+			flag, assignment = "--env=", rest
+		} else if rest, ok := strings.CutPrefix(arg, "-e"); ok && !strings.HasPrefix(rest, "-") {
+			flag, assignment = "-e", rest
+		}
+		if name, _, ok := strings.Cut(assignment, "="); ok && isEnvName(name) {
+			arg = flag + name + "=xxxxx"
+		}
+		redacted[i] = arg
+	}
+	return strings.Join(redacted, " ")
+}
+
+// isEnvName reports whether name is a valid environment variable name.
+func isEnvName(name string) bool {
+	for i, c := range name {
+		if c != '_' && !('A' <= c && c <= 'Z') && !('a' <= c && c <= 'z') && (i == 0 || !('0' <= c && c <= '9')) {
+			return false
+		}
+	}
+	return name != ""
+}
+
+// parseAssignments parses a comma-separated list of key=value pairs, as
+// UPDATE_WINDOWS and DEVICE_GROUPS are given in the environment.
+func parseAssignments(spec string) (map[string]string, error) {
+	pairs := make(map[string]string)
+	for _, entry := range strings.Split(spec, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(entry, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("expected key=value, got %q", entry)
+		}
+		pairs[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return pairs, nil
+}
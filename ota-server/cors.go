@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// corsPaths are the read-only endpoints cross-origin dashboards may
+// fetch; paths ending in "/" cover everything below them.
+var corsPaths = []string{
+	"/status", "/status.txt", "/history", "/metrics", "/events",
+	"/manifest.json", "/changelog", "/licenses", "/rollout", "/rollout/",
+}
+
+// resolveCORS checks the CORS allowlist: "*" or origins like
+// https://dash.example.com, and GET and HEAD unless methods are given.
+func resolveCORS(cfg *Config) error {
+	for i, origin := range cfg.CORSOrigins {
+		origin = strings.TrimSuffix(strings.TrimSpace(origin), "/")
+		if origin != "*" {
+			u, err := url.Parse(origin)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" || u.RawQuery != "" {
+				return fmt.Errorf("CORS origin must be * or scheme://host[:port], got %q", cfg.CORSOrigins[i])
+			}
+			origin = strings.ToLower(origin)
+		}
+		cfg.CORSOrigins[i] = origin
+	}
+	if len(cfg.CORSMethods) == 0 {
+		cfg.CORSMethods = []string{http.MethodGet, http.MethodHead}
+	}
+	for i, method := range cfg.CORSMethods {
+		method = strings.ToUpper(strings.TrimSpace(method))
+		if method == "" || strings.Trim(method, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+			return fmt.Errorf("invalid CORS method %q", cfg.CORSMethods[i])
+		}
+		cfg.CORSMethods[i] = method
+	}
+	return nil
+}
+
+func corsPath(path string) bool {
+	for _, p := range corsPaths {
+		if path == p || (strings.HasSuffix(p, "/") && strings.HasPrefix(path, p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowCORS adds Access-Control-Allow-* headers to requests for corsPaths
+// from the origins in config.CORSOrigins, and answers their OPTIONS
+// preflights itself. It runs before restrictAccess, as browsers send
+// preflights without credentials. Listed origins (but not "*") may send
+// credentials, for servers behind Basic Auth. Other origins and paths get
+// no CORS headers, so browsers keep blocking them. It is off unless
+// CORS_ORIGINS is set.
+func allowCORS(handler http.Handler) http.Handler {
+	if len(config.CORSOrigins) == 0 {
+		return handler
+	}
+	methods := strings.Join(config.CORSMethods, ", ")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !corsPath(r.URL.Path) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		listed := slices.Contains(config.CORSOrigins, strings.ToLower(origin))
+		if !listed && !slices.Contains(config.CORSOrigins, "*") {
+			slog.Debug("🌐 Cross-origin request from an origin not allowed", "origin", origin, "path", r.URL.Path)
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		if listed {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		}
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+			w.Header().Set("Access-Control-Allow-Methods", methods)
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if !slices.Contains(config.CORSMethods, r.Method) {
+			w.Header().Del("Access-Control-Allow-Origin")
+			w.Header().Del("Access-Control-Allow-Credentials")
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
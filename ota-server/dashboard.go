@@ -0,0 +1,82 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//go:embed templates/dashboard.html
+var templateFS embed.FS
+
+// DashboardData is the context the dashboard template is rendered with.
+type DashboardData struct {
+	BuildStatus      string
+	FirmwareStatus   string
+	ShortCommit      string
+	Commit           CommitInfo
+	CommitsBehind    int
+	Stale            bool
+	Maintenance      Maintenance
+	RepositoryError  string
+	BackendError     string
+	ToolchainStatus  string
+	LastCheck        time.Time
+	NextCheckMinutes int
+	NextCheckIn      string
+	GitBranch        string
+	CheckInterval    time.Duration
+	CheckSchedule    string
+	Notes            *FirmwareNotes
+	Devices          []DeviceDownload
+	LowRollouts      []RolloutStats
+	Changelog        *Changelog
+	Server           ServerInfo
+}
+
+// DashboardSummary is the dashboard for JSON clients: the /status document
+// plus the schedule and notes the page shows alongside it.
+type DashboardSummary struct {
+	StatusResponse
+	GitBranch     string         `json:"gitBranch"`
+	CheckInterval string         `json:"checkInterval"`
+	CheckSchedule string         `json:"checkSchedule,omitempty"`
+	Notes         *FirmwareNotes `json:"notes,omitempty"`
+}
+
+// nextCheckIn describes when the next scheduled git check runs, as shown on
+// the dashboard and in /status. Before the monitor has scheduled one, or
+// once it is due, it is "soon". Callers must hold state.RLock.
+func nextCheckIn(now time.Time) string {
+	wait := state.NextCheckTime.Sub(now)
+	switch {
+	case state.NextCheckTime.IsZero() || wait < time.Minute:
+		return "soon"
+	case wait < 2*time.Minute:
+		return "in ~1 minute"
+	case wait >= 2*time.Hour:
+		return fmt.Sprintf("in ~%d hours", int(wait.Round(time.Hour).Hours()))
+	}
+	return fmt.Sprintf("in ~%d minutes", int(wait.Round(time.Minute).Minutes()))
+}
+
+// acceptsJSON reports whether the client asked for JSON. Browsers don't
+// list application/json, so they keep getting HTML.
+func acceptsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// defaultDashboard is the embedded dashboard template.
+var defaultDashboard = template.Must(template.ParseFS(templateFS, "templates/dashboard.html"))
+
+// loadDashboardTemplate parses the template at overridePath, which lets
+// deployments rebrand the page, or returns the embedded default.
+func loadDashboardTemplate(overridePath string) (*template.Template, error) {
+	if overridePath == "" {
+		return defaultDashboard, nil
+	}
+	return template.ParseFiles(overridePath)
+}
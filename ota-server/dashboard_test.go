@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDashboardEscapesHostileText(t *testing.T) {
+	const hostile = `<script>alert("pwned")</script><img src=x onerror=alert(1)>`
+	override := filepath.Join(t.TempDir(), "custom.html")
+	if err := os.WriteFile(override, []byte(`<h1>ACME OTA</h1><p>{{.BuildStatus}}</p><p>{{.Commit.Subject}}</p>`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		template string // DASHBOARD_TEMPLATE, empty for the embedded default
+		want     string
+	}{
+		{name: "embedded template", want: "Firmware Notes"},
+		{name: "override template", template: override, want: "ACME OTA"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestFirmware(t, testImage("1.0.0", 'A', 4096))
+			dashboard, err := loadDashboardTemplate(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+			config.dashboard = dashboard
+
+			state.Lock()
+			savedError, savedInfo, savedNotes := state.BuildError, state.LastCommitInfo, state.Notes
+			state.BuildError = "compile failed: " + hostile
+			state.LastCommitInfo = CommitInfo{Subject: hostile, Author: hostile}
+			state.Notes = FirmwareNotes{Notes: hostile}
+			state.Unlock()
+			t.Cleanup(func() {
+				state.Lock()
+				state.BuildError, state.LastCommitInfo, state.Notes = savedError, savedInfo, savedNotes
+				state.Unlock()
+			})
+			// Stub the probe backendHealthMonitor would run
+			savedHealth := lastBackendHealth.Swap(&BackendHealth{Backend: buildBackendDocker, Error: hostile})
+			t.Cleanup(func() { lastBackendHealth.Store(savedHealth) })
+
+			w := httptest.NewRecorder()
+			rootHandler(w, httptest.NewRequest(http.MethodGet, "/", nil))
+			page := w.Body.String()
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, page)
+			}
+			if !strings.Contains(page, tt.want) {
+				t.Errorf("page was not rendered from the %s", tt.name)
+			}
+			for _, raw := range []string{"<script>alert", "<img src=x", `alert("pwned")`} {
+				if strings.Contains(page, raw) {
+					t.Errorf("page contains unescaped %q", raw)
+				}
+			}
+			if !strings.Contains(page, "&lt;script&gt;") {
+				t.Error("the build error is missing from the page instead of being escaped")
+			}
+		})
+	}
+}
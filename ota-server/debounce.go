@@ -0,0 +1,33 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// pendingBuild is the debounced build scheduled by scheduleBuild.
+var pendingBuild struct {
+	sync.Mutex
+	timer *time.Timer
+}
+
+// scheduleBuild queues a build once no further changes have been seen for
+// config.BuildDebounce. Each call within that window restarts the wait, so
+// a burst of pushes produces one build of the last commit.
+func scheduleBuild() {
+	pendingBuild.Lock()
+	defer pendingBuild.Unlock()
+
+	if pendingBuild.timer != nil && pendingBuild.timer.Stop() {
+		slog.Info("⏱️  More changes arrived, build postponed", "event", "build_postponed", "delay", config.BuildDebounce)
+	} else {
+		slog.Info("⏱️  Build scheduled unless more changes arrive", "event", "build_scheduled", "delay", config.BuildDebounce)
+	}
+	pendingBuild.timer = time.AfterFunc(config.BuildDebounce, func() {
+		pendingBuild.Lock()
+		pendingBuild.timer = nil
+		pendingBuild.Unlock()
+		enqueueBuild(BuildRequest{Reason: buildReasonGit})
+	})
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// Delta patches rebuild the current firmware from an older retained
+// build. The format is a copy/insert stream over the old image:
+//
+//	"OTAD" 0x01
+//	uvarint target size, 32-byte target SHA256
+//	ops: 'C' uvarint offset, uvarint length  copy from the old image
+//	     'A' uvarint length, bytes            insert literal bytes
+//
+// The device applies the ops in order and must check the SHA256 before
+// flashing. Matches are found with a rolling hash over deltaBlockSize
+// windows, which handles code that moved as well as code that changed.
+const (
+	deltaMagic      = "OTAD\x01"
+	deltaBlockSize  = 32
+	maxDeltaSources = 3
+	// Deltas that don't save at least this share of the full image aren't
+	// worth the device-side patching.
+	minDeltaSavings = 0.10
+)
+
+// DeltaInfo describes a stored patch from one retained build to another.
+type DeltaInfo struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+func deltaName(from, to string) string {
+	return fmt.Sprintf("%s-%s.delta", strings.TrimSuffix(archiveName(from), ".bin"), to[:min(8, len(to))])
+}
+
+const rollingBase = 257
+
+func rollingHash(window []byte) uint32 {
+	var h uint32
+	for _, b := range window {
+		h = h*rollingBase + uint32(b)
+	}
+	return h
+}
+
+// computeDelta encodes target as a patch against source.
+func computeDelta(source, target []byte) []byte {
+	sum := sha256.Sum256(target)
+	out := append([]byte(deltaMagic), binary.AppendUvarint(nil, uint64(len(target)))...)
+	out = append(out, sum[:]...)
+
+	emitAdd := func(data []byte) {
+		if len(data) > 0 {
+			out = append(out, 'A')
+			out = binary.AppendUvarint(out, uint64(len(data)))
+			out = append(out, data...)
+		}
+	}
+
+	const k = deltaBlockSize
+	index := make(map[uint32]int)
+	for off := 0; off+k <= len(source); off += k {
+		if _, ok := index[rollingHash(source[off:off+k])]; !ok {
+			index[rollingHash(source[off:off+k])] = off
+		}
+	}
+
+	// rollingBase^(k-1), to drop the outgoing byte when rolling
+	var top uint32 = 1
+	for i := 1; i < k; i++ {
+		top *= rollingBase
+	}
+
+	pending := 0
+	i := 0
+	var h uint32
+	if len(target) >= k {
+		h = rollingHash(target[:k])
+	}
+	for i+k <= len(target) {
+		if off, ok := index[h]; ok && bytes.Equal(source[off:off+k], target[i:i+k]) {
+			s, t := off, i
+			for s > 0 && t > pending && source[s-1] == target[t-1] {
+				s--
+				t--
+			}
+			n := i + k - t
+			for s+n < len(source) && t+n < len(target) && source[s+n] == target[t+n] {
+				n++
+			}
+			emitAdd(target[pending:t])
+			out = append(out, 'C')
+			out = binary.AppendUvarint(out, uint64(s))
+			out = binary.AppendUvarint(out, uint64(n))
+
+			i, pending = t+n, t+n
+			if i+k <= len(target) {
+				h = rollingHash(target[i : i+k])
+			}
+			continue
+		}
+		if i+k < len(target) {
+			h = (h-uint32(target[i])*top)*rollingBase + uint32(target[i+k])
+		}
+		i++
+	}
+	emitAdd(target[pending:])
+	return out
+}
+
+// applyDelta rebuilds the target image from source and a patch, checking
+// the result against the patch's SHA256.
+func applyDelta(source, delta []byte) ([]byte, error) {
+	rest, ok := bytes.CutPrefix(delta, []byte(deltaMagic))
+	if !ok {
+		return nil, errors.New("not a delta patch")
+	}
+	r := bytes.NewReader(rest)
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	want := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(r, want); err != nil {
+		return nil, err
+	}
+
+	target := make([]byte, 0, size)
+	for {
+		op, err := r.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		switch op {
+		case 'C':
+			off, err1 := binary.ReadUvarint(r)
+			n, err2 := binary.ReadUvarint(r)
+			if err := errors.Join(err1, err2); err != nil {
+				return nil, err
+			}
+			if off+n > uint64(len(source)) {
+				return nil, errors.New("copy past end of source")
+			}
+			target = append(target, source[off:off+n]...)
+		case 'A':
+			n, err := binary.ReadUvarint(r)
+			if err != nil {
+				return nil, err
+			}
+			if n > uint64(r.Len()) {
+				return nil, errors.New("insert past end of patch")
+			}
+			data := make([]byte, n)
+			io.ReadFull(r, data)
+			target = append(target, data...)
+		default:
+			return nil, fmt.Errorf("unknown op %q", op)
+		}
+	}
+
+	if got := sha256.Sum256(target); uint64(len(target)) != size || !bytes.Equal(got[:], want) {
+		return nil, errors.New("patched image does not match target checksum")
+	}
+	return target, nil
+}
+
+func readStored(name string) ([]byte, error) {
+	obj, err := firmwareStore.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+	return io.ReadAll(io.NewSectionReader(obj.Content, 0, obj.Size))
+}
+
+// generateDeltas replaces the stored patches with ones from the last
+// maxDeltaSources retained builds to the build of commit, which must
+// already be archived.
+func generateDeltas(commit string) {
+	target, err := readStored(archiveName(commit))
+	if err != nil {
+		slog.Warn("⚠️  Could not read build for deltas", "commit", commit, "error", err)
+		return
+	}
+
+	state.Lock()
+	old := state.Deltas
+	state.Deltas = nil
+	var sources []RetainedVersion
+	for i := len(state.RetainedVersions) - 1; i >= 0 && len(sources) < maxDeltaSources; i-- {
+		if v := state.RetainedVersions[i]; v.Name != archiveName(commit) {
+			sources = append(sources, v)
+		}
+	}
+	state.Unlock()
+
+	for _, d := range old {
+		if err := firmwareStore.Remove(d.Name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("⚠️  Could not remove old delta", "name", d.Name, "error", err)
+		}
+	}
+
+	var deltas []DeltaInfo
+	for _, v := range sources {
+		source, err := readStored(v.Name)
+		if err != nil {
+			slog.Warn("⚠️  Could not read archived build for delta", "name", v.Name, "error", err)
+			continue
+		}
+		patch := computeDelta(source, target)
+		if float64(len(patch)) > float64(len(target))*(1-minDeltaSavings) {
+			slog.Info("📐 Delta not worthwhile", "from", v.Commit, "bytes", len(patch), "image_bytes", len(target))
+			continue
+		}
+		if _, err := applyDelta(source, patch); err != nil {
+			slog.Error("❌ Delta failed verification", "from", v.Commit, "error", err)
+			continue
+		}
+		name := deltaName(v.Commit, commit)
+		if err := firmwareStore.Put(name, bytes.NewReader(patch)); err != nil {
+			slog.Warn("⚠️  Could not store delta", "name", name, "error", err)
+			continue
+		}
+		deltas = append(deltas, DeltaInfo{From: v.Commit, To: commit, Name: name, Size: int64(len(patch))})
+		slog.Info("📐 Delta generated", "event", "delta_generated", "from", v.Commit[:min(8, len(v.Commit))],
+			"commit", commit[:min(8, len(commit))], "bytes", len(patch), "image_bytes", len(target))
+	}
+
+	state.Lock()
+	state.Deltas = deltas
+	state.Unlock()
+}
+
+// deltaHandler serves a patch from ?from=<commit> to the current build.
+// When there is none, the device gets the full image with X-Delta: full.
+// Patches are admitted like full downloads and claim the target version's
+// license seat.
+func deltaHandler(w http.ResponseWriter, r *http.Request) {
+	from := r.URL.Query().Get("from")
+	if from != "" {
+		var ok bool
+		if from, ok = requireCommitParam(w, "from", from); !ok {
+			return
+		}
+	}
+	if !admitDownload(w, r) {
+		return
+	}
+	if _, held := stableBuildFor(r); from == "" || held {
+		w.Header().Set("X-Delta", "full")
+		sendFirmware(w, r)
+		return
+	}
+
+	// Open the current image and look up its commit in one firmwareSwap
+	// section, so the patch and the checksum it's sent with are for the
+	// same build.
+	firmwareSwap.RLock()
+	current, err := firmwareStore.Open(config.FirmwareFile)
+	var delta DeltaInfo
+	found := false
+	state.RLock()
+	for _, d := range state.Deltas {
+		if d.To == state.LastGitCommit && (strings.HasPrefix(d.From, from) || strings.HasPrefix(from, d.From)) {
+			delta, found = d, true
+		}
+	}
+	state.RUnlock()
+	firmwareSwap.RUnlock()
+	if err == nil {
+		defer current.Close()
+	}
+	if !found || err != nil {
+		w.Header().Set("X-Delta", "full")
+		sendFirmware(w, r)
+		return
+	}
+
+	digest, err := firmwareDigest(current.FirmwareInfo, current.Content)
+	if err != nil {
+		slog.Error("❌ Failed to hash firmware", "error", err)
+		http.Error(w, "Failed to read firmware", http.StatusInternalServerError)
+		return
+	}
+	obj, err := firmwareStore.Open(delta.Name)
+	if err != nil {
+		slog.Warn("⚠️  Delta unavailable, sending full image", "name", delta.Name, "error", err)
+		w.Header().Set("X-Delta", "full")
+		sendFirmware(w, r)
+		return
+	}
+	defer obj.Close()
+
+	etag := fmt.Sprintf(`"%s-%s"`, delta.From[:min(8, len(delta.From))], digest.SHA256[:16])
+	version := readFirmwareVersion(current.Content)
+	if r.Method != http.MethodHead && !notModified(r, etag, obj.ModTime) && !claimLicenseSeat(w, r, version) {
+		return
+	}
+
+	w.Header().Set("X-Delta", "patch")
+	w.Header().Set("X-Delta-From", delta.From)
+	w.Header().Set("X-Delta-To", delta.To)
+	w.Header().Set("X-Firmware-SHA256", digest.SHA256)
+	w.Header().Set("X-Firmware-Size", fmt.Sprintf("%d", digest.Size))
+	if version != "" {
+		w.Header().Set("X-Firmware-Version", version)
+	}
+	w.Header().Set("Content-Type", "application/x-ota-delta")
+	w.Header().Set("ETag", etag)
+
+	slog.Info("📐 Serving delta", "event", "delta_download", "name", delta.Name, "bytes", obj.Size, "remote_addr", r.RemoteAddr)
+
+	http.ServeContent(w, r, delta.Name, obj.ModTime, obj.Content)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDeltaAdmission(t *testing.T) {
+	// A window that opens two hours from now, so it's closed for the test
+	closed := time.Now().Add(2 * time.Hour)
+	window := closed.Format("15:04") + "-" + closed.Add(time.Hour).Format("15:04")
+
+	tests := []struct {
+		name   string
+		setup  func()
+		header http.Header
+		want   int
+	}{
+		{name: "patch", want: http.StatusOK},
+		{name: "rate limited", setup: func() {
+			config.DownloadRate, config.DownloadBurst = 1, 1
+			first := httptest.NewRecorder()
+			deltaHandler(first, httptest.NewRequest(http.MethodGet, "/delta?from="+testCommitB, nil))
+			if first.Code != http.StatusOK {
+				t.Fatalf("first download: status %d", first.Code)
+			}
+		}, want: http.StatusTooManyRequests},
+		{name: "outside update window", setup: func() {
+			config.UpdateWindows = map[string]string{"lobby": window}
+			if err := resolveUpdateWindows(&config); err != nil {
+				t.Fatal(err)
+			}
+		}, header: http.Header{"X-Device-Group": {"lobby"}}, want: http.StatusServiceUnavailable},
+		{name: "license seats taken", setup: func() {
+			state.Lock()
+			state.Licenses["1.0.0"] = &VersionLicense{Cap: 1, Devices: map[string]time.Time{"24:6f:28:00:00:01": time.Now()}}
+			state.Unlock()
+		}, header: http.Header{"X-Device-ID": {"24:6f:28:00:00:02"}}, want: http.StatusForbidden},
+		{name: "build in progress", setup: func() {
+			config.BuildServePolicy = servePolicyReject
+			state.Lock()
+			state.BuildInProgress = true
+			state.Unlock()
+		}, want: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestFirmware(t, testImage("1.0.0", 'A', 8192))
+			state.Lock()
+			savedLicenses, savedDeltas := state.Licenses, state.Deltas
+			state.Licenses = map[string]*VersionLicense{}
+			state.Unlock()
+			t.Cleanup(func() {
+				state.Lock()
+				state.Licenses, state.Deltas, state.BuildInProgress = savedLicenses, savedDeltas, false
+				state.Unlock()
+			})
+			downloadLimiter.Lock()
+			downloadLimiter.clients, downloadLimiter.global = map[string]*tokenBucket{}, nil
+			downloadLimiter.downloads = map[string]time.Time{}
+			downloadLimiter.Unlock()
+
+			patch := []byte("not really a patch")
+			name := deltaName(testCommitB, testCommitA)
+			if err := firmwareStore.Put(name, bytes.NewReader(patch)); err != nil {
+				t.Fatal(err)
+			}
+			state.Lock()
+			state.Deltas = []DeltaInfo{{From: testCommitB, To: testCommitA, Name: name, Size: int64(len(patch))}}
+			state.Unlock()
+			if tt.setup != nil {
+				tt.setup()
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "/delta?from="+testCommitB[:8], nil)
+			for key, values := range tt.header {
+				r.Header[key] = values
+			}
+			w := httptest.NewRecorder()
+			deltaHandler(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("status %d, want %d", w.Code, tt.want)
+			}
+			if tt.want == http.StatusOK {
+				if got := w.Header().Get("X-Delta"); got != "patch" || !bytes.Equal(w.Body.Bytes(), patch) {
+					t.Errorf("X-Delta %q with a %d byte body, want the patch", got, w.Body.Len())
+				}
+				if got := w.Header().Get("X-Firmware-Version"); got != "1.0.0" {
+					t.Errorf("X-Firmware-Version = %q, want 1.0.0", got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const maxDeviceDownloads = 200
+
+// DeviceDownload records one firmware download by a device.
+type DeviceDownload struct {
+	Time       time.Time `json:"time"`
+	RemoteAddr string    `json:"remoteAddr"`
+	DeviceID   string    `json:"deviceId,omitempty"`
+	UserAgent  string    `json:"userAgent"`
+	Image      string    `json:"image"`
+	Version    string    `json:"version"`
+	Bytes      int64     `json:"bytes"`
+	Outcome    string    `json:"outcome"`
+}
+
+// recordDeviceDownload adds a download to the bounded log of recent
+// downloads, dropping the oldest beyond maxDeviceDownloads.
+func recordDeviceDownload(r *http.Request, image, version string, bytes int64, outcome string) {
+	d := DeviceDownload{
+		Time:       time.Now(),
+		RemoteAddr: r.RemoteAddr,
+		DeviceID:   deviceID(r),
+		UserAgent:  r.UserAgent(),
+		Image:      image,
+		Version:    version,
+		Bytes:      bytes,
+		Outcome:    outcome,
+	}
+
+	state.Lock()
+	defer state.Unlock()
+	state.Downloads = append(state.Downloads, d)
+	if over := len(state.Downloads) - maxDeviceDownloads; over > 0 {
+		state.Downloads = append([]DeviceDownload(nil), state.Downloads[over:]...)
+	}
+}
+
+// deviceKey identifies a device by its ID, or by address if it sent none.
+func (d DeviceDownload) deviceKey() string {
+	if d.DeviceID != "" {
+		return strings.ToLower(d.DeviceID)
+	}
+	if host, _, err := net.SplitHostPort(d.RemoteAddr); err == nil {
+		return host
+	}
+	return d.RemoteAddr
+}
+
+// latestDeviceDownloads returns each device's most recent download,
+// newest first. Callers must hold state.RLock.
+func latestDeviceDownloads() []DeviceDownload {
+	seen := make(map[string]bool)
+	var latest []DeviceDownload
+	for i := len(state.Downloads) - 1; i >= 0; i-- {
+		d := state.Downloads[i]
+		if key := d.deviceKey(); !seen[key] {
+			seen[key] = true
+			latest = append(latest, d)
+		}
+	}
+	return latest
+}
+
+// devicesHandler lists the latest download of each recently seen device,
+// or with ?all=1 every recorded download, newest first.
+func devicesHandler(w http.ResponseWriter, r *http.Request) {
+	state.RLock()
+	var downloads []DeviceDownload
+	if r.URL.Query().Get("all") != "" {
+		for i := len(state.Downloads) - 1; i >= 0; i-- {
+			downloads = append(downloads, state.Downloads[i])
+		}
+	} else {
+		downloads = latestDeviceDownloads()
+	}
+	state.RUnlock()
+
+	if downloads == nil {
+		downloads = []DeviceDownload{}
+	}
+	writeJSON(w, downloads)
+}
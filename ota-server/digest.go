@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+)
+
+// FirmwareDigest holds the checksums of a firmware image along with the
+// mtime and size they were computed for.
+type FirmwareDigest struct {
+	MD5     string
+	SHA256  string
+	ModTime time.Time
+	Size    int64
+}
+
+func (d FirmwareDigest) matches(info FirmwareInfo) bool {
+	return d.SHA256 != "" && d.ModTime.Equal(info.ModTime) && d.Size == info.Size
+}
+
+// ETag is a strong entity tag for the image, derived from its SHA256 and
+// mtime so a republished identical image still gets a fresh tag.
+func (d FirmwareDigest) ETag() string {
+	return fmt.Sprintf(`"%s-%x"`, d.SHA256[:16], d.ModTime.UnixNano())
+}
+
+// firmwareDigest returns the checksums of the image described by info.
+// Digests of the current firmware are cached in ServerState.FirmwareChecksum
+// and only recomputed when its mtime or size changes; archived images are
+// hashed on every call.
+func firmwareDigest(info FirmwareInfo, content io.ReaderAt) (FirmwareDigest, error) {
+	current := info.Name == config.FirmwareFile
+	if current {
+		state.RLock()
+		cached := state.FirmwareChecksum
+		state.RUnlock()
+		if cached.matches(info) {
+			return cached, nil
+		}
+	}
+
+	md5Hash, shaHash := md5.New(), sha256.New()
+	if _, err := io.Copy(io.MultiWriter(md5Hash, shaHash), io.NewSectionReader(content, 0, info.Size)); err != nil {
+		return FirmwareDigest{}, err
+	}
+	digest := FirmwareDigest{
+		MD5:     hex.EncodeToString(md5Hash.Sum(nil)),
+		SHA256:  hex.EncodeToString(shaHash.Sum(nil)),
+		ModTime: info.ModTime,
+		Size:    info.Size,
+	}
+
+	if current {
+		state.Lock()
+		state.FirmwareChecksum = digest
+		state.Unlock()
+	}
+	return digest, nil
+}
+
+// verifyPublished re-reads a published image from the store, bypassing the
+// digest cache, and checks it has the SHA256 of the bytes that were put.
+func verifyPublished(name, want string) error {
+	obj, err := firmwareStore.Open(name)
+	if err != nil {
+		return fmt.Errorf("verify published firmware: %w", err)
+	}
+	defer obj.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, io.NewSectionReader(obj.Content, 0, obj.Size)); err != nil {
+		return fmt.Errorf("verify published firmware: %w", err)
+	}
+	if got := hex.EncodeToString(hash.Sum(nil)); got != want {
+		slog.Error("❌ Published firmware doesn't match the build", "event", "publish_corrupt", "name", name,
+			"built_sha256", want, "published_sha256", got, "published_size", obj.Size)
+		return fmt.Errorf("published %s has sha256 %s, build has %s", name, got, want)
+	}
+	return nil
+}
+
+// currentFirmwareDigest opens the current firmware from the store and
+// returns its checksums.
+func currentFirmwareDigest() (FirmwareDigest, error) {
+	obj, err := firmwareStore.Open(config.FirmwareFile)
+	if err != nil {
+		return FirmwareDigest{}, err
+	}
+	defer obj.Close()
+	return firmwareDigest(obj.FirmwareInfo, obj.Content)
+}
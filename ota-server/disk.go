@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"syscall"
+)
+
+const defaultMinFreeMB = 500
+
+// DiskSpace is the free space on the filesystem holding a build path.
+type DiskSpace struct {
+	Path      string `json:"path"`
+	FreeBytes uint64 `json:"freeBytes"`
+}
+
+// diskFree returns the space available to unprivileged users on the
+// filesystem holding path.
+func diskFree(path string) (uint64, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(path, &fs); err != nil {
+		return 0, err
+	}
+	return fs.Bavail * uint64(fs.Bsize), nil
+}
+
+// buildDiskSpace reports free space for the firmware and project paths.
+// Paths that can't be checked are left out rather than blocking builds.
+func buildDiskSpace() []DiskSpace {
+	var spaces []DiskSpace
+	for _, path := range []string{config.FirmwarePath, config.ProjectPath} {
+		free, err := diskFree(path)
+		if err != nil {
+			continue
+		}
+		spaces = append(spaces, DiskSpace{Path: path, FreeBytes: free})
+	}
+	return spaces
+}
+
+// lowDiskSpace returns the build paths with less than minimum bytes free.
+func lowDiskSpace(minimum uint64) []DiskSpace {
+	var low []DiskSpace
+	for _, space := range buildDiskSpace() {
+		if space.FreeBytes < minimum {
+			low = append(low, space)
+		}
+	}
+	return low
+}
+
+// ensureDiskSpace checks that the firmware and project paths have at least
+// config.MinFreeDiskMB free before a build. When they don't, it prunes
+// archived firmware down to the current and stable builds, and Docker
+// images too if config.DockerPruneOnLowDisk is set, then checks again.
+// Callers must hold dockerHost.
+func ensureDiskSpace() error {
+	minimum := uint64(config.MinFreeDiskMB) << 20
+	if minimum == 0 {
+		return nil
+	}
+	low := lowDiskSpace(minimum)
+	if len(low) == 0 {
+		return nil
+	}
+
+	slog.Warn("💽 Low disk space, pruning before build", "event", "disk_low", "path", low[0].Path,
+		"free_mb", low[0].FreeBytes>>20, "min_free_mb", minimum>>20)
+	if n := pruneRetainedVersions(1); n > 0 {
+		slog.Info("🗑️  Pruned archived firmware to free space", "count", n)
+	}
+	if config.DockerPruneOnLowDisk {
+		runDockerPrune(config.DockerPruneRetention)
+	}
+
+	if low = lowDiskSpace(minimum); len(low) > 0 {
+		return fmt.Errorf("not enough free disk space: %s has %d MB free, builds need %d MB (MIN_FREE_DISK_MB)",
+			low[0].Path, low[0].FreeBytes>>20, minimum>>20)
+	}
+	return nil
+}
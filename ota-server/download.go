@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// countingWriter wraps a ResponseWriter to record the status code, how
+// many body bytes were written, and the first write error.
+type countingWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+	err    error
+}
+
+func (c *countingWriter) WriteHeader(code int) {
+	if c.status == 0 {
+		c.status = code
+	}
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	n, err := c.ResponseWriter.Write(p)
+	c.bytes += int64(n)
+	if err != nil && c.err == nil {
+		c.err = err
+	}
+	return n, err
+}
+
+// Flush lets streaming handlers such as /events flush through the wrapper.
+func (c *countingWriter) Flush() {
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (c *countingWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// expected returns the body length announced in Content-Length, which
+// http.ServeContent sets for the whole file or the requested range and
+// serveGzip for the compressed image, or -1 when there is none.
+func (c *countingWriter) expected() int64 {
+	n, err := strconv.ParseInt(c.Header().Get("Content-Length"), 10, 64)
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// complete reports whether the whole announced body was written.
+func (c *countingWriter) complete() bool {
+	return c.err == nil && c.bytes >= c.expected()
+}
+
+// Download outcomes.
+const (
+	downloadComplete         = "complete"
+	downloadClientDisconnect = "client-disconnect"
+	downloadWriteError       = "write-error"
+)
+
+// classifyDownload tells a device dropping the connection apart from other
+// failures writing the response. A download is only complete when every
+// announced byte was written; a body cut short without a write error, e.g.
+// by a failed read of the image, is a write error too.
+func classifyDownload(r *http.Request, cw *countingWriter) string {
+	switch {
+	case cw.complete():
+		return downloadComplete
+	case r.Context().Err() != nil,
+		errors.Is(cw.err, syscall.EPIPE),
+		errors.Is(cw.err, syscall.ECONNRESET):
+		return downloadClientDisconnect
+	default:
+		return downloadWriteError
+	}
+}
+
+// logDownload logs how a download ended, with the bytes actually sent
+// against those announced, so aborted OTA pulls stand out from completed
+// ones.
+func logDownload(logger *slog.Logger, outcome string, cw *countingWriter) {
+	logger = logger.With("event", "download_"+outcome, "bytes", cw.bytes, "expected_bytes", cw.expected(),
+		"complete", outcome == downloadComplete, "status", cw.status)
+	switch outcome {
+	case downloadClientDisconnect:
+		logger.Warn("⚠️  Client disconnected before the download completed", "error", cw.err)
+	case downloadWriteError:
+		logger.Error("❌ Firmware download incomplete", "error", cw.err)
+	default:
+		logger.Info("✅ Firmware delivered", "content_range", cw.Header().Get("Content-Range"))
+	}
+}
+
+// recordDownload counts a download outcome.
+func recordDownload(outcome string) {
+	state.Lock()
+	defer state.Unlock()
+	switch outcome {
+	case downloadComplete:
+		state.DownloadsCompleted++
+	case downloadClientDisconnect:
+		state.DownloadsClientAborted++
+	case downloadWriteError:
+		state.DownloadWriteErrors++
+	}
+}
+
+// allowGetOrHead answers 405 with an Allow header for methods other than
+// GET and HEAD. HEAD gets the same headers as GET, so pollers can read the
+// size, checksums and Last-Modified without downloading anything.
+func allowGetOrHead(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return true
+	}
+	w.Header().Set("Allow", "GET, HEAD")
+	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
+// notModified reports whether a conditional GET or HEAD will be answered
+// with 304 by http.ServeContent, so the caller can skip work that only
+// applies to real downloads. If-None-Match takes precedence over
+// If-Modified-Since, as in ServeContent.
+func notModified(r *http.Request, etag string, modTime time.Time) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || tag == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || modTime.IsZero() || modTime.Unix() == 0 {
+		return false
+	}
+	return !modTime.Truncate(time.Second).After(since)
+}
+
+// downloadFilename names a saved download after the image's version and
+// commit, e.g. beacon_firmware-1.2.3-a1b2c3d4.bin, so archived copies can
+// be told apart. The URL stays the same.
+func downloadFilename(name, version, commit string) string {
+	ext := filepath.Ext(name)
+	filename := strings.TrimSuffix(name, ext)
+	version = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune(".+_-", r) {
+			return r
+		}
+		return -1
+	}, version)
+	if version != "" {
+		filename += "-" + version
+	}
+	if commit != "" {
+		filename += "-" + commit[:min(8, len(commit))]
+	}
+	return filename + ext
+}
+
+// contentDisposition is an attachment header for filename.
+func contentDisposition(filename string) string {
+	return mime.FormatMediaType("attachment", map[string]string{"filename": filename})
+}
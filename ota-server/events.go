@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Build event types sent to /events subscribers.
+const (
+	eventBuildStarted   = "started"
+	eventBuildLog       = "log"
+	eventBuildCompleted = "completed"
+	eventBuildFailed    = "failed"
+)
+
+// BuildEvent is one build state transition or output line.
+type BuildEvent struct {
+	Type   string    `json:"type"`
+	Time   time.Time `json:"time"`
+	Line   string    `json:"line,omitempty"`
+	Commit string    `json:"commit,omitempty"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// eventHub fans build events out to subscribers. It has its own lock so
+// events can be published with or without state held.
+type eventHub struct {
+	mu          sync.Mutex
+	subscribers map[chan BuildEvent]struct{}
+	closed      bool
+}
+
+// subscriberBuffer is how many events a slow client may fall behind
+// before events are dropped for it.
+const subscriberBuffer = 256
+
+func (h *eventHub) subscribe() chan BuildEvent {
+	ch := make(chan BuildEvent, subscriberBuffer)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		close(ch)
+		return ch
+	}
+	if h.subscribers == nil {
+		h.subscribers = make(map[chan BuildEvent]struct{})
+	}
+	h.subscribers[ch] = struct{}{}
+	return ch
+}
+
+func (h *eventHub) unsubscribe(ch chan BuildEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subscribers[ch]; ok {
+		delete(h.subscribers, ch)
+		close(ch)
+	}
+}
+
+// publish never blocks: a subscriber whose buffer is full misses the event.
+func (h *eventHub) publish(ev BuildEvent) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subscribers {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// closeAll ends every subscription, e.g. on shutdown, so open streams
+// don't hold the server up.
+func (h *eventHub) closeAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for ch := range h.subscribers {
+		delete(h.subscribers, ch)
+		close(ch)
+	}
+}
+
+// eventLineWriter publishes build output to the hub one line at a time.
+type eventLineWriter struct {
+	partial []byte
+}
+
+func (w *eventLineWriter) Write(p []byte) (int, error) {
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		state.Events.publish(BuildEvent{Type: eventBuildLog, Line: string(bytes.TrimRight(w.partial[:i], "\r"))})
+		w.partial = w.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+// flush publishes a trailing line that had no newline.
+func (w *eventLineWriter) flush() {
+	if len(w.partial) > 0 {
+		state.Events.publish(BuildEvent{Type: eventBuildLog, Line: string(w.partial)})
+		w.partial = nil
+	}
+}
+
+// eventsHandler streams build events as Server-Sent Events until the
+// client disconnects or the server shuts down.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	events := state.Events.subscribe()
+	defer state.Events.unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	streamWithoutDeadline(w)
+
+	state.RLock()
+	building := state.BuildInProgress
+	state.RUnlock()
+	fmt.Fprintf(w, "retry: 5000\n\n")
+	if building {
+		writeEvent(w, BuildEvent{Type: eventBuildStarted, Time: time.Now()})
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			writeEvent(w, ev)
+		case <-keepalive.C:
+			fmt.Fprintf(w, ": keepalive\n\n")
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w http.ResponseWriter, ev BuildEvent) {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		slog.Warn("⚠️  Could not encode build event", "error", err)
+		return
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+}
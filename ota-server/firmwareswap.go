@@ -0,0 +1,15 @@
+package main
+
+import "sync"
+
+// firmwareSwap orders replacing the current image against downloads
+// opening it. Publishers hold the write lock while they swap the file and
+// record which commit it is; downloads hold the read lock while they open
+// the image and read that record, so a download never pairs the new image
+// with the old commit or the other way round. New downloads wait for the
+// swap, which only takes a rename.
+//
+// Downloads release it before streaming: the open handle keeps reading the
+// image it started with, so a slow device can't hold up a release.
+// Take it before state's lock, never while holding that.
+var firmwareSwap sync.RWMutex
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+)
+
+const maxFlagsBytes = 64 << 10
+
+// loadFeatureFlags reads the initial flags from config.FeatureFlagsFile, if
+// set.
+// Flags default to an empty object.
+func loadFeatureFlags() {
+	flags := []byte("{}")
+	if path := config.FeatureFlagsFile; path != "" {
+		data, err := os.ReadFile(path)
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			slog.Warn("⚠️  Could not read feature flags", "path", path, "error", err)
+		default:
+			if normalized, err := normalizeFlags(data); err != nil {
+				slog.Warn("⚠️  Ignoring invalid feature flags", "path", path, "error", err)
+			} else {
+				flags = normalized
+			}
+		}
+	}
+
+	state.Lock()
+	setFeatureFlags(flags)
+	state.Unlock()
+}
+
+// normalizeFlags validates that data is a JSON object and compacts it so the
+// ETag doesn't change with formatting.
+func normalizeFlags(data []byte) ([]byte, error) {
+	var obj map[string]any
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, fmt.Errorf("flags must be a JSON object: %w", err)
+	}
+	if obj == nil {
+		return nil, fmt.Errorf("flags must be a JSON object, got null")
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// setFeatureFlags stores already-validated flags. Callers must hold state.Lock.
+func setFeatureFlags(flags []byte) {
+	sum := sha256.Sum256(flags)
+	state.FeatureFlags = flags
+	state.FeatureFlagsETag = `"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+func flagsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		state.RLock()
+		flags, etag := state.FeatureFlags, state.FeatureFlagsETag
+		state.RUnlock()
+
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", "no-cache")
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(flags)
+
+	case http.MethodPut:
+		if !requireAdmin(w, r) {
+			return
+		}
+		data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxFlagsBytes))
+		if err != nil {
+			http.Error(w, "Failed to read body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		flags, err := normalizeFlags(data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if path := config.FeatureFlagsFile; path != "" {
+			if err := os.WriteFile(path, flags, 0644); err != nil {
+				slog.Error("❌ Failed to persist feature flags", "path", path, "error", err)
+				http.Error(w, "Failed to persist flags", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		state.Lock()
+		setFeatureFlags(flags)
+		etag := state.FeatureFlagsETag
+		state.Unlock()
+
+		slog.Info("🚩 Feature flags updated", "event", "flags_updated", "remote_addr", r.RemoteAddr, "etag", etag)
+
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(flags)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
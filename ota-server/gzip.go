@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FirmwareGzip is a gzip-compressed copy of the current firmware, made
+// once per image rather than on every download. Data is nil when the image
+// doesn't get smaller.
+type FirmwareGzip struct {
+	SHA256 string
+	Data   []byte
+}
+
+// acceptsGzip reports whether the request's Accept-Encoding allows gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if coding = strings.TrimSpace(coding); coding != "gzip" && coding != "*" {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// gzippedFirmware returns the compressed current firmware described by
+// digest, compressing and caching it in ServerState.FirmwareGzip if the
+// image has changed since the last call.
+func gzippedFirmware(info FirmwareInfo, content io.ReaderAt, digest FirmwareDigest) ([]byte, error) {
+	state.RLock()
+	cached := state.FirmwareGzip
+	state.RUnlock()
+	if cached.SHA256 == digest.SHA256 {
+		return cached.Data, nil
+	}
+
+	var buf bytes.Buffer
+	gz, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if _, err := io.Copy(gz, io.NewSectionReader(content, 0, info.Size)); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	compressed := FirmwareGzip{SHA256: digest.SHA256}
+	if int64(buf.Len()) < info.Size {
+		compressed.Data = buf.Bytes()
+	}
+
+	state.Lock()
+	state.FirmwareGzip = compressed
+	state.Unlock()
+	return compressed.Data, nil
+}
+
+// currentFirmwareGzip compresses the current firmware ahead of the first
+// download that asks for it.
+func currentFirmwareGzip() ([]byte, error) {
+	obj, err := firmwareStore.Open(config.FirmwareFile)
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+	digest, err := firmwareDigest(obj.FirmwareInfo, obj.Content)
+	if err != nil {
+		return nil, err
+	}
+	return gzippedFirmware(obj.FirmwareInfo, obj.Content, digest)
+}
+
+// serveGzip sends the compressed firmware in full. http.ServeContent drops
+// Content-Length once Content-Encoding is set, which leaves devices and
+// countingWriter unable to tell a finished download from a truncated one,
+// so the length of the compressed body is announced here. Ranged and
+// not-modified requests still go through ServeContent.
+func serveGzip(w http.ResponseWriter, r *http.Request, modTime time.Time, gz []byte) {
+	if !modTime.IsZero() {
+		w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Length", strconv.Itoa(len(gz)))
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		w.Write(gz)
+	}
+}
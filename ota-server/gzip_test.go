@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestGzipDownloadLength(t *testing.T) {
+	image := testImage("1.0.0", 'A', 64<<10)
+	useTestFirmware(t, image)
+
+	var logs bytes.Buffer
+	savedLogger := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(savedLogger) })
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, nil)))
+
+	state.Lock()
+	completed := state.DownloadsCompleted
+	state.Unlock()
+
+	for _, method := range []string{http.MethodHead, http.MethodGet} {
+		t.Run(method, func(t *testing.T) {
+			logs.Reset()
+			r := httptest.NewRequest(method, "/"+config.FirmwareFile, nil)
+			r.Header.Set("Accept-Encoding", "gzip")
+			w := httptest.NewRecorder()
+			serveFirmware(w, r)
+
+			if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != "gzip" {
+				t.Fatalf("status %d, Content-Encoding %q, want a 200 gzip response",
+					w.Code, w.Header().Get("Content-Encoding"))
+			}
+			gz, err := currentFirmwareGzip()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := w.Header().Get("Content-Length"); got != strconv.Itoa(len(gz)) {
+				t.Errorf("Content-Length = %q, want the compressed size %d", got, len(gz))
+			}
+			if method == http.MethodHead {
+				if w.Body.Len() != 0 {
+					t.Errorf("HEAD returned a %d byte body", w.Body.Len())
+				}
+				return
+			}
+
+			zr, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if body, err := io.ReadAll(zr); err != nil || !bytes.Equal(body, image) {
+				t.Errorf("body doesn't decompress to the image (%d bytes, err %v)", len(body), err)
+			}
+
+			var entry struct {
+				Event    string `json:"event"`
+				Bytes    int64  `json:"bytes"`
+				Expected int64  `json:"expected_bytes"`
+			}
+			for _, line := range bytes.Split(logs.Bytes(), []byte("\n")) {
+				if json.Unmarshal(line, &entry) == nil && entry.Event == "download_complete" {
+					break
+				}
+				entry.Event = ""
+			}
+			if entry.Event == "" {
+				t.Fatalf("no download_complete event logged:\n%s", logs.String())
+			}
+			if entry.Expected != int64(len(gz)) || entry.Bytes != int64(len(gz)) {
+				t.Errorf("logged %d of %d bytes, want %d of %d", entry.Bytes, entry.Expected, len(gz), len(gz))
+			}
+			state.Lock()
+			defer state.Unlock()
+			if state.DownloadsCompleted != completed+1 {
+				t.Errorf("DownloadsCompleted = %d, want %d", state.DownloadsCompleted, completed+1)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+const maxBuildHistory = 50
+
+// BuildRecord describes one finished build.
+type BuildRecord struct {
+	Commit          string    `json:"commit"`
+	Ref             string    `json:"ref,omitempty"`
+	Channel         string    `json:"channel,omitempty"`
+	Trigger         string    `json:"trigger,omitempty"`
+	StartTime       time.Time `json:"startTime"`
+	DurationSeconds float64   `json:"durationSeconds"`
+	Success         bool      `json:"success"`
+	FirmwareSize    int64     `json:"firmwareSize"`
+	Error           string    `json:"error,omitempty"`
+	TimedOut        bool      `json:"timedOut,omitempty"`
+	Aborted         bool      `json:"aborted,omitempty"`
+
+	// Runs of the primary build, more than 1 after network errors
+	Attempts int `json:"attempts,omitempty"`
+
+	// Failures of extra targets, by name; the primary's is Error
+	TargetErrors map[string]string `json:"targetErrors,omitempty"`
+
+	// Pre- and post-build hook runs, see runBuildHook
+	Hooks []HookResult `json:"hooks,omitempty"`
+
+	// Checksum of an uploaded image, which has no commit
+	SHA256 string `json:"sha256,omitempty"`
+
+	// Who signed the built commit or tag, with REQUIRE_SIGNED_COMMITS
+	Signer string `json:"signer,omitempty"`
+
+	// Saved output, served by /logs?commit= until the entry is evicted
+	LogFile string `json:"logFile,omitempty"`
+
+	IDFVersion      string `json:"idfVersion,omitempty"`
+	CompilerVersion string `json:"compilerVersion,omitempty"`
+}
+
+// appendBuildRecord adds a record to the bounded build history, dropping
+// the oldest entries beyond maxBuildHistory along with their saved logs.
+// Callers must hold state.Lock.
+func appendBuildRecord(record BuildRecord) {
+	state.History = append(state.History, record)
+	if over := len(state.History) - maxBuildHistory; over > 0 {
+		for _, evicted := range state.History[:over] {
+			removeBuildLogFile(evicted.LogFile)
+		}
+		state.History = append([]BuildRecord(nil), state.History[over:]...)
+	}
+}
+
+// BuildDurations summarises how long the successful builds in the history
+// took, to spot builds getting slower.
+type BuildDurations struct {
+	Builds         int     `json:"builds"`
+	LastSeconds    float64 `json:"lastSeconds"`
+	AverageSeconds float64 `json:"averageSeconds"`
+	MaxSeconds     float64 `json:"maxSeconds"`
+}
+
+// buildDurations aggregates the successful builds in the history. Failed
+// builds are left out since they usually stop early. Callers must hold
+// state.RLock.
+func buildDurations() BuildDurations {
+	var d BuildDurations
+	var total float64
+	for _, record := range state.History {
+		if !record.Success || record.Trigger == buildReasonUpload || record.Trigger == buildReasonRollback {
+			continue
+		}
+		d.Builds++
+		d.LastSeconds = record.DurationSeconds
+		d.MaxSeconds = max(d.MaxSeconds, record.DurationSeconds)
+		total += record.DurationSeconds
+	}
+	if d.Builds > 0 {
+		d.AverageSeconds = total / float64(d.Builds)
+	}
+	return d
+}
+
+// historyHandler returns the retained builds, newest first.
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	state.RLock()
+	records := make([]BuildRecord, 0, len(state.History))
+	for i := len(state.History) - 1; i >= 0; i-- {
+		records = append(records, state.History[i])
+	}
+	state.RUnlock()
+
+	writeJSON(w, records)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+const (
+	hookPreBuild  = "pre-build"
+	hookPostBuild = "post-build"
+
+	hookFailureWarn = "warn"
+	hookFailureFail = "fail"
+
+	// Hooks upload and notify, so allow a slow network but not a hang
+	hookTimeout = 5 * time.Minute
+
+	// Enough of a hook's output for the history to show what went wrong
+	maxHookOutputBytes = 16 << 10
+)
+
+// HookResult records one run of a build hook in the build history.
+type HookResult struct {
+	Stage           string  `json:"stage"`
+	DurationSeconds float64 `json:"durationSeconds"`
+	Output          string  `json:"output,omitempty"`
+	Error           string  `json:"error,omitempty"`
+}
+
+// resolveHooks checks the hook settings.
+func resolveHooks(cfg *Config) error {
+	switch cfg.HookFailure {
+	case "":
+		cfg.HookFailure = hookFailureWarn
+	case hookFailureWarn, hookFailureFail:
+	default:
+		return fmt.Errorf("hook failure must be %q or %q, got %q", hookFailureWarn, hookFailureFail, cfg.HookFailure)
+	}
+	return nil
+}
+
+// runBuildHook runs command, the pre- or post-build hook, with sh -c in the
+// checkout source, relative to the project like FirmwareTarget.Source. FIRMWARE_PATH is the image being built (for the
+// pre-build hook, the one it will replace), FIRMWARE_DIR the published
+// firmware directory, and COMMIT, VERSION and BUILD_TRIGGER describe the
+// build. Output goes to w as well as into the result, which is nil when no
+// hook is set. A failed hook only returns an error with HOOK_FAILURE=fail,
+// or when the build was aborted.
+func runBuildHook(ctx context.Context, stage, command, source, firmwarePath, commit, version, trigger string, w io.Writer) (*HookResult, error) {
+	if command == "" {
+		return nil, nil
+	}
+	slog.Info("🪝 Running build hook", "event", "hook_started", "stage", stage, "commit", commit[:min(8, len(commit))])
+	fmt.Fprintf(w, "\n==> Running %s hook\n", stage)
+
+	hookCtx, cancel := context.WithTimeout(ctx, hookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(hookCtx, "sh", "-c", command)
+	cmd.Dir = filepath.Join(config.ProjectPath, source)
+	cmd.Env = append(os.Environ(),
+		"FIRMWARE_PATH="+firmwarePath,
+		"FIRMWARE_DIR="+config.FirmwarePath,
+		"COMMIT="+commit,
+		"VERSION="+version,
+		"BUILD_TRIGGER="+trigger,
+		"HOOK_STAGE="+stage)
+	var output bytes.Buffer
+	cmd.Stdout = io.MultiWriter(&output, w)
+	cmd.Stderr = cmd.Stdout
+	start := time.Now()
+	err := cmd.Run()
+
+	result := &HookResult{Stage: stage, DurationSeconds: time.Since(start).Seconds()}
+	if output.Len() > maxHookOutputBytes {
+		result.Output = "...\n" + string(output.Bytes()[output.Len()-maxHookOutputBytes:])
+	} else {
+		result.Output = output.String()
+	}
+	if ctx.Err() != nil {
+		return result, errBuildAborted
+	}
+	if errors.Is(hookCtx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("timed out after %v", hookTimeout)
+	}
+	if err == nil {
+		slog.Info("✅ Build hook succeeded", "event", "hook_succeeded", "stage", stage, "duration", time.Since(start))
+		return result, nil
+	}
+
+	result.Error = err.Error()
+	if config.HookFailure == hookFailureFail {
+		slog.Error("❌ Build hook failed", "event", "hook_failed", "stage", stage, "error", err, "output", result.Output)
+		return result, fmt.Errorf("%s hook: %w", stage, err)
+	}
+	slog.Warn("⚠️  Build hook failed, continuing", "event", "hook_failed", "stage", stage, "error", err, "output", result.Output)
+	fmt.Fprintf(w, "==> %s hook failed (%v), continuing\n", stage, err)
+	return result, nil
+}
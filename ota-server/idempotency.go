@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// How long an Idempotency-Key on POST /build is remembered
+	idempotencyWindow    = 24 * time.Hour
+	maxIdempotencyKeyLen = 255
+	maxBuildKeys         = 1000
+)
+
+// keyedBuild is a build triggered through POST /build with an
+// Idempotency-Key.
+type keyedBuild struct {
+	req BuildRequest
+	at  time.Time
+}
+
+// buildKeys remembers recent Idempotency-Keys, so a retried POST /build
+// reports the build the first request queued instead of queueing another.
+// Its lock is held from lookup to enqueue, so concurrent retries don't both
+// queue a build.
+var buildKeys = struct {
+	sync.Mutex
+	builds map[string]keyedBuild
+}{builds: map[string]keyedBuild{}}
+
+// forgetOldBuildKeys drops keys past idempotencyWindow and, beyond
+// maxBuildKeys, the oldest. Callers must hold buildKeys.
+func forgetOldBuildKeys(now time.Time) {
+	var oldestKey string
+	var oldest time.Time
+	for key, b := range buildKeys.builds {
+		if now.Sub(b.at) > idempotencyWindow {
+			delete(buildKeys.builds, key)
+		} else if oldestKey == "" || b.at.Before(oldest) {
+			oldestKey, oldest = key, b.at
+		}
+	}
+	if len(buildKeys.builds) >= maxBuildKeys {
+		delete(buildKeys.builds, oldestKey)
+	}
+}
+
+// status describes what became of the build: the first matching build
+// that started after the key was used, else the queued or running one.
+// A build requested while an identical one was queued was coalesced with
+// it, which also started after the key was used.
+func (b keyedBuild) status() string {
+	state.RLock()
+	defer state.RUnlock()
+	for _, record := range state.History {
+		if record.StartTime.Before(b.at) || record.Ref != b.req.Ref || record.Channel != b.req.Channel ||
+			(b.req.Commit != "" && record.Commit != b.req.Commit) {
+			continue
+		}
+		commit := record.Commit[:min(8, len(record.Commit))]
+		switch {
+		case record.Success:
+			return fmt.Sprintf("succeeded (commit %s)", commit)
+		case record.Aborted:
+			return fmt.Sprintf("was aborted (commit %s)", commit)
+		default:
+			return fmt.Sprintf("failed (commit %s): %s", commit, record.Error)
+		}
+	}
+	for i, queued := range state.BuildQueue {
+		if queued.sameBuild(b.req) {
+			return fmt.Sprintf("is queued at position %d", i+1)
+		}
+	}
+	if state.BuildInProgress && state.RunningBuild.sameBuild(b.req) {
+		return "is running"
+	}
+	return "was dropped before it ran"
+}
+
+// queueIdempotentBuild queues req with queueManualBuild unless key was
+// already used within idempotencyWindow, in which case it answers with that
+// build's status and Idempotent-Replayed: true. A key reused for another
+// ref is rejected.
+func queueIdempotentBuild(w http.ResponseWriter, r *http.Request, key string, req BuildRequest) {
+	if len(key) > maxIdempotencyKeyLen {
+		http.Error(w, fmt.Sprintf("Idempotency-Key is longer than %d bytes", maxIdempotencyKeyLen), http.StatusBadRequest)
+		return
+	}
+	buildKeys.Lock()
+	now := time.Now()
+	forgetOldBuildKeys(now)
+	b, seen := buildKeys.builds[key]
+	if !seen {
+		buildKeys.builds[key] = keyedBuild{req: req, at: now}
+		message := queueManualBuild(req, r.RemoteAddr)
+		buildKeys.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprint(w, message)
+		return
+	}
+	buildKeys.Unlock()
+
+	// The commit of a branch may have moved since, so it isn't compared
+	if b.req.Ref != req.Ref || b.req.Channel != req.Channel {
+		http.Error(w, "Idempotency-Key was already used for a different build", http.StatusUnprocessableEntity)
+		return
+	}
+	slog.Info("🔁 Build already requested with this key", "event", "build_replayed", "ref", req.Ref, "remote_addr", r.RemoteAddr)
+	w.Header().Set("Idempotent-Replayed", "true")
+	fmt.Fprintf(w, "Build for this Idempotency-Key %s\n", b.status())
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ESP32 app image layout, see esp_image_format.h in ESP-IDF.
+const (
+	espImageMagic       = 0xE9
+	espImageHeaderLen   = 24
+	espSegmentHeaderLen = 8
+	espChecksumSeed     = 0xEF
+	espAppDescMagic     = 0xABCD5432
+	espHashAppendedAt   = 23 // offset of hash_appended in the image header
+	maxImageSegments    = 16
+
+	// Size of the ota_0/ota_1 app slots in partitions_ota.csv, the default
+	// FIRMWARE_MAX_SIZE; a bigger image would be rejected by esp_ota_begin
+	// on the device.
+	defaultMaxFirmwareSize = 0x1E0000
+)
+
+// firmwareSizeUsage returns how much of config.MaxFirmwareSize an image of
+// size bytes fills, in percent, and a warning once that reaches
+// config.FirmwareSizeWarnPercent.
+func firmwareSizeUsage(size int64) (percent float64, warning string) {
+	percent = float64(size) * 100 / float64(config.MaxFirmwareSize)
+	if size > 0 && percent >= float64(config.FirmwareSizeWarnPercent) {
+		warning = fmt.Sprintf("firmware is %d bytes, %.1f%% of the %d byte app partition", size, percent, config.MaxFirmwareSize)
+	}
+	return percent, warning
+}
+
+// validateFirmwareImage checks that content is a complete ESP32 app image
+// that fits an OTA slot (config.MaxFirmwareSize): header and app descriptor magic, every segment
+// within the file, the XOR checksum and, when the image carries one, the
+// appended SHA256. It catches empty, truncated or corrupted build output
+// before it is published.
+func validateFirmwareImage(content io.ReaderAt, size int64) error {
+	if size == 0 {
+		return errors.New("image is empty")
+	}
+	if size < espImageHeaderLen+espSegmentHeaderLen {
+		return fmt.Errorf("image is only %d bytes", size)
+	}
+	if size > config.MaxFirmwareSize {
+		return fmt.Errorf("image is %d bytes, %d over the %d byte app partition (FIRMWARE_MAX_SIZE); it could not be flashed",
+			size, size-config.MaxFirmwareSize, config.MaxFirmwareSize)
+	}
+	header := make([]byte, espImageHeaderLen)
+	if _, err := content.ReadAt(header, 0); err != nil {
+		return fmt.Errorf("reading image header: %w", err)
+	}
+	if header[0] != espImageMagic {
+		return fmt.Errorf("bad image magic 0x%02x", header[0])
+	}
+	segments := int(header[1])
+	if segments == 0 || segments > maxImageSegments {
+		return fmt.Errorf("implausible segment count %d", segments)
+	}
+
+	checksum := byte(espChecksumSeed)
+	offset := int64(espImageHeaderLen)
+	for i := 0; i < segments; i++ {
+		segHeader := make([]byte, espSegmentHeaderLen)
+		if _, err := content.ReadAt(segHeader, offset); err != nil {
+			return fmt.Errorf("segment %d header: %w", i, err)
+		}
+		length := int64(binary.LittleEndian.Uint32(segHeader[4:]))
+		offset += espSegmentHeaderLen
+		if offset+length > size {
+			return fmt.Errorf("segment %d runs past end of image (truncated?)", i)
+		}
+
+		data := make([]byte, length)
+		if _, err := content.ReadAt(data, offset); err != nil {
+			return fmt.Errorf("segment %d: %w", i, err)
+		}
+		if i == 0 && (length < 4 || binary.LittleEndian.Uint32(data) != espAppDescMagic) {
+			return errors.New("missing app descriptor")
+		}
+		for _, b := range data {
+			checksum ^= b
+		}
+		offset += length
+	}
+
+	// The checksum byte sits at the end of padding to a 16-byte boundary
+	offset += 15 - offset%16
+	stored := make([]byte, 1)
+	if _, err := content.ReadAt(stored, offset); err != nil {
+		return fmt.Errorf("reading checksum: %w", err)
+	}
+	if stored[0] != checksum {
+		return fmt.Errorf("checksum mismatch: image has 0x%02x, computed 0x%02x", stored[0], checksum)
+	}
+	offset++
+
+	if header[espHashAppendedAt] == 1 {
+		want := make([]byte, sha256.Size)
+		if _, err := content.ReadAt(want, offset); err != nil {
+			return fmt.Errorf("reading appended SHA256 (truncated?): %w", err)
+		}
+		hash := sha256.New()
+		if _, err := io.Copy(hash, io.NewSectionReader(content, 0, offset)); err != nil {
+			return err
+		}
+		if !bytes.Equal(hash.Sum(nil), want) {
+			return errors.New("appended SHA256 does not match image")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// latestFirmwareHandler redirects /firmware/latest to the current build's
+// versioned URL, named like the file browsers save, so download tooling
+// keeps a meaningful local filename. Devices keep polling the fixed
+// firmware URL, which needs no redirect.
+func latestFirmwareHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowGetOrHead(w, r) {
+		return
+	}
+
+	firmwareSwap.RLock()
+	state.RLock()
+	commit, version := state.LastGitCommit, state.FirmwareVersion
+	uploaded := state.Upload != nil
+	state.RUnlock()
+	if file, err := firmwareStore.Open(config.FirmwareFile); err == nil {
+		if embedded := readFirmwareVersion(file.Content); embedded != "" {
+			version = embedded
+		}
+		file.Close()
+	}
+	firmwareSwap.RUnlock()
+	if uploaded {
+		http.Error(w, "The current firmware was uploaded and has no versioned URL", http.StatusNotFound)
+		return
+	}
+	if commit == "" {
+		http.Error(w, "No firmware built yet", http.StatusNotFound)
+		return
+	}
+
+	location := "/firmware/versions/" + url.PathEscape(downloadFilename(config.FirmwareFile, version, commit))
+	w.Header().Set("Cache-Control", "no-cache")
+	slog.Debug("↪️  Redirecting to latest firmware", "location", location, "remote_addr", r.RemoteAddr)
+	http.Redirect(w, r, location, http.StatusFound)
+}
+
+// versionedFirmwareHandler serves /firmware/versions/<name>-<version>-<commit>.bin
+// from the retained build of that commit, so a versioned URL always returns
+// the image it names, even after newer builds or during a canary rollout.
+func versionedFirmwareHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/firmware/versions/")
+	rest, ok := strings.CutPrefix(name, strings.TrimSuffix(config.FirmwareFile, ".bin")+"-")
+	rest, isBin := strings.CutSuffix(rest, ".bin")
+	if !ok || !isBin {
+		http.NotFound(w, r)
+		return
+	}
+	version, commit := "", rest
+	if i := strings.LastIndex(rest, "-"); i >= 0 {
+		version, commit = rest[:i], rest[i+1:]
+	}
+	if version != "" && !versionParamPattern.MatchString(version) {
+		http.Error(w, "Invalid version in firmware name", http.StatusBadRequest)
+		return
+	}
+	commit, valid := requireCommitParam(w, "commit in firmware name", commit)
+	if !valid {
+		return
+	}
+
+	pinned := r.Clone(r.Context())
+	query := pinned.URL.Query()
+	query.Set("commit", commit)
+	pinned.URL.RawQuery = query.Encode()
+	serveFirmware(w, pinned)
+}
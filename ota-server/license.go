@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// VersionLicense caps how many distinct devices may download a firmware
+// version. A zero Cap means unlimited.
+type VersionLicense struct {
+	Cap     int                  `json:"cap"`
+	Devices map[string]time.Time `json:"devices"`
+}
+
+// LicenseUsage summarizes a version's seats for status reporting.
+type LicenseUsage struct {
+	Used int `json:"used"`
+	Cap  int `json:"cap"`
+}
+
+// claimLicenseSeat records the requesting device against version's cap. It
+// returns false, after writing a 403, when the device would exceed it.
+// Devices that already hold a seat can always re-download.
+func claimLicenseSeat(w http.ResponseWriter, r *http.Request, version string) bool {
+	claimed := false
+	defer func() {
+		// After the unlock below; seats must survive a restart
+		if claimed {
+			saveState()
+		}
+	}()
+	state.Lock()
+	defer state.Unlock()
+
+	license := state.Licenses[version]
+	if license == nil || license.Cap == 0 {
+		return true
+	}
+
+	id := strings.ToLower(deviceID(r))
+	if id == "" {
+		slog.Warn("🚫 Refusing licensed firmware: no device ID", "event", "license_refused", "version", version, "remote_addr", r.RemoteAddr)
+		http.Error(w, "Firmware "+version+" is licensed per device: send X-Device-ID", http.StatusForbidden)
+		return false
+	}
+	if _, ok := license.Devices[id]; ok {
+		return true
+	}
+	if len(license.Devices) >= license.Cap {
+		slog.Warn("🚫 License cap reached", "event", "license_refused", "version", version, "cap", license.Cap, "device", id)
+		http.Error(w, "License limit reached for firmware "+version, http.StatusForbidden)
+		return false
+	}
+
+	license.Devices[id] = time.Now()
+	claimed = true
+	slog.Info("🎫 Device took license seat", "event", "license_claimed", "device", id, "seat", len(license.Devices),
+		"cap", license.Cap, "version", version)
+	return true
+}
+
+// licenseUsage returns per-version seat usage. Callers must hold state.RLock.
+func licenseUsage() map[string]LicenseUsage {
+	usage := make(map[string]LicenseUsage, len(state.Licenses))
+	for version, license := range state.Licenses {
+		usage[version] = LicenseUsage{Used: len(license.Devices), Cap: license.Cap}
+	}
+	return usage
+}
+
+func licensesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		state.RLock()
+		usage := licenseUsage()
+		state.RUnlock()
+		writeJSON(w, usage)
+
+	case http.MethodPut:
+		if !requireAdmin(w, r) {
+			return
+		}
+
+		var req struct {
+			Version string `json:"version"`
+			Cap     int    `json:"cap"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Version == "" || req.Cap < 0 {
+			http.Error(w, "version is required and cap must be >= 0", http.StatusBadRequest)
+			return
+		}
+
+		state.Lock()
+		license := state.Licenses[req.Version]
+		if license == nil {
+			license = &VersionLicense{Devices: make(map[string]time.Time)}
+			state.Licenses[req.Version] = license
+		}
+		license.Cap = req.Cap
+		usage := LicenseUsage{Used: len(license.Devices), Cap: license.Cap}
+		state.Unlock()
+		saveState()
+
+		slog.Info("🎫 License cap set", "event", "license_cap_set", "version", req.Version, "cap", req.Cap, "remote_addr", r.RemoteAddr)
+
+		writeJSON(w, usage)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
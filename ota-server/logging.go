@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Log messages keep their emoji prefix and carry details as slog
+// attributes. The "pretty" format prints them much like the server always
+// has; "text" and "json" drop the emoji and are meant for log aggregators.
+// In JSON, durations are reported in seconds.
+
+// setupLogging installs the configured handler as the default logger, so
+// both slog and any remaining log package output go through it.
+func setupLogging(format, level string) error {
+	handler, err := newLogHandler(format, level, os.Stderr)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// fatal logs an error and exits, like log.Fatal.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+func newLogHandler(format, level string, w io.Writer) (slog.Handler, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("log level must be debug, info, warn or error, got %q", level)
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl, ReplaceAttr: plainMessage}
+	switch format {
+	case "pretty":
+		return &prettyHandler{mu: &sync.Mutex{}, w: w, level: lvl}, nil
+	case "text":
+		return slog.NewTextHandler(w, opts), nil
+	case "json":
+		opts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+			if a.Value.Kind() == slog.KindDuration {
+				return slog.Float64(a.Key, a.Value.Duration().Seconds())
+			}
+			return plainMessage(groups, a)
+		}
+		return slog.NewJSONHandler(w, opts), nil
+	}
+	return nil, fmt.Errorf("log format must be pretty, text or json, got %q", format)
+}
+
+// plainMessage strips the emoji prefix from log messages.
+func plainMessage(groups []string, a slog.Attr) slog.Attr {
+	if len(groups) == 0 && a.Key == slog.MessageKey {
+		msg := a.Value.String()
+		if r := []rune(msg); len(r) > 0 && r[0] > unicode.MaxLatin1 {
+			if _, rest, ok := strings.Cut(msg, " "); ok {
+				msg = strings.TrimLeft(rest, " ")
+			}
+		}
+		return slog.String(slog.MessageKey, msg)
+	}
+	return a
+}
+
+// prettyHandler writes "2006/01/02 15:04:05 message key=value ..." lines,
+// the format of the standard logger. Warnings and errors are marked by
+// their message's emoji, so the level isn't printed, and neither are empty
+// values. The event name is printed like any other attribute, so pretty
+// logs can be grepped for it too.
+type prettyHandler struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	level  slog.Level
+	prefix string // preformatted attributes from WithAttrs
+	group  string
+}
+
+func (h *prettyHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *prettyHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+	if !r.Time.IsZero() {
+		b.WriteString(r.Time.Format("2006/01/02 15:04:05 "))
+	}
+	b.WriteString(r.Message)
+	b.WriteString(h.prefix)
+	r.Attrs(func(a slog.Attr) bool {
+		appendPrettyAttr(&b, h.group, a)
+		return true
+	})
+	b.WriteByte('\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, b.String())
+	return err
+}
+
+func (h *prettyHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var b strings.Builder
+	for _, a := range attrs {
+		appendPrettyAttr(&b, h.group, a)
+	}
+	h2 := *h
+	h2.prefix += b.String()
+	return &h2
+}
+
+func (h *prettyHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.group += name + "."
+	return &h2
+}
+
+func appendPrettyAttr(b *strings.Builder, group string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) || a.Value.Equal(slog.StringValue("")) {
+		return
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		for _, ga := range a.Value.Group() {
+			appendPrettyAttr(b, group+a.Key+".", ga)
+		}
+		return
+	}
+
+	// Multi-line values such as build output go on lines of their own
+	value := strings.TrimRight(a.Value.String(), "\n")
+	switch {
+	case strings.Contains(value, "\n"):
+		value = "\n" + value
+	case strings.ContainsAny(value, " \"="):
+		value = fmt.Sprintf("%q", value)
+	}
+	fmt.Fprintf(b, " %s%s=%s", group, a.Key, value)
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestPrettyHandlerKeepsEvent(t *testing.T) {
+	var out bytes.Buffer
+	handler, err := newLogHandler("pretty", "info", &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slog.New(handler).Info("✅ Build completed", "event", "build_completed", "commit", "abc12345", "error", "")
+
+	line := out.String()
+	if !strings.Contains(line, "✅ Build completed event=build_completed commit=abc12345") {
+		t.Errorf("line %q lacks the event and commit", line)
+	}
+	if strings.Contains(line, "error=") {
+		t.Errorf("line %q prints an empty value", line)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// versionWaiters counts the /version requests held open by waitForUpdate.
+var versionWaiters atomic.Int64
+
+// isUpdateFor reports whether the build with version and commit is an
+// update for a device reporting current, which is either its firmware
+// version or the commit (at least 7 hex digits) it was built from.
+func isUpdateFor(version, commit, current string) bool {
+	if len(current) >= 7 && len(current) <= 40 && strings.Trim(strings.ToLower(current), "0123456789abcdef") == "" {
+		return !strings.HasPrefix(commit, strings.ToLower(current))
+	}
+	return compareVersions(version, current) > 0
+}
+
+// offeredBuild returns the version and commit /version answers r with:
+// the stable build for devices held back by a canary rollout, else the
+// current one.
+func offeredBuild(r *http.Request) (version, commit string) {
+	if stable, ok := stableBuildFor(r); ok {
+		return getFirmwareVersion(filepath.Join(config.FirmwarePath, stable.Name)), stable.Commit
+	}
+	state.RLock()
+	version, commit = state.FirmwareVersion, state.LastGitCommit
+	state.RUnlock()
+	if version == "" {
+		version = getFirmwareVersion(filepath.Join(config.FirmwarePath, config.FirmwareFile))
+	}
+	return version, commit
+}
+
+// parseWait reads ?wait= as seconds or a duration like "2m", capped at
+// config.LongPollMax.
+func parseWait(value string) time.Duration {
+	wait, err := time.ParseDuration(value)
+	if seconds, convErr := strconv.Atoi(value); convErr == nil {
+		wait, err = time.Duration(seconds)*time.Second, nil
+	}
+	if err != nil || wait <= 0 {
+		return 0
+	}
+	if wait > config.LongPollMax {
+		return config.LongPollMax
+	}
+	return wait
+}
+
+// waitForUpdate holds a /version?wait=<seconds>&current=<version or commit>
+// request while the device is up to date, until a build gives it an update,
+// the wait (capped at config.LongPollMax) ends or the client goes away.
+// The normal answer follows either way. Beyond config.LongPollWaiters held
+// requests, new ones are answered at once so devices fall back to polling.
+func waitForUpdate(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	current := query.Get("current")
+	wait := parseWait(query.Get("wait"))
+	if current == "" || wait == 0 {
+		return
+	}
+	if n := versionWaiters.Add(1); n > int64(config.LongPollWaiters) {
+		versionWaiters.Add(-1)
+		slog.Debug("⏳ Too many waiting version checks, answering at once", "remote_addr", r.RemoteAddr)
+		return
+	}
+	defer versionWaiters.Add(-1)
+
+	// Subscribe before checking so a build finishing in between isn't missed
+	events := state.Events.subscribe()
+	defer state.Events.unsubscribe(events)
+	if version, commit := offeredBuild(r); isUpdateFor(version, commit, current) {
+		return
+	}
+
+	streamWithoutDeadline(w)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	start := time.Now()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-timer.C:
+			slog.Debug("⏳ Version wait timed out", "remote_addr", r.RemoteAddr, "current", current, "waited", time.Since(start))
+			return
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			if ev.Type != eventBuildCompleted {
+				continue
+			}
+			if version, commit := offeredBuild(r); isUpdateFor(version, commit, current) {
+				slog.Info("🔔 Waiting device notified of new firmware", "event", "version_wait_notified", "remote_addr", r.RemoteAddr,
+					"current", current, "version", version, "waited", time.Since(start).Round(time.Second))
+				return
+			}
+		}
+	}
+}
@@ -1,174 +1,723 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"io"
+	"io/fs"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
-const (
-	port          = "8080"
-	firmwarePath  = "/firmware"
-	firmwareFile  = "beacon_firmware.bin"
-	projectPath   = "/project"
-	gitBranch     = "main"
-	checkInterval = 1 * time.Hour
-)
+// Builds write here (relative to config.FirmwarePath) before being published
+const buildOutputDir = ".build"
 
 type ServerState struct {
 	sync.RWMutex
-	LastGitCommit  string
-	LastBuildTime  time.Time
-	LastCheckTime  time.Time
+	LastGitCommit   string
+	LastCommitInfo  CommitInfo
+	LastBuildTime   time.Time
+	LastCheckTime   time.Time
+	NextCheckTime   time.Time
 	BuildInProgress bool
-	FirmwareSize   int64
-	BuildError     string
+	FirmwareSize    int64
+	BuildError      string
+
+	FirmwareVersion  string
+	MinVersion       string
+	FirmwareChecksum FirmwareDigest
+	FirmwareGzip     FirmwareGzip
+	History          []BuildRecord
+	RetainedVersions []RetainedVersion
+
+	Toolchain        Toolchain
+	ToolchainWarning string
+
+	MonitorLastActive time.Time
+	MonitorRestarts   int
+
+	LastPruneTime      time.Time
+	LastPruneReclaimed string
+
+	Notes            FirmwareNotes
+	FeatureFlags     []byte
+	FeatureFlagsETag string
+	Licenses         map[string]*VersionLicense
+
+	// Download outcomes, see classifyDownload
+	DownloadsCompleted     int
+	DownloadsClientAborted int
+	DownloadWriteErrors    int
+
+	Metrics BuildMetrics
+
+	// Staged rollout pointers, see canary.go
+	StableCommit string
+	CanaryCommit string
+
+	// Events publishes build progress to /events subscribers
+	Events eventHub
+
+	Targets []TargetStatus
+	// Wall-clock time of the last build of all targets
+	TargetBuildWall time.Duration
+
+	// Release channels besides the tracked branch, see channels.go
+	Channels []ChannelStatus
+
+	// Maintenance mode, see pause.go
+	Maintenance Maintenance
+
+	// Set by rollbacks and uploads, see PublishPin
+	Pin PublishPin
+	// The served image when it was uploaded rather than built
+	Upload *UploadInfo
+
+	// Recent firmware downloads, see devices.go
+	Downloads []DeviceDownload
+
+	// Downloads and flash confirmations per build, see rollout.go
+	Rollouts []*Rollout
+
+	Deltas []DeltaInfo
+
+	// Last image /ready found valid, see ready.go
+	ValidatedFirmware FirmwareInfo
+
+	// Builds waiting for the build worker, see buildqueue.go
+	BuildQueue []BuildRequest
+
+	// The running build and how to abort it, see buildcancel.go
+	RunningBuild BuildRequest
+	CancelBuild  context.CancelFunc
+
+	// A/B partition assignments, see slots.go
+	Slots      map[string]string
+	ActiveSlot string
+
+	// Why the project isn't a git checkout yet, see repo.go
+	RepositoryError string
+
+	// Unbuilt commits on origin, see stale.go
+	CommitsBehind       int
+	OldestUnbuiltCommit time.Time
 }
 
-var state = &ServerState{}
+var state = &ServerState{
+	Licenses: make(map[string]*VersionLicense),
+}
 
 func main() {
-	// Start git monitor
-	go gitMonitor()
+	serverStarted = time.Now()
+	configPath := flag.String("config", os.Getenv("OTA_CONFIG"), "path to a JSON config file")
+	buildOnce := flag.Bool("build-once", false, "build the checkout once, print the result and exit")
+	flag.Parse()
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		fatal("❌ Invalid configuration", "error", err)
+	}
+	config = cfg
+	if err := setupLogging(config.LogFormat, config.LogLevel); err != nil {
+		fatal("❌ Invalid logging configuration", "error", err)
+	}
+
+	if config.SigningKey != "" {
+		key, err := loadSigningKey(config.SigningKey)
+		if err != nil {
+			fatal("❌ Invalid signing key", "error", err)
+		}
+		signingKey = key
+	}
+
+	firmwareStore = newFirmwareStore()
+	if mirrorMode() && *buildOnce {
+		fatal("❌ A mirror can't build, unset FIRMWARE_STORE to use -build-once")
+	}
+	// requireAdmin refuses every admin request without a token, so fail
+	// loudly here rather than start with /build and /rollback unusable
+	if config.AdminToken == "" && !mirrorMode() && !*buildOnce {
+		fatal("❌ OTA_ADMIN_TOKEN is not set; /build, /rollback and the other admin endpoints need it." +
+			" Set it (or adminToken in the config file) to a long random value")
+	}
+	if mirrorMode() {
+		slog.Info("🪞 Mirroring firmware from the primary, builds are disabled", "event", "mirror_mode",
+			"url", redactedURL(config.MirrorURL))
+	} else if err := checkBuildBackend(); err != nil {
+		fatal("❌ Build backend unusable", "backend", config.BuildBackend, "error", err)
+	} else if _, err := ensureRepository(); err != nil {
+		if config.GitRepoURL == "" || *buildOnce {
+			fatal("❌ Project repository not initialized", "path", config.ProjectPath, "error", err)
+		}
+		slog.Error("❌ Could not clone the project repository, retrying on every git check", "event", "repo_clone_failed", "error", err)
+	}
+	initTargetStatus()
+	initChannelStatus()
+	loadRetainedVersions()
+	if *buildOnce {
+		os.Exit(runBuildOnce())
+	}
+	go mirrorSync()
+
+	loadFeatureFlags()
+
+	// Skip the startup build when the published image is already the
+	// build of the checked-out commit
+	upToDate := loadState()
+	if upToDate && config.ForceInitialBuild {
+		slog.Info("🔨 Published firmware matches the checkout, building anyway (FORCE_INITIAL_BUILD)")
+		upToDate = false
+	} else if upToDate {
+		slog.Info("✅ Published firmware is up to date, skipping initial build")
+	}
+	if buildsPaused() {
+		slog.Warn("⏸️  Maintenance mode is on, automatic builds stay paused until POST /maintenance")
+	}
+
+	// Start the build worker and the git monitor under the watchdog
+	if !mirrorMode() {
+		go buildWorker()
+		go superviseGitMonitor(!upToDate)
+		startChannelMonitors()
+		go pruneMonitor()
+		go backendHealthMonitor()
+	}
+	go metricsPusher()
 
 	// HTTP handlers
-	http.HandleFunc("/beacon_firmware.bin", serveFirmware)
+	http.HandleFunc("/"+config.FirmwareFile, variantFirmwareHandler)
+	http.HandleFunc("/"+metadataName(config.FirmwareFile), firmwareMetadataHandler)
 	http.HandleFunc("/version", versionCheckHandler)
+	http.HandleFunc("/manifest.json", manifestHandler)
+	http.HandleFunc("/verify", verifyHandler)
+	http.HandleFunc("/v", versionProbeHandler)
 	http.HandleFunc("/health", healthCheck)
+	http.HandleFunc("/ready", readyHandler)
 	http.HandleFunc("/status", statusHandler)
-	http.HandleFunc("/build", manualBuildHandler)
+	http.HandleFunc("/status.txt", statusTextHandler)
+	http.HandleFunc("/history", historyHandler)
+	http.HandleFunc("/devices", devicesHandler)
+	http.HandleFunc("/rollout", rolloutHandler)
+	http.HandleFunc("/rollout/", rolloutHandler)
+	http.HandleFunc("/logs", logsHandler)
+	http.HandleFunc("/events", eventsHandler)
+	http.HandleFunc("/metrics", metricsHandler)
+	http.HandleFunc("/build", refuseOnMirror(manualBuildHandler))
+	http.HandleFunc("/build/cancel", refuseOnMirror(cancelBuildHandler))
+	http.HandleFunc("/check", refuseOnMirror(checkHandler))
+	http.HandleFunc("/changelog", changelogHandler)
+	http.HandleFunc("/rollback", refuseOnMirror(rollbackHandler))
+	http.HandleFunc("/promote", refuseOnMirror(promoteHandler))
+	http.HandleFunc("/maintenance", maintenanceHandler)
+	http.HandleFunc("/webhook", refuseOnMirror(webhookHandler))
+	http.HandleFunc("/firmware", firmwareQueryHandler)
+	http.HandleFunc("/firmware/", targetFirmwareHandler)
+	http.HandleFunc("/firmware/latest", latestFirmwareHandler)
+	http.HandleFunc("/firmware/info", firmwareInfoHandler)
+	http.HandleFunc("/firmware/versions/", versionedFirmwareHandler)
+	http.HandleFunc("/firmware/notes", firmwareNotesHandler)
+	http.HandleFunc("/chunks", chunksHandler)
+	http.HandleFunc("/delta", deltaHandler)
+	http.HandleFunc("/flags", flagsHandler)
+	http.HandleFunc("/pubkey", pubkeyHandler)
+	http.HandleFunc("/licenses", licensesHandler)
+	http.HandleFunc("/selftest", refuseOnMirror(selfTestHandler))
 	http.HandleFunc("/", rootHandler)
 
-	log.Printf("🚀 OTA Server starting on port %s", port)
-	log.Printf("📁 Project path: %s", projectPath)
-	log.Printf("📁 Firmware path: %s", firmwarePath)
-	log.Printf("🔄 Git monitor: checking %s branch every %v", gitBranch, checkInterval)
-	log.Println("✅ Server ready")
+	slog.Info("🚀 OTA Server starting", "event", "server_start", "port", config.Port,
+		"server_version", serverVersion, "server_commit", serverBuildCommit())
+	slog.Info("⚙️  Config", "config", config.String())
+	switch {
+	case mirrorMode():
+		slog.Info("🪞 Mirror sync running, git monitor not started")
+	case config.schedule != nil:
+		slog.Info("🔄 Git monitor started", "branch", config.GitBranch, "schedule", config.schedule)
+	default:
+		slog.Info("🔄 Git monitor started", "branch", config.GitBranch, "interval", config.CheckInterval)
+	}
+	slog.Info("✅ Server ready")
 
-	if err := http.ListenAndServe(":"+port, logRequest(http.DefaultServeMux)); err != nil {
-		log.Fatal(err)
+	// Plain HTTP stays on config.Port for devices already in the field;
+	// HTTPS is added alongside when configured
+	handler := logRequest(allowCORS(restrictAccess(http.DefaultServeMux)))
+	servers := []*http.Server{newHTTPServer(":"+config.Port, handler)}
+	tlsConfig, err := newTLSConfig()
+	if err != nil {
+		fatal("❌ Invalid TLS configuration", "error", err)
+	}
+	if tlsConfig != nil {
+		if config.TLSRedirect {
+			servers[0].Handler = logRequest(restrictAccess(http.HandlerFunc(redirectToHTTPS)))
+		}
+		https := newHTTPServer(":"+config.TLSPort, handler)
+		https.TLSConfig = tlsConfig
+		servers = append(servers, https)
+		slog.Info("🔐 HTTPS enabled", "port", config.TLSPort, "redirect_http", config.TLSRedirect)
+	}
+	if err := serveUntilSignal(servers...); err != nil {
+		fatal("❌ Server failed", "error", err)
 	}
 }
 
-func gitMonitor() {
-	// Initial build on startup
-	time.Sleep(5 * time.Second)
-	log.Println("🔨 Performing initial build...")
-	buildFirmware()
-
-	ticker := time.NewTicker(checkInterval)
-	defer ticker.Stop()
+func gitMonitor(generation int64, initialBuild bool) {
+	state.RLock()
+	repositoryMissing := state.RepositoryError != ""
+	state.RUnlock()
+	if initialBuild && !repositoryMissing {
+		// Initial build on startup
+		time.Sleep(5 * time.Second)
+		slog.Info("🔨 Performing initial build...")
+		enqueueBuild(BuildRequest{Reason: buildReasonStartup})
+	}
 
-	for range ticker.C {
+	// A superseded monitor must exit before it schedules, or it would move
+	// the next check of the one that replaced it
+	superseded := func() bool {
+		if monitorGeneration.Load() == generation {
+			return false
+		}
+		slog.Info("🛑 Superseded git monitor exiting", "generation", generation)
+		return true
+	}
+	for {
+		if superseded() {
+			return
+		}
+		time.Sleep(time.Until(scheduleNextCheck()))
+		if superseded() {
+			return
+		}
+		markMonitorActive()
 		checkAndBuild()
 	}
 }
 
-func checkAndBuild() {
+// scheduleNextCheck records and returns when the monitor checks next, see
+// nextCheck. Checks triggered by webhooks or manual builds don't move it.
+func scheduleNextCheck() time.Time {
+	now := time.Now()
 	state.Lock()
-	state.LastCheckTime = time.Now()
-	state.Unlock()
+	defer state.Unlock()
+	state.NextCheckTime = nextCheck(state.NextCheckTime, now)
+	return state.NextCheckTime
+}
 
-	log.Println("🔍 Checking for git updates...")
+// nextCheck returns when a monitor whose last scheduled check was at last
+// checks next: the next time config.CheckSchedule names, or one interval
+// after last so slow checks don't make the cadence drift.
+func nextCheck(last, now time.Time) time.Time {
+	switch next := last.Add(config.CheckInterval); {
+	case config.schedule != nil:
+		return config.schedule.next(now)
+	case last.IsZero() || !next.After(now):
+		return now.Add(config.CheckInterval)
+	default:
+		return next
+	}
+}
 
-	// Get current commit
-	currentCommit := getCurrentCommit()
+// gitCheck serializes checkAndBuild between the poller and webhooks, which
+// would otherwise race on the working tree, and the channel monitors' fetches.
+var gitCheck sync.Mutex
 
-	// Git pull
-	cmd := exec.Command("git", "-C", projectPath, "pull", "origin", gitBranch)
-	output, err := cmd.CombinedOutput()
+func checkAndBuild() {
+	gitCheck.Lock()
+	defer gitCheck.Unlock()
+	if buildsPaused() {
+		slog.Info("⏸️  Maintenance mode, skipping git check", "event", "git_check_paused")
+		return
+	}
+	// Without a checkout there is nothing to fetch; build once it's cloned
+	cloned, err := ensureRepository()
 	if err != nil {
-		log.Printf("❌ Git pull failed: %v\n%s", err, output)
+		slog.Error("❌ Project repository not initialized", "event", "repo_missing", "path", config.ProjectPath, "error", err)
+		return
+	}
+	if cloned {
+		scheduleBuild()
 		return
 	}
+	slog.Debug("🔍 Checking for git updates...", "event", "git_check")
+
+	// Fetching is cheap and leaves the tree alone; only move the checkout
+	// when origin is ahead. A hard reset rather than a merge means local
+	// edits in the build tree can't make the update fail.
+	check, err := fetchUpdates()
+	switch {
+	case err != nil || !check.Pending:
+	default:
+		ctx, cancel := context.WithTimeout(context.Background(), gitTimeout)
+		var output []byte
+		output, err = exec.CommandContext(ctx, "git", "-C", config.ProjectPath, "reset", "--hard", "--quiet", check.Remote).CombinedOutput()
+		cancel()
+		if err != nil {
+			err = fmt.Errorf("git reset: %v: %s", err, strings.TrimSpace(string(output)))
+		} else {
+			lastCheck = UpdateCheck{}
+			slog.Debug("📡 Reset checkout to origin", "branch", config.GitBranch, "commit", check.Remote)
+		}
+	}
+
+	state.Lock()
+	state.LastCheckTime = time.Now()
+	observeGitCheck(err != nil)
+	state.Unlock()
 
-	log.Printf("📡 Git pull: %s", strings.TrimSpace(string(output)))
+	if err != nil {
+		slog.Error("❌ Git update failed", "event", "git_pull_failed", "error", err)
+		return
+	}
+	updateStaleness()
 
 	// Check if there are changes
 	newCommit := getCurrentCommit()
 
-	if currentCommit != newCommit {
-		log.Printf("🆕 New commit detected: %s -> %s", currentCommit[:8], newCommit[:8])
-		buildFirmware()
+	if check.Local != newCommit {
+		slog.Info("🆕 New commit detected", "event", "new_commit", "from", check.Local[:min(8, len(check.Local))], "commit", newCommit[:min(8, len(newCommit))])
+		scheduleBuild()
 	} else {
-		log.Println("✅ No changes detected")
+		slog.Info("✅ No changes detected", "event", "git_check", "commit", newCommit[:min(8, len(newCommit))])
 	}
 }
 
 func getCurrentCommit() string {
-	cmd := exec.Command("git", "-C", projectPath, "rev-parse", "HEAD")
-	output, err := cmd.Output()
+	ctx, cancel := context.WithTimeout(context.Background(), gitTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, "git", "-C", config.ProjectPath, "rev-parse", "HEAD").Output()
 	if err != nil {
 		return "unknown"
 	}
 	return strings.TrimSpace(string(output))
 }
 
-func buildFirmware() {
+// buildFirmware builds and publishes the checked-out tree. It is only
+// called by the build worker, which runs one queued build at a time, and
+// by -build-once. The result is recorded in ServerState and also returned;
+// a failed extra target fails the build here even though the primary image
+// was published.
+func buildFirmware(req BuildRequest) error {
+	// A rollback holds the build slot while it swaps images; wait it out
 	state.Lock()
-	if state.BuildInProgress {
+	for state.BuildInProgress {
+		buildDone.Wait()
+	}
+	if shuttingDown.Load() {
 		state.Unlock()
-		log.Println("⚠️  Build already in progress, skipping")
-		return
+		slog.Warn("⚠️  Shutting down, not starting a build")
+		return errors.New("shutting down")
 	}
+	ctx, cancel := context.WithCancel(context.Background())
 	state.BuildInProgress = true
 	state.BuildError = ""
+	state.RunningBuild, state.CancelBuild = req, cancel
 	state.Unlock()
 
 	defer func() {
+		cancel()
 		state.Lock()
 		state.BuildInProgress = false
+		state.RunningBuild, state.CancelBuild = BuildRequest{}, nil
+		buildDone.Broadcast()
 		state.Unlock()
+		saveState()
 	}()
 
-	log.Println("🔨 Starting firmware build...")
+	slog.Info("🔨 Starting firmware build...", "event", "build_started")
 	startTime := time.Now()
+	state.Events.publish(BuildEvent{Type: eventBuildStarted, Time: startTime})
 
-	// Get host project path from environment (fallback to container path)
-	hostProjectPath := os.Getenv("HOST_PROJECT_PATH")
-	if hostProjectPath == "" {
-		hostProjectPath = projectPath
-	}
+	// Run the target builds
+	dockerHost.Lock()
+	defer dockerHost.Unlock()
 
-	// Run build in Docker container
-	cmd := exec.Command("docker", "run", "--rm",
-		"-v", hostProjectPath+":/project",
-		"-v", "ota-server_firmware-data:/firmware",
-		"beacon-builder",
-		"/build.sh")
+	// Refuse to start on a nearly full disk rather than failing halfway
+	// through with a confusing error
+	setupErr := ensureDiskSpace()
 
-	output, err := cmd.CombinedOutput()
+	// Keep the output for /logs as well as for error reporting
+	var output bytes.Buffer
+	// A ref build checks out its commit in a worktree of its own, so the
+	// tracked branch's checkout keeps following origin meanwhile
+	commit, source := getCurrentCommit(), ""
+	if req.Ref != "" && setupErr == nil {
+		commit = req.Commit
+		gitCheck.Lock()
+		source, setupErr = checkoutWorktree(refWorktree, req.Commit)
+		gitCheck.Unlock()
+	}
+	version := readProjectVersion(source)
+	var signer string
+	if setupErr == nil {
+		signer, setupErr = verifySignature(ctx, req.Ref, commit)
+	}
+	buildLog := startBuildLog(commit)
+	lines := &eventLineWriter{}
+	buildOutput := io.MultiWriter(&output, buildLog, lines)
+	builtPath := filepath.Join(config.FirmwarePath, buildOutputDir, config.FirmwareFile)
+	var hooks []HookResult
+	runHook := func(stage, command, firmwarePath string, out io.Writer) error {
+		result, err := runBuildHook(ctx, stage, command, source, firmwarePath, commit, version, req.Reason, out)
+		if result != nil {
+			hooks = append(hooks, *result)
+		}
+		return err
+	}
+	if setupErr == nil {
+		setupErr = runHook(hookPreBuild, config.PreBuildHook, filepath.Join(config.FirmwarePath, config.FirmwareFile), buildOutput)
+	}
+	// The primary target builds alongside the others; its output is also
+	// kept on its own for error reports and the toolchain
+	primary := config.Targets[0]
+	primary.Source = source
+	timedOut, attempts, err := false, 0, setupErr
+	var primaryDuration time.Duration
+	var targetErrors map[string]error
+	if setupErr == nil {
+		targetErrors = buildTargets(ctx, source, commit, io.MultiWriter(buildLog, lines), func(shared io.Writer) {
+			primaryOut := io.MultiWriter(&output, shared)
+			timedOut, attempts, err = runTargetBuildWithRetry(ctx, primary, primaryOut)
+			primaryDuration = time.Since(startTime)
+			if err == nil {
+				// Before publishing, so a failing hook can hold the image back
+				err = runHook(hookPostBuild, config.PostBuildHook, builtPath, primaryOut)
+			}
+			if err == nil {
+				err = publishFirmware(builtPath, commit, version, parseToolchain(output.Bytes()))
+			}
+		})
+	}
+	extraErr := joinTargetErrors(targetErrors)
+	lines.flush()
+	buildLog.finish(errors.Join(err, extraErr))
 	buildDuration := time.Since(startTime)
+	state.Lock()
+	state.TargetBuildWall = buildDuration
+	state.Unlock()
+	record := BuildRecord{
+		Commit:          commit,
+		Ref:             req.Ref,
+		Trigger:         req.Reason,
+		StartTime:       startTime,
+		DurationSeconds: buildDuration.Seconds(),
+		Attempts:        attempts,
+		Hooks:           hooks,
+		LogFile:         buildLog.File,
+		Signer:          signer,
+	}
+	for name, targetErr := range targetErrors {
+		if record.TargetErrors == nil {
+			record.TargetErrors = make(map[string]string)
+		}
+		record.TargetErrors[name] = targetErr.Error()
+	}
 
+	if errors.Is(err, errBuildAborted) {
+		slog.Warn("🛑 Build aborted", "event", "build_aborted", "commit", record.Commit, "duration", buildDuration)
+		record.Error = fmt.Sprintf("Build aborted after %v", buildDuration.Round(time.Second))
+		record.Aborted = true
+		state.Lock()
+		state.BuildError = record.Error
+		appendBuildRecord(record)
+		observeBuild(record)
+		state.Unlock()
+		state.Events.publish(BuildEvent{Type: eventBuildFailed, Commit: record.Commit, Error: err.Error()})
+		return err
+	}
 	if err != nil {
-		errMsg := fmt.Sprintf("Build failed after %v: %v\n%s", buildDuration, err, output)
-		log.Printf("❌ %s", errMsg)
+		errMsg := fmt.Sprintf("Build failed after %v: %v\n%s", buildDuration, err, output.Bytes())
+		slog.Error("❌ Build failed", "event", "build_failed", "commit", record.Commit, "duration", buildDuration,
+			"timed_out", timedOut, "error", err, "output", output.String())
+		record.Error = errMsg
+		record.TimedOut = timedOut
 		state.Lock()
 		state.BuildError = errMsg
+		appendBuildRecord(record)
+		observeBuild(record)
+		recordTargetBuild(config.Targets[0].Name, record.Commit, primaryDuration, err)
 		state.Unlock()
-		return
+		state.Events.publish(BuildEvent{Type: eventBuildFailed, Commit: record.Commit, Error: err.Error()})
+		notifyBuildResult(record, err, output.Bytes())
+		return err
 	}
 
 	// Update state
 	state.Lock()
+	state.Pin = PublishPin{}
 	state.LastBuildTime = time.Now()
-	state.LastGitCommit = getCurrentCommit()
+	state.MinVersion = readProjectMinVersion(source)
+	recordToolchain(parseToolchain(output.Bytes()))
 
 	// Get firmware size
-	firmwareFullPath := filepath.Join(firmwarePath, firmwareFile)
-	if fileInfo, err := os.Stat(firmwareFullPath); err == nil {
-		state.FirmwareSize = fileInfo.Size()
+	firmwareFullPath := filepath.Join(config.FirmwarePath, config.FirmwareFile)
+	if info, err := firmwareStore.Stat(config.FirmwareFile); err == nil {
+		state.FirmwareSize = info.Size
+	}
+	rollNotesForward(getFirmwareVersion(firmwareFullPath))
+
+	record.Success = true
+	record.FirmwareSize = state.FirmwareSize
+	record.IDFVersion = state.Toolchain.IDFVersion
+	record.CompilerVersion = state.Toolchain.CompilerVersion
+	appendBuildRecord(record)
+	observeBuild(record)
+	advanceRollout(record.Commit)
+	recordTargetBuild(config.Targets[0].Name, record.Commit, primaryDuration, nil)
+	state.Unlock()
+
+	finishPublish(builtPath, record.Commit)
+
+	updateStaleness()
+	state.Events.publish(BuildEvent{Type: eventBuildCompleted, Commit: record.Commit})
+	notifyBuildResult(record, nil, nil)
+	slog.Info("✅ Build completed", "event", "build_completed", "commit", record.Commit, "duration", buildDuration,
+		"version", getFirmwareVersion(firmwareFullPath), "bytes", record.FirmwareSize, "idf", record.IDFVersion, "compiler", record.CompilerVersion)
+	return extraErr
+}
+
+// finishPublish archives, signs and diffs a newly published image and
+// precomputes what devices fetch, so the first device doesn't wait. Builds
+// and uploads both end with it.
+func finishPublish(builtPath, commit string) {
+	// Keep a copy of this build for rollback and pinned downloads. Uploads
+	// have no commit to key the archive and deltas by.
+	signed := []string{config.FirmwareFile}
+	if commit != "" {
+		if err := archiveFirmware(builtPath, commit); err != nil {
+			slog.Warn("⚠️  Could not archive firmware", "commit", commit, "error", err)
+		} else {
+			assignSlot(commit)
+		}
+		signed = append(signed, archiveName(commit))
+	}
+	for _, name := range signed {
+		if err := signFirmware(name); err != nil {
+			slog.Warn("⚠️  Could not sign firmware", "name", name, "error", err)
+		}
+	}
+
+	if commit != "" {
+		generateDeltas(commit)
+	}
+
+	// Precompute checksums so the first device doesn't pay for them
+	if _, err := currentFirmwareDigest(); err != nil {
+		slog.Warn("⚠️  Could not hash firmware", "error", err)
+	}
+	if gz, err := currentFirmwareGzip(); err != nil {
+		slog.Warn("⚠️  Could not compress firmware", "error", err)
+	} else if gz != nil {
+		slog.Info("🗜️  Compressed firmware", "bytes", len(gz))
+	}
+	if m, err := chunkManifest(config.FirmwareFile); err == nil {
+		slog.Info("🧩 Chunk manifest", "chunks", len(m.Chunks), "chunk_size", m.ChunkSize)
+	} else {
+		slog.Warn("⚠️  Could not compute chunk manifest", "error", err)
+	}
+}
+
+// publishFirmware moves a freshly built or uploaded image into the
+// firmware store and records it as commit with the given project version.
+//
+// Invariant: the published config.FirmwareFile is always a complete, valid
+// image. Builds never write it directly; the image is validated here and
+// the store swaps it in atomically (temp file + rename for localStore).
+// serveFirmware relies on this: it opens the image once and serves from
+// that handle, so a download that overlaps a publish keeps reading the
+// old image and never sees a mix of the two. The commit and project
+// version are recorded, and the metadata sidecar written, under
+// firmwareSwap together with the swap.
+//
+// The published file is read back and checked against the checksum of the
+// bytes handed to the store. If they differ, e.g. after a short write on a
+// full disk, the previous build is put back from its archive.
+func publishFirmware(builtPath, commit, version string, toolchain Toolchain) error {
+	file, err := os.Open(builtPath)
+	if err != nil {
+		return fmt.Errorf("build output missing: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if err := validateFirmwareImage(file, info.Size()); err != nil {
+		return fmt.Errorf("refusing to publish invalid image: %w", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	details := commitInfo(commit)
+	firmwareSwap.Lock()
+	defer firmwareSwap.Unlock()
+	built := sha256.New()
+	if err := firmwareStore.Put(config.FirmwareFile, io.TeeReader(file, built)); err != nil {
+		return fmt.Errorf("publish firmware: %w", err)
 	}
+	sum := hex.EncodeToString(built.Sum(nil))
+	if err := verifyPublished(config.FirmwareFile, sum); err != nil {
+		restorePreviousFirmware()
+		return err
+	}
+	if _, warning := firmwareSizeUsage(info.Size()); warning != "" {
+		slog.Warn("⚠️  Firmware is close to the app partition size", "event", "firmware_size_warning", "warning", warning)
+	}
+	writeFirmwareMetadata(FirmwareMetadata{
+		Version:         version,
+		Commit:          commit,
+		BuiltAt:         time.Now(),
+		Size:            info.Size(),
+		SHA256:          sum,
+		IDFVersion:      toolchain.IDFVersion,
+		CompilerVersion: toolchain.CompilerVersion,
+	})
+	state.Lock()
+	state.LastGitCommit, state.LastCommitInfo, state.FirmwareVersion = commit, details, version
+	state.Upload = nil
 	state.Unlock()
+	return nil
+}
+
+// restorePreviousFirmware republishes the archive of the last good build
+// after a corrupt publish. Callers must hold firmwareSwap.
+func restorePreviousFirmware() {
+	state.RLock()
+	previous := state.LastGitCommit
+	state.RUnlock()
+	if previous == "" {
+		return
+	}
+	archived, err := firmwareStore.Open(archiveName(previous))
+	if err == nil {
+		err = firmwareStore.Put(config.FirmwareFile, archived.Content)
+		archived.Close()
+	}
+	if err != nil {
+		slog.Error("❌ Could not restore previous firmware", "commit", previous[:min(8, len(previous))], "error", err)
+		return
+	}
+	slog.Warn("⏪ Restored previous firmware after corrupt publish", "commit", previous[:min(8, len(previous))])
+}
 
-	log.Printf("✅ Build completed in %v", buildDuration)
-	log.Printf("📦 Firmware size: %.2f KB", float64(state.FirmwareSize)/1024)
+// Get host project path from environment (fallback to container path)
+func hostProjectPath() string {
+	if path := os.Getenv("HOST_PROJECT_PATH"); path != "" {
+		return path
+	}
+	return config.ProjectPath
 }
 
 // Extract firmware version from ESP32 binary (app descriptor at offset 0x20)
@@ -179,10 +728,14 @@ func getFirmwareVersion(filePath string) string {
 	}
 	defer file.Close()
 
+	return readFirmwareVersion(file)
+}
+
+func readFirmwareVersion(file io.ReaderAt) string {
 	// ESP32 app descriptor is at offset 0x20
 	// Version string is at offset 0x10 within the descriptor (32 bytes max)
 	buf := make([]byte, 32)
-	_, err = file.ReadAt(buf, 0x30) // 0x20 + 0x10
+	_, err := file.ReadAt(buf, 0x30) // 0x20 + 0x10
 	if err != nil {
 		return ""
 	}
@@ -196,102 +749,318 @@ func getFirmwareVersion(filePath string) string {
 	return string(buf)
 }
 
+// requestedFirmware picks the image r gets: the current build unless an
+// archived one is pinned by ?commit=, or the device is held on the stable
+// build during a canary rollout. The commit is empty for the current build.
+// An unknown pin is answered with 404.
+func requestedFirmware(w http.ResponseWriter, r *http.Request) (name, commit string, ok bool) {
+	if query := r.URL.Query(); query.Has("commit") {
+		pinned, ok := requireCommitParam(w, "commit", query.Get("commit"))
+		if !ok {
+			return "", "", false
+		}
+		archived, err := findRetainedVersion(pinned)
+		if err != nil {
+			http.Error(w, err.Error(), retainedLookupStatus(err))
+			return "", "", false
+		}
+		return archived.Name, archived.Commit, true
+	}
+	if stable, ok := stableBuildFor(r); ok {
+		return stable.Name, stable.Commit, true
+	}
+	return config.FirmwareFile, "", true
+}
+
+// admitDownload runs the checks every firmware download goes through,
+// full image or delta, before anything is opened: method, the device's
+// update window, rate limit and the build serve policy. It answers the
+// request itself when the download mustn't go ahead.
+func admitDownload(w http.ResponseWriter, r *http.Request) bool {
+	return allowGetOrHead(w, r) && allowUpdateWindow(w, r) && allowDownload(w, r) && applyServePolicy(w, r)
+}
+
 func serveFirmware(w http.ResponseWriter, r *http.Request) {
-	fullPath := filepath.Join(firmwarePath, firmwareFile)
+	if admitDownload(w, r) {
+		sendFirmware(w, r)
+	}
+}
 
-	fileInfo, err := os.Stat(fullPath)
-	if os.IsNotExist(err) {
-		log.Printf("❌ Firmware file not found: %s", fullPath)
+// sendFirmware serves the requested image to a download admitDownload has
+// let through.
+func sendFirmware(w http.ResponseWriter, r *http.Request) {
+	name, commit, ok := requestedFirmware(w, r)
+	if !ok {
+		return
+	}
+	fullPath := filepath.Join(config.FirmwarePath, name)
+
+	// Open the firmware once and serve everything from this object. The
+	// store replaces images by rename, so an open object keeps pointing at
+	// the image this download started with even if a new one is published.
+	// The current image's commit is read in the same firmwareSwap section
+	// so the two always match.
+	var projectVersion string
+	firmwareSwap.RLock()
+	file, err := firmwareStore.Open(name)
+	if commit == "" {
+		state.RLock()
+		commit, projectVersion = state.LastGitCommit, state.FirmwareVersion
+		state.RUnlock()
+	}
+	firmwareSwap.RUnlock()
+	if errors.Is(err, fs.ErrNotExist) {
+		slog.Error("❌ Firmware file not found", "path", fullPath)
 		http.Error(w, "Firmware not found", http.StatusNotFound)
 		return
 	}
+	if err != nil {
+		slog.Error("❌ Failed to open firmware", "name", name, "error", err)
+		http.Error(w, "Failed to read firmware", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
 
 	// Extract and send firmware version header
-	version := getFirmwareVersion(fullPath)
+	version := readFirmwareVersion(file.Content)
 	if version != "" {
 		w.Header().Set("X-Firmware-Version", version)
-		log.Printf("📋 Firmware version: %s", version)
+		slog.Debug("📋 Firmware version", "version", version)
 	} else {
-		log.Printf("⚠️  Could not extract firmware version")
+		slog.Warn("⚠️  Could not extract firmware version", "name", name)
+	}
+
+	// Checksums let devices verify the image before flashing. They are
+	// computed over, and always describe, the uncompressed image.
+	digest, err := firmwareDigest(file.FirmwareInfo, file.Content)
+	if err != nil {
+		slog.Error("❌ Failed to hash firmware", "name", name, "error", err)
+		http.Error(w, "Failed to read firmware", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("x-MD5", digest.MD5)
+	w.Header().Set("X-Firmware-SHA256", digest.SHA256)
+	w.Header().Set("X-Firmware-Size", fmt.Sprintf("%d", file.Size))
+	if commit != "" {
+		w.Header().Set("X-Firmware-Commit", commit)
+	}
+
+	// Compress the current firmware on the wire for clients that accept
+	// it. Ranged requests get raw bytes so offsets keep referring to the
+	// image itself.
+	var body io.ReadSeeker = file.Content
+	var gzipped []byte
+	size := file.Size
+	encoding := "identity"
+	etag := digest.ETag()
+	if !allowResume(w, r, etag) {
+		return
+	}
+	w.Header().Add("Vary", "Accept-Encoding")
+	if name == config.FirmwareFile && r.Header.Get("Range") == "" && acceptsGzip(r) {
+		if gz, err := gzippedFirmware(file.FirmwareInfo, file.Content, digest); err != nil {
+			slog.Warn("⚠️  Could not compress firmware, sending it raw", "error", err)
+		} else if gz != nil {
+			gzipped, size = gz, int64(len(gz))
+			etag = strings.TrimSuffix(etag, `"`) + `-gzip"`
+			w.Header().Set("Content-Encoding", "gzip")
+			encoding = "gzip"
+		}
+	}
+
+	// Validators let pollers skip unchanged images: ServeContent answers
+	// matching If-None-Match / If-Modified-Since with 304.
+	w.Header().Set("ETag", etag)
+	unchanged := notModified(r, etag, file.ModTime)
+
+	// Enforce per-version license seats on actual downloads
+	if r.Method != http.MethodHead && !unchanged && !claimLicenseSeat(w, r, version) {
+		return
 	}
 
 	// Check for force update flag (from environment variable)
-	if os.Getenv("FORCE_OTA_UPDATE") == "true" {
+	if forceUpdateFor(r) {
 		w.Header().Set("X-Force-Update", "true")
-		log.Printf("🔥 Force update enabled")
+		slog.Debug("🔥 Force update enabled")
 	}
 
 	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", firmwareFile))
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", fileInfo.Size()))
-
-	// For HEAD requests, just write headers (don't use ServeFile as it might override headers)
-	if r.Method == "HEAD" {
-		log.Printf("📤 HEAD request: %s (%.2f KB) to %s", firmwareFile, float64(fileInfo.Size())/1024, r.RemoteAddr)
-		w.WriteHeader(http.StatusOK)
-		log.Printf("✅ Headers sent")
+	// Name the saved file after the build; the current image falls back to
+	// the project's version when none is embedded
+	fileVersion := version
+	if fileVersion == "" {
+		fileVersion = projectVersion
+	}
+	w.Header().Set("Content-Disposition", contentDisposition(downloadFilename(config.FirmwareFile, fileVersion, commit)))
+
+	// ServeContent sets Content-Length (of the body as sent) and
+	// Last-Modified itself and handles HEAD, Range and If-Range, answering
+	// 206 with Content-Range for resumed downloads. It leaves Content-Length
+	// out of gzip bodies, so serveGzip sends those.
+	logger := slog.With("name", name, "version", version, "remote_addr", r.RemoteAddr)
+	if unchanged {
+		logger.Info("📭 Firmware unchanged", "event", "download_not_modified", "etag", etag)
+	} else if r.Method == http.MethodHead {
+		logger.Info("📤 HEAD request", "bytes", size)
+	} else {
+		logger.Info("📤 Serving firmware", "event", "download_started", "bytes", size, "encoding", encoding, "range", r.Header.Get("Range"))
+	}
+
+	cw := &countingWriter{ResponseWriter: w}
+	if gzipped != nil && !unchanged {
+		serveGzip(cw, r, file.ModTime, gzipped)
+	} else {
+		http.ServeContent(cw, r, name, file.ModTime, body)
+	}
+	if r.Method == http.MethodHead || unchanged {
+		logger.Debug("✅ Headers sent")
 		return
 	}
 
-	log.Printf("📤 Serving firmware: %s (%.2f KB) to %s", firmwareFile, float64(fileInfo.Size())/1024, r.RemoteAddr)
-	http.ServeFile(w, r, fullPath)
-	log.Printf("✅ Firmware delivered")
+	outcome := classifyDownload(r, cw)
+	recordDownload(outcome)
+	recordDeviceDownload(r, name, version, cw.bytes, outcome)
+	if outcome == downloadComplete {
+		recordRolloutDownload(r, commit)
+	}
+	logDownload(logger, outcome, cw)
 }
 
 func versionCheckHandler(w http.ResponseWriter, r *http.Request) {
-	fullPath := filepath.Join(firmwarePath, firmwareFile)
+	waitForUpdate(w, r)
+
+	// Devices held back by a canary rollout are told the stable version
+	stable, onStable := stableBuildFor(r)
+	fullPath := filepath.Join(config.FirmwarePath, config.FirmwareFile)
+	if onStable {
+		fullPath = filepath.Join(config.FirmwarePath, stable.Name)
+	}
 
 	fileInfo, err := os.Stat(fullPath)
 	if os.IsNotExist(err) {
-		log.Printf("❌ Firmware file not found: %s", fullPath)
+		slog.Error("❌ Firmware file not found", "path", fullPath)
 		http.Error(w, "Firmware not found", http.StatusNotFound)
 		return
 	}
+	if err != nil {
+		slog.Error("❌ Failed to stat firmware", "path", fullPath, "error", err)
+		http.Error(w, "Failed to read firmware", http.StatusInternalServerError)
+		return
+	}
 
 	// Extract and send firmware version header
 	version := getFirmwareVersion(fullPath)
 	if version != "" {
 		w.Header().Set("X-Firmware-Version", version)
-		log.Printf("📋 Version check: %s", version)
+		slog.Debug("📋 Version check", "version", version)
 	} else {
-		log.Printf("⚠️  Could not extract firmware version")
+		slog.Warn("⚠️  Could not extract firmware version", "path", fullPath)
 	}
 
 	// Check for force update flag (from environment variable)
-	if os.Getenv("FORCE_OTA_UPDATE") == "true" {
+	if forceUpdateFor(r) {
 		w.Header().Set("X-Force-Update", "true")
-		log.Printf("🔥 Force update enabled")
+		slog.Debug("🔥 Force update enabled")
+	}
+
+	// Tell devices outside their window that the update has to wait
+	if allowed, window, wait := updateWindowFor(r, time.Now()); !allowed {
+		w.Header().Set("X-Update-Deferred", "true")
+		w.Header().Set("X-Update-Window", window.String())
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int(wait.Seconds())))
+	}
+
+	if wantsJSONVersion(r) {
+		state.RLock()
+		info := VersionInfo{
+			Version:   state.FirmwareVersion,
+			BuildTime: state.LastBuildTime,
+			Commit:    state.LastGitCommit,
+			Size:      fileInfo.Size(),
+			Current:   r.URL.Query().Get("current"),
+		}
+		state.RUnlock()
+		if onStable {
+			info.Version, info.Commit, info.BuildTime = version, stable.Commit, stable.BuiltAt
+		}
+		if info.Version == "" {
+			info.Version = version
+		}
+		if info.Current != "" {
+			info.UpdateAvailable = isUpdateFor(info.Version, info.Commit, info.Current)
+		}
+		slog.Info("📤 Version check", "event", "version_check", "remote_addr", r.RemoteAddr, "version", info.Version,
+			"current", info.Current, "update_available", info.UpdateAvailable)
+		writeJSON(w, info)
+		return
 	}
 
 	w.Header().Set("Content-Type", "text/plain")
 	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(version)))
 
-	log.Printf("📤 Version check from %s", r.RemoteAddr)
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprint(w, version)
-	log.Printf("✅ Version sent: %s (%.0f bytes)", version, float64(fileInfo.Size()))
+	slog.Info("📤 Version check", "event", "version_check", "remote_addr", r.RemoteAddr, "version", version, "bytes", fileInfo.Size())
 }
 
+// versionProbeHandler answers with a single "<version> <md5>" line for
+// devices that can't afford a full version check. Unknown fields are "-".
+func versionProbeHandler(w http.ResponseWriter, r *http.Request) {
+	version, checksum := "-", "-"
+
+	name := config.FirmwareFile
+	if stable, ok := stableBuildFor(r); ok {
+		name = stable.Name
+	}
+	if obj, err := firmwareStore.Open(name); err == nil {
+		if v := readFirmwareVersion(obj.Content); v != "" {
+			version = v
+		}
+		if digest, err := firmwareDigest(obj.FirmwareInfo, obj.Content); err == nil {
+			checksum = digest.MD5
+		} else {
+			slog.Warn("⚠️  Could not hash firmware", "name", name, "error", err)
+		}
+		obj.Close()
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Cache-Control", "public, max-age=30")
+	w.Header().Set("Vary", "X-Device-ID")
+	fmt.Fprintf(w, "%s %s\n", version, checksum)
+}
+
+// healthCheck is the liveness probe. With HEALTH_CHECK_BACKEND it also
+// reports a build backend that is down, but still answers 200: restarting
+// the server won't bring Docker back, and it can still serve firmware.
 func healthCheck(w http.ResponseWriter, r *http.Request) {
+	if config.HealthCheckBackend {
+		if health := buildBackendHealth(); !health.OK {
+			w.Header().Set("X-Build-Backend", "degraded")
+			fmt.Fprintf(w, "OK (degraded: %s)", health.Error)
+			return
+		}
+	}
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprintf(w, "OK")
 }
 
 func statusHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowGetOrHead(w, r) {
+		return
+	}
+	w.Header().Add("Vary", "Accept")
+	if acceptsPlainText(r) {
+		statusTextHandler(w, r)
+		return
+	}
+	backend := buildBackendHealth()
 	state.RLock()
-	defer state.RUnlock()
+	status := newStatusResponse()
+	state.RUnlock()
+	status.BuildBackend = &backend
 
-	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, `{
-  "lastCommit": "%s",
-  "lastBuild": "%s",
-  "lastCheck": "%s",
-  "buildInProgress": %v,
-  "firmwareSize": %d,
-  "buildError": "%s"
-}`, state.LastGitCommit, state.LastBuildTime.Format(time.RFC3339),
-		state.LastCheckTime.Format(time.RFC3339), state.BuildInProgress,
-		state.FirmwareSize, state.BuildError)
+	writeJSON(w, status)
 }
 
 func manualBuildHandler(w http.ResponseWriter, r *http.Request) {
@@ -299,17 +1068,94 @@ func manualBuildHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	if !parseSmallForm(w, r) {
+		return
+	}
+	if buildsPaused() {
+		http.Error(w, "Builds are paused for maintenance", http.StatusConflict)
+		return
+	}
+
+	// Optionally build a branch, tag or commit instead of the tracked branch
+	req := BuildRequest{Reason: buildReasonManual, Ref: r.FormValue("ref")}
+	branchOnly := false
+	if branch := r.FormValue("branch"); branch != "" {
+		req.Ref, branchOnly = branch, true
+	}
+	if req.Ref != "" {
+		// A ref build replaces the image every device downloads, so make
+		// the caller say so rather than publishing a test branch by accident
+		if publish, _ := strconv.ParseBool(r.FormValue("publish")); !publish {
+			http.Error(w, "Building a ref publishes it to every device; add publish=true to confirm", http.StatusBadRequest)
+			return
+		}
+		gitCheck.Lock()
+		commit, err := resolveBuildRef(req.Ref, branchOnly)
+		gitCheck.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req.Commit = commit
+	}
 
-	go buildFirmware()
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		queueIdempotentBuild(w, r, key, req)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprint(w, queueManualBuild(req, r.RemoteAddr))
+}
 
-	fmt.Fprintf(w, "Build triggered\n")
+// queueManualBuild queues a manual build and describes its place in the
+// queue.
+func queueManualBuild(req BuildRequest, remoteAddr string) string {
+	slog.Info("🔨 Manual build requested", "event", "manual_build", "ref", req.Ref, "commit", req.Commit, "remote_addr", remoteAddr)
+	position, coalesced := enqueueBuild(req)
+	switch {
+	case coalesced:
+		return fmt.Sprintf("Build already queued at position %d\n", position)
+	case req.Ref != "":
+		return fmt.Sprintf("Build of %s (%s) queued at position %d\n", req.Ref, req.Commit[:8], position)
+	default:
+		return fmt.Sprintf("Build queued at position %d\n", position)
+	}
 }
 
 func rootHandler(w http.ResponseWriter, r *http.Request) {
+	// May run git, so gather it before taking the state lock; both are
+	// cached, as the page refreshes itself every 30 seconds
+	changes, changesErr := pendingChangelog()
+	backend := cachedBackendHealth()
+	backendError := ""
+	if backend != nil {
+		backendError = backend.Error
+	}
+
 	state.RLock()
 	defer state.RUnlock()
 
-	fullPath := filepath.Join(firmwarePath, firmwareFile)
+	w.Header().Add("Vary", "Accept")
+	if acceptsJSON(r) {
+		summary := DashboardSummary{
+			StatusResponse: newStatusResponse(),
+			GitBranch:      config.GitBranch,
+			CheckInterval:  config.CheckInterval.String(),
+			CheckSchedule:  config.CheckSchedule,
+		}
+		summary.BuildBackend = backend
+		if state.Notes.Notes != "" {
+			notes := state.Notes
+			summary.Notes = &notes
+		}
+		writeJSON(w, summary)
+		return
+	}
+
+	fullPath := filepath.Join(config.FirmwarePath, config.FirmwareFile)
 	fileInfo, _ := os.Stat(fullPath)
 
 	buildStatus := "⏳ Never built"
@@ -323,81 +1169,82 @@ func rootHandler(w http.ResponseWriter, r *http.Request) {
 		buildStatus = fmt.Sprintf("❌ Build failed: %s", state.BuildError)
 	}
 
+	toolchainStatus := state.Toolchain.String()
+	if state.ToolchainWarning != "" {
+		toolchainStatus = fmt.Sprintf("⚠️ %s", state.ToolchainWarning)
+	}
+
 	firmwareStatus := "❌ Not found"
 	if fileInfo != nil {
-		firmwareStatus = fmt.Sprintf("✅ %.2f KB (modified %s)",
-			float64(fileInfo.Size())/1024,
+		sizePercent, sizeWarning := firmwareSizeUsage(fileInfo.Size())
+		mark := "✅"
+		if sizeWarning != "" {
+			mark = "⚠️"
+		}
+		firmwareStatus = fmt.Sprintf("%s %.2f KB, %.1f%% of the %d KB app partition (modified %s)",
+			mark, float64(fileInfo.Size())/1024, sizePercent, config.MaxFirmwareSize/1024,
 			fileInfo.ModTime().Format("2006-01-02 15:04:05"))
 	}
 
-	html := fmt.Sprintf(`<!DOCTYPE html>
-<html>
-<head>
-    <title>ESP32 OTA Server</title>
-    <style>
-        body { font-family: system-ui; max-width: 900px; margin: 50px auto; padding: 20px; }
-        .status { padding: 20px; border-radius: 8px; margin: 20px 0; background: #f5f5f5; border: 1px solid #ddd; }
-        h1 { color: #333; }
-        .info { margin: 10px 0; }
-        .label { font-weight: bold; min-width: 150px; display: inline-block; }
-        a { color: #007bff; text-decoration: none; }
-        a:hover { text-decoration: underline; }
-        button { background: #007bff; color: white; border: none; padding: 10px 20px; border-radius: 4px; cursor: pointer; }
-        button:hover { background: #0056b3; }
-    </style>
-    <script>
-        function triggerBuild() {
-            fetch('/build', {method: 'POST'})
-                .then(r => r.text())
-                .then(data => {
-                    alert('Build triggered! Refresh page in a minute to see results.');
-                });
-        }
-        setTimeout(() => location.reload(), 30000); // Auto-refresh every 30s
-    </script>
-</head>
-<body>
-    <h1>🚀 ESP32 Beacon OTA Server</h1>
-
-    <div class="status">
-        <h2>Status</h2>
-        <div class="info"><span class="label">Build Status:</span> %s</div>
-        <div class="info"><span class="label">Firmware:</span> %s</div>
-        <div class="info"><span class="label">Last Git Commit:</span> %s</div>
-        <div class="info"><span class="label">Last Check:</span> %s</div>
-        <div class="info"><span class="label">Next Check:</span> in ~%d minutes</div>
-    </div>
-
-    <div class="status">
-        <h2>Actions</h2>
-        <button onclick="triggerBuild()">🔨 Trigger Build Now</button>
-        <a href="/beacon_firmware.bin" style="margin-left: 20px;">📥 Download Firmware</a>
-        <a href="/status" style="margin-left: 20px;">📊 JSON Status</a>
-    </div>
-
-    <div class="status">
-        <h2>Configuration</h2>
-        <div class="info"><span class="label">Git Branch:</span> %s</div>
-        <div class="info"><span class="label">Check Interval:</span> %v</div>
-        <div class="info"><span class="label">Beacon Check:</span> Every 5 minutes</div>
-    </div>
-
-    <p><small>Page auto-refreshes every 30 seconds</small></p>
-</body>
-</html>`, buildStatus, firmwareStatus, state.LastGitCommit[:min(8, len(state.LastGitCommit))],
-		state.LastCheckTime.Format("2006-01-02 15:04:05"),
-		int(time.Until(state.LastCheckTime.Add(checkInterval)).Minutes()),
-		gitBranch, checkInterval)
+	data := DashboardData{
+		BuildStatus:      buildStatus,
+		FirmwareStatus:   firmwareStatus,
+		ShortCommit:      state.LastGitCommit[:min(8, len(state.LastGitCommit))],
+		Commit:           state.LastCommitInfo,
+		CommitsBehind:    state.CommitsBehind,
+		Stale:            firmwareStale(),
+		Maintenance:      state.Maintenance,
+		RepositoryError:  state.RepositoryError,
+		BackendError:     backendError,
+		ToolchainStatus:  toolchainStatus,
+		LastCheck:        state.LastCheckTime,
+		NextCheckMinutes: max(0, int(time.Until(state.NextCheckTime).Minutes())),
+		NextCheckIn:      nextCheckIn(time.Now()),
+		GitBranch:        config.GitBranch,
+		CheckInterval:    config.CheckInterval,
+		CheckSchedule:    config.CheckSchedule,
+		Devices:          latestDeviceDownloads(),
+		LowRollouts:      lowRollouts(),
+		Server:           serverInfo(time.Now()),
+	}
+	if state.Notes.Notes != "" {
+		notes := state.Notes
+		data.Notes = &notes
+	}
+	if changesErr == nil {
+		data.Changelog = &changes
+	}
+
+	var page bytes.Buffer
+	if err := config.dashboard.Execute(&page, data); err != nil {
+		slog.Error("❌ Failed to render dashboard", "error", err)
+		http.Error(w, "Failed to render dashboard", http.StatusInternalServerError)
+		return
+	}
 
 	w.Header().Set("Content-Type", "text/html")
-	fmt.Fprint(w, html)
+	page.WriteTo(w)
 }
 
 func logRequest(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
-		handler.ServeHTTP(w, r)
-		log.Printf("📍 %s %s from %s (took %v)", r.Method, r.URL.Path, r.RemoteAddr, time.Since(start))
+		cw := &countingWriter{ResponseWriter: w}
+		handler.ServeHTTP(cw, r)
+		if cw.status == 0 {
+			cw.status = http.StatusOK
+		}
+
+		// Missing firmware and auth failures stand out as warnings
+		level, mark := slog.LevelInfo, "📍"
+		switch {
+		case cw.status >= 500:
+			level, mark = slog.LevelError, "❌"
+		case cw.status >= 400:
+			level, mark = slog.LevelWarn, "⚠️ "
+		}
+		slog.Log(r.Context(), level, mark+" Request", "event", "request", "method", r.Method, "path", r.URL.Path,
+			"status", cw.status, "bytes", cw.bytes, "latency", time.Since(start), "remote_addr", r.RemoteAddr)
 	})
 }
 
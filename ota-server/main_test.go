@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+const (
+	testCommitA = "aaaaaaa1111111111111111111111111111111aa"
+	testCommitB = "bbbbbbb2222222222222222222222222222222bb"
+)
+
+// testImage builds a valid single-segment ESP32 app image of about size
+// bytes carrying version, with the rest of the segment filled with fill so
+// images are easy to tell apart byte by byte.
+func testImage(version string, fill byte, size int) []byte {
+	length := (size - espImageHeaderLen - espSegmentHeaderLen - 16) &^ 3
+	segment := bytes.Repeat([]byte{fill}, length)
+	binary.LittleEndian.PutUint32(segment, espAppDescMagic)
+	copy(segment[0x10:0x30], make([]byte, 32))
+	copy(segment[0x10:], version)
+
+	image := make([]byte, espImageHeaderLen, size)
+	image[0], image[1] = espImageMagic, 1
+	image = binary.LittleEndian.AppendUint32(image, 0x3f400020) // load address
+	image = binary.LittleEndian.AppendUint32(image, uint32(length))
+	image = append(image, segment...)
+
+	checksum := byte(espChecksumSeed)
+	for _, b := range segment {
+		checksum ^= b
+	}
+	image = append(image, make([]byte, 15-len(image)%16)...)
+	return append(image, checksum)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// useTestFirmware points config and the store at a fresh firmware
+// directory with image published as testCommitA, resets the state the
+// download path reads, and puts everything back when the test ends.
+func useTestFirmware(t *testing.T, image []byte) string {
+	t.Helper()
+	dir := t.TempDir()
+	savedConfig, savedStore := config, firmwareStore
+	t.Cleanup(func() { config, firmwareStore = savedConfig, savedStore })
+	config = defaultConfig()
+	config.FirmwarePath, config.ProjectPath = dir, dir
+	firmwareStore = &localStore{dir: dir}
+
+	state.Lock()
+	state.LastGitCommit, state.FirmwareVersion = testCommitA, ""
+	state.FirmwareChecksum, state.FirmwareGzip = FirmwareDigest{}, FirmwareGzip{}
+	state.RetainedVersions, state.StableCommit, state.CanaryCommit = nil, "", ""
+	state.BuildInProgress, state.Upload, state.Pin = false, nil, PublishPin{}
+	state.History = nil
+	state.Unlock()
+
+	if err := os.WriteFile(filepath.Join(dir, config.FirmwareFile), image, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// publishTestImage publishes image as commit the way a finished build does.
+func publishTestImage(t *testing.T, image []byte, commit string) {
+	t.Helper()
+	built := filepath.Join(t.TempDir(), "built.bin")
+	if err := os.WriteFile(built, image, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := publishFirmware(built, commit, "", Toolchain{}); err != nil {
+		t.Fatalf("publishFirmware: %v", err)
+	}
+}
+
+// swapDuringWrite is a ResponseWriter that publishes a new image during
+// the first body write, as if a build finished while a slow device was
+// mid-download.
+type swapDuringWrite struct {
+	*httptest.ResponseRecorder
+	swap    func()
+	swapped bool
+}
+
+func (w *swapDuringWrite) Write(p []byte) (int, error) {
+	if !w.swapped {
+		w.swapped = true
+		n, err := w.ResponseRecorder.Write(p)
+		w.swap()
+		return n, err
+	}
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestServeFirmwareReplacedMidDownload(t *testing.T) {
+	// Several write chunks' worth, so the swap lands mid-body
+	imageA := testImage("1.0.0", 'A', 256<<10)
+	imageB := testImage("2.0.0", 'B', 200<<10)
+
+	tests := []struct {
+		name   string
+		header http.Header
+	}{
+		{name: "full download"},
+		{name: "resumed download", header: http.Header{"Range": {"bytes=1000-"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestFirmware(t, imageA)
+			w := &swapDuringWrite{
+				ResponseRecorder: httptest.NewRecorder(),
+				swap:             func() { publishTestImage(t, imageB, testCommitB) },
+			}
+			r := httptest.NewRequest(http.MethodGet, "/"+config.FirmwareFile, nil)
+			for key, values := range tt.header {
+				r.Header[key] = values
+			}
+			serveFirmware(w, r)
+
+			if !w.swapped {
+				t.Fatal("the response was never written, so nothing was swapped")
+			}
+			want := imageA
+			if tt.header.Get("Range") != "" {
+				want = imageA[1000:]
+			}
+			body := w.Body.Bytes()
+			if !bytes.Equal(body, want) {
+				t.Errorf("body is not the image the download started with (%d bytes, want %d; mixed builds: %v)",
+					len(body), len(want), bytes.IndexByte(body, 'B') >= 0)
+			}
+			if got := w.Header().Get("X-Firmware-SHA256"); got != sha256Hex(imageA) {
+				t.Errorf("X-Firmware-SHA256 = %s, want the started image's %s", got, sha256Hex(imageA))
+			}
+			if got := w.Header().Get("X-Firmware-Commit"); got != testCommitA {
+				t.Errorf("X-Firmware-Commit = %s, want %s", got, testCommitA)
+			}
+
+			// The next download gets the new build
+			next := httptest.NewRecorder()
+			serveFirmware(next, httptest.NewRequest(http.MethodGet, "/"+config.FirmwareFile, nil))
+			if !bytes.Equal(next.Body.Bytes(), imageB) || next.Header().Get("X-Firmware-Commit") != testCommitB {
+				t.Errorf("download after the swap got %d bytes of commit %s, want the new image",
+					next.Body.Len(), next.Header().Get("X-Firmware-Commit"))
+			}
+		})
+	}
+}
+
+func TestServeFirmwareConcurrentSwaps(t *testing.T) {
+	images := map[string][]byte{
+		testCommitA: testImage("1.0.0", 'A', 96<<10),
+		testCommitB: testImage("2.0.0", 'B', 64<<10),
+	}
+	useTestFirmware(t, images[testCommitA])
+	server := httptest.NewServer(http.HandlerFunc(serveFirmware))
+	defer server.Close()
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+	built := map[string]string{}
+	for commit, image := range images {
+		built[commit] = filepath.Join(t.TempDir(), "built.bin")
+		if err := os.WriteFile(built[commit], image, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	const downloaders, downloads, swaps = 8, 15, 40
+	errs := make(chan string, downloaders*downloads+swaps)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < swaps; i++ {
+			commit := testCommitA
+			if i%2 == 0 {
+				commit = testCommitB
+			}
+			if err := publishFirmware(built[commit], commit, "", Toolchain{}); err != nil {
+				errs <- err.Error()
+			}
+		}
+	}()
+
+	for d := 0; d < downloaders; d++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < downloads; i++ {
+				resp, err := client.Get(server.URL + "/" + config.FirmwareFile)
+				if err != nil {
+					errs <- err.Error()
+					return
+				}
+				body, err := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				commit := resp.Header.Get("X-Firmware-Commit")
+				switch {
+				case err != nil:
+					errs <- err.Error()
+				case !bytes.Equal(body, images[commit]):
+					errs <- fmt.Sprintf("torn read: %d bytes don't match the image of commit %.7s", len(body), commit)
+				case resp.Header.Get("X-Firmware-SHA256") != sha256Hex(body):
+					errs <- fmt.Sprintf("X-Firmware-SHA256 of commit %.7s doesn't match the body", commit)
+				case resp.ContentLength != int64(len(body)):
+					errs <- fmt.Sprintf("Content-Length %d for a %d byte body", resp.ContentLength, len(body))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestHeadRequests(t *testing.T) {
+	image := testImage("1.0.0", 'A', 48<<10)
+	useTestFirmware(t, image)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/"+config.FirmwareFile, serveFirmware)
+	mux.HandleFunc("/status", statusHandler)
+	mux.HandleFunc("/status.txt", statusTextHandler)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		wantStatus  int
+		wantLength  int64             // -1 to only require a Content-Length
+		wantHeaders map[string]string // "" only requires the header
+	}{
+		{
+			name: "HEAD firmware", method: http.MethodHead, path: "/" + config.FirmwareFile,
+			wantStatus: http.StatusOK, wantLength: int64(len(image)),
+			wantHeaders: map[string]string{
+				"X-Firmware-SHA256":  sha256Hex(image),
+				"X-Firmware-Size":    fmt.Sprint(len(image)),
+				"X-Firmware-Version": "1.0.0",
+				"X-Firmware-Commit":  testCommitA,
+				"Last-Modified":      "",
+				"ETag":               "",
+			},
+		},
+		{
+			name: "HEAD status", method: http.MethodHead, path: "/status",
+			wantStatus: http.StatusOK, wantLength: -1,
+			wantHeaders: map[string]string{"Content-Type": "application/json"},
+		},
+		{
+			name: "HEAD text status", method: http.MethodHead, path: "/status.txt",
+			wantStatus: http.StatusOK, wantLength: -1,
+			wantHeaders: map[string]string{"Content-Type": "text/plain; charset=utf-8"},
+		},
+		{
+			name: "POST firmware", method: http.MethodPost, path: "/" + config.FirmwareFile,
+			wantStatus: http.StatusMethodNotAllowed, wantLength: -1,
+			wantHeaders: map[string]string{"Allow": "GET, HEAD"},
+		},
+		{
+			name: "DELETE status", method: http.MethodDelete, path: "/status",
+			wantStatus: http.StatusMethodNotAllowed, wantLength: -1,
+			wantHeaders: map[string]string{"Allow": "GET, HEAD"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tt.method, server.URL+tt.path, nil)
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if tt.method == http.MethodHead && len(body) != 0 {
+				t.Errorf("HEAD returned a %d byte body", len(body))
+			}
+			switch length := resp.Header.Get("Content-Length"); {
+			case tt.wantLength >= 0 && length != fmt.Sprint(tt.wantLength):
+				t.Errorf("Content-Length = %q, want %d", length, tt.wantLength)
+			case length == "" || length == "0":
+				t.Errorf("Content-Length = %q, want the size of the GET body", length)
+			}
+			for key, want := range tt.wantHeaders {
+				got := resp.Header.Get(key)
+				if (want == "" && got == "") || (want != "" && got != want) {
+					t.Errorf("%s = %q, want %q", key, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestVersionCheckUnreadableFirmware(t *testing.T) {
+	dir := useTestFirmware(t, testImage("1.0.0", 'A', 4096))
+	// A firmware path under a regular file fails with ENOTDIR, not ENOENT
+	config.FirmwarePath = filepath.Join(dir, config.FirmwareFile)
+
+	w := httptest.NewRecorder()
+	versionCheckHandler(w, httptest.NewRequest(http.MethodGet, "/version", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status %d, want 500", w.Code)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FirmwareManifest is the /manifest.json document describing the image a
+// device should install.
+type FirmwareManifest struct {
+	Version         string `json:"version"`
+	URL             string `json:"url"`
+	Size            int64  `json:"size"`
+	SHA256          string `json:"sha256"`
+	MinVersion      string `json:"min_version,omitempty"`
+	IDFVersion      string `json:"idf_version,omitempty"`
+	CompilerVersion string `json:"compiler_version,omitempty"`
+	Notes           string `json:"notes,omitempty"`
+}
+
+// readProjectMinVersion returns the oldest firmware version allowed to
+// update to the checkout source, from its MIN_VERSION file. Devices
+// running something older must reflash another way.
+func readProjectMinVersion(source string) string {
+	data, err := os.ReadFile(filepath.Join(config.ProjectPath, source, "MIN_VERSION"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// manifestHandler describes the current image, or the stable one for
+// devices held back by a canary rollout, with an absolute download URL.
+func manifestHandler(w http.ResponseWriter, r *http.Request) {
+	name, query := config.FirmwareFile, ""
+	stable, onStable := stableBuildFor(r)
+	if onStable {
+		name, query = stable.Name, "?commit="+stable.Commit
+	}
+
+	obj, err := firmwareStore.Open(name)
+	if err != nil {
+		http.Error(w, "Firmware not found", http.StatusNotFound)
+		return
+	}
+	defer obj.Close()
+	digest, err := firmwareDigest(obj.FirmwareInfo, obj.Content)
+	if err != nil {
+		slog.Error("❌ Failed to hash firmware", "name", name, "error", err)
+		http.Error(w, "Failed to read firmware", http.StatusInternalServerError)
+		return
+	}
+
+	manifest := FirmwareManifest{
+		Version: readFirmwareVersion(obj.Content),
+		URL:     requestBaseURL(r) + "/" + config.FirmwareFile + query,
+		Size:    digest.Size,
+		SHA256:  digest.SHA256,
+	}
+	state.RLock()
+	toolchain := state.Toolchain
+	if onStable {
+		toolchain = buildToolchain(stable.Commit)
+	} else {
+		manifest.MinVersion = state.MinVersion
+	}
+	// Notes describe one version, so they only go with that image
+	if state.Notes.Version == manifest.Version {
+		manifest.Notes = state.Notes.Notes
+	}
+	state.RUnlock()
+	manifest.IDFVersion, manifest.CompilerVersion = toolchain.IDFVersion, toolchain.CompilerVersion
+
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Vary", "X-Device-ID")
+	writeJSON(w, manifest)
+}
+
+// requestBaseURL returns the scheme and host the client used to reach us,
+// honouring X-Forwarded-Proto from a TLS-terminating proxy.
+func requestBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestManifestNotes(t *testing.T) {
+	useTestFirmware(t, testImage("1.0.0", 'A', 8192))
+	t.Cleanup(func() {
+		state.Lock()
+		state.Notes = FirmwareNotes{}
+		state.Unlock()
+	})
+
+	tests := []struct {
+		name  string
+		notes FirmwareNotes
+		want  string
+	}{
+		{name: "no notes", notes: FirmwareNotes{}, want: ""},
+		{name: "notes for the image", notes: FirmwareNotes{Version: "1.0.0", Notes: "Validated on rev C"}, want: "Validated on rev C"},
+		{name: "notes for another version", notes: FirmwareNotes{Version: "0.9.0", Notes: "Old notes"}, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state.Lock()
+			state.Notes = tt.notes
+			state.Unlock()
+
+			w := httptest.NewRecorder()
+			manifestHandler(w, httptest.NewRequest(http.MethodGet, "/manifest.json", nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d, want 200", w.Code)
+			}
+			var manifest FirmwareManifest
+			if err := json.Unmarshal(w.Body.Bytes(), &manifest); err != nil {
+				t.Fatal(err)
+			}
+			if manifest.Version != "1.0.0" {
+				t.Fatalf("version %q, want 1.0.0", manifest.Version)
+			}
+			if manifest.Notes != tt.want {
+				t.Errorf("notes %q, want %q", manifest.Notes, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FirmwareMetadata is the sidecar published next to the firmware as
+// <firmware>.json, so downstream tooling can describe an image without
+// calling several endpoints.
+type FirmwareMetadata struct {
+	Version         string    `json:"version"`
+	Commit          string    `json:"commit"`
+	BuiltAt         time.Time `json:"builtAt"`
+	Size            int64     `json:"size"`
+	SHA256          string    `json:"sha256"`
+	IDFVersion      string    `json:"idfVersion,omitempty"`
+	CompilerVersion string    `json:"compilerVersion,omitempty"`
+}
+
+// metadataName is the store name of the metadata sidecar for name.
+func metadataName(name string) string {
+	return name + ".json"
+}
+
+// writeFirmwareMetadata replaces the sidecar of the published firmware.
+// Callers must hold firmwareSwap, so the sidecar changes with the image. If
+// it can't be written the old one is removed rather than left describing
+// another image.
+func writeFirmwareMetadata(meta FirmwareMetadata) {
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err == nil {
+		err = firmwareStore.Put(metadataName(config.FirmwareFile), bytes.NewReader(append(data, '\n')))
+	}
+	if err == nil {
+		return
+	}
+	slog.Warn("⚠️  Could not write firmware metadata", "event", "metadata_failed", "error", err)
+	if err := firmwareStore.Remove(metadataName(config.FirmwareFile)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		slog.Error("❌ Could not remove stale firmware metadata", "event", "metadata_failed", "error", err)
+	}
+}
+
+// historyToolchain returns the toolchain that built commit (or a prefix of
+// it, as archives are named), from its latest successful build in the
+// history.
+func historyToolchain(commit string) Toolchain {
+	state.RLock()
+	defer state.RUnlock()
+	for i := len(state.History) - 1; i >= 0; i-- {
+		if record := state.History[i]; record.Success && commit != "" && strings.HasPrefix(record.Commit, commit) {
+			return Toolchain{IDFVersion: record.IDFVersion, CompilerVersion: record.CompilerVersion}
+		}
+	}
+	return Toolchain{}
+}
+
+// firmwareMetadataHandler serves the metadata sidecar of the published
+// firmware.
+func firmwareMetadataHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowGetOrHead(w, r) {
+		return
+	}
+	firmwareSwap.RLock()
+	obj, err := firmwareStore.Open(metadataName(config.FirmwareFile))
+	firmwareSwap.RUnlock()
+	if errors.Is(err, fs.ErrNotExist) {
+		http.Error(w, "No firmware metadata yet", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("❌ Failed to open firmware metadata", "error", err)
+		http.Error(w, "Failed to read firmware metadata", http.StatusInternalServerError)
+		return
+	}
+	defer obj.Close()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeContent(w, r, metadataName(config.FirmwareFile), obj.ModTime, obj.Content)
+}
+
+// firmwareInfoHandler describes the image /beacon_firmware.bin would serve
+// (honouring ?commit= and canary rollouts) purely in headers, for clients
+// that can't parse JSON: X-Firmware-Version, X-Firmware-Commit,
+// X-Firmware-SHA256, x-MD5 and X-Firmware-Size, with an empty body. HEAD
+// /beacon_firmware.bin sends the same headers with the image's
+// Content-Length.
+func firmwareInfoHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowGetOrHead(w, r) {
+		return
+	}
+	name, commit, ok := requestedFirmware(w, r)
+	if !ok {
+		return
+	}
+
+	firmwareSwap.RLock()
+	file, err := firmwareStore.Open(name)
+	if commit == "" {
+		state.RLock()
+		commit = state.LastGitCommit
+		state.RUnlock()
+	}
+	firmwareSwap.RUnlock()
+	if errors.Is(err, fs.ErrNotExist) {
+		http.Error(w, "Firmware not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("❌ Failed to open firmware", "name", name, "error", err)
+		http.Error(w, "Failed to read firmware", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+	digest, err := firmwareDigest(file.FirmwareInfo, file.Content)
+	if err != nil {
+		slog.Error("❌ Failed to hash firmware", "name", name, "error", err)
+		http.Error(w, "Failed to read firmware", http.StatusInternalServerError)
+		return
+	}
+
+	if version := readFirmwareVersion(file.Content); version != "" {
+		w.Header().Set("X-Firmware-Version", version)
+	}
+	if commit != "" {
+		w.Header().Set("X-Firmware-Commit", commit)
+	}
+	w.Header().Set("x-MD5", digest.MD5)
+	w.Header().Set("X-Firmware-SHA256", digest.SHA256)
+	w.Header().Set("X-Firmware-Size", strconv.FormatInt(file.Size, 10))
+	if forceUpdateFor(r) {
+		w.Header().Set("X-Force-Update", "true")
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Length", "0")
+	slog.Debug("📋 Firmware info", "name", name, "commit", commit, "remote_addr", r.RemoteAddr)
+	w.WriteHeader(http.StatusOK)
+}
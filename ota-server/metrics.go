@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// buildDurationBuckets are the upper bounds, in seconds, of the build
+// duration histogram. A clean ESP-IDF build takes a few minutes.
+var buildDurationBuckets = []float64{30, 60, 120, 300, 600, 900, 1800}
+
+// BuildMetrics accumulates build and git check counters for /metrics.
+type BuildMetrics struct {
+	BuildsTotal       int
+	BuildsFailed      int
+	DurationCounts    []int // per bucket, non-cumulative; last is +Inf
+	DurationSum       float64
+	GitChecksTotal    int
+	GitCheckFailures  int
+	LastSuccessfulRun time.Time
+}
+
+// observeBuild records a finished build. Callers must hold state.Lock.
+func observeBuild(record BuildRecord) {
+	m := &state.Metrics
+	if m.DurationCounts == nil {
+		m.DurationCounts = make([]int, len(buildDurationBuckets)+1)
+	}
+	m.BuildsTotal++
+	if !record.Success {
+		m.BuildsFailed++
+	} else {
+		m.LastSuccessfulRun = record.StartTime.Add(time.Duration(record.DurationSeconds * float64(time.Second)))
+	}
+	i := 0
+	for i < len(buildDurationBuckets) && record.DurationSeconds > buildDurationBuckets[i] {
+		i++
+	}
+	m.DurationCounts[i]++
+	m.DurationSum += record.DurationSeconds
+}
+
+// observeGitCheck counts a git poll. Callers must hold state.Lock.
+func observeGitCheck(failed bool) {
+	state.Metrics.GitChecksTotal++
+	if failed {
+		state.Metrics.GitCheckFailures++
+	}
+}
+
+// metricsHandler serves counters and gauges in the Prometheus text
+// exposition format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	state.RLock()
+	m := state.Metrics
+	m.DurationCounts = append([]int(nil), m.DurationCounts...)
+	inProgress := state.BuildInProgress
+	durations := buildDurations()
+	size := state.FirmwareSize
+	behind, stale := state.CommitsBehind, firmwareStale()
+	downloads := map[string]int{
+		downloadComplete:         state.DownloadsCompleted,
+		downloadClientDisconnect: state.DownloadsClientAborted,
+		downloadWriteError:       state.DownloadWriteErrors,
+	}
+	state.RUnlock()
+
+	var b strings.Builder
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	metric("ota_builds_total", "counter", "Firmware builds finished, successful or not.")
+	fmt.Fprintf(&b, "ota_builds_total %d\n", m.BuildsTotal)
+	metric("ota_builds_failed_total", "counter", "Firmware builds that failed or timed out.")
+	fmt.Fprintf(&b, "ota_builds_failed_total %d\n", m.BuildsFailed)
+
+	metric("ota_build_duration_seconds", "histogram", "Wall-clock duration of firmware builds.")
+	cumulative := 0
+	for i, bound := range buildDurationBuckets {
+		if i < len(m.DurationCounts) {
+			cumulative += m.DurationCounts[i]
+		}
+		fmt.Fprintf(&b, "ota_build_duration_seconds_bucket{le=%q} %d\n", strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(&b, "ota_build_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.BuildsTotal)
+	fmt.Fprintf(&b, "ota_build_duration_seconds_sum %g\n", m.DurationSum)
+	fmt.Fprintf(&b, "ota_build_duration_seconds_count %d\n", m.BuildsTotal)
+
+	metric("ota_build_last_duration_seconds", "gauge", "Duration of the last successful build in the history.")
+	fmt.Fprintf(&b, "ota_build_last_duration_seconds %g\n", durations.LastSeconds)
+	metric("ota_build_average_duration_seconds", "gauge", "Mean duration of the successful builds in the history.")
+	fmt.Fprintf(&b, "ota_build_average_duration_seconds %g\n", durations.AverageSeconds)
+	metric("ota_build_max_duration_seconds", "gauge", "Longest successful build in the history.")
+	fmt.Fprintf(&b, "ota_build_max_duration_seconds %g\n", durations.MaxSeconds)
+
+	metric("ota_build_in_progress", "gauge", "1 while a build or rollback is running.")
+	fmt.Fprintf(&b, "ota_build_in_progress %d\n", boolGauge(inProgress))
+
+	metric("ota_last_successful_build_age_seconds", "gauge", "Seconds since the last successful build finished, -1 if none yet.")
+	age := -1.0
+	if !m.LastSuccessfulRun.IsZero() {
+		age = time.Since(m.LastSuccessfulRun).Seconds()
+	}
+	fmt.Fprintf(&b, "ota_last_successful_build_age_seconds %g\n", age)
+
+	metric("ota_git_checks_total", "counter", "Git update checks run by the poller or webhook.")
+	fmt.Fprintf(&b, "ota_git_checks_total %d\n", m.GitChecksTotal)
+	metric("ota_git_check_failures_total", "counter", "Git update checks whose fetch or reset failed.")
+	fmt.Fprintf(&b, "ota_git_check_failures_total %d\n", m.GitCheckFailures)
+
+	metric("ota_firmware_size_bytes", "gauge", "Size of the firmware currently served.")
+	fmt.Fprintf(&b, "ota_firmware_size_bytes %d\n", size)
+
+	metric("ota_firmware_commits_behind", "gauge", "Commits on origin not included in the served firmware.")
+	fmt.Fprintf(&b, "ota_firmware_commits_behind %d\n", behind)
+	metric("ota_firmware_stale", "gauge", "1 when unbuilt commits are older than STALE_FIRMWARE_AFTER.")
+	fmt.Fprintf(&b, "ota_firmware_stale %d\n", boolGauge(stale))
+
+	metric("ota_firmware_downloads_total", "counter", "Firmware downloads by outcome.")
+	for _, outcome := range []string{downloadComplete, downloadClientDisconnect, downloadWriteError} {
+		fmt.Fprintf(&b, "ota_firmware_downloads_total{outcome=%q} %d\n", outcome, downloads[outcome])
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
+
+func boolGauge(v bool) int {
+	if v {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+)
+
+const metricsPushTimeout = 5 * time.Second
+
+// FleetMetrics is the rollout of the current build across the devices seen
+// in any tracked rollout, as pushed to the metrics sink.
+type FleetMetrics struct {
+	Commit string
+	Fleet  int // devices seen in any tracked rollout
+	RolloutStats
+
+	AdoptionPercent   float64 // share of the fleet confirmed on the current build
+	AckSuccessPercent float64 // settled devices that confirmed it through /verify
+	CrashPercent      float64 // settled devices that came back running another build
+}
+
+// fleetMetrics computes FleetMetrics as of now.
+func fleetMetrics(now time.Time) FleetMetrics {
+	state.RLock()
+	defer state.RUnlock()
+	commit := state.LastGitCommit
+	m := FleetMetrics{Commit: commit[:min(8, len(commit))]}
+	fleet := map[string]bool{}
+	for _, ro := range state.Rollouts {
+		for key := range ro.Downloaded {
+			fleet[key] = true
+		}
+		if m.Commit != "" && ro.Commit == m.Commit {
+			m.RolloutStats = ro.stats(now)
+		}
+	}
+	m.Fleet = len(fleet)
+	if m.Fleet > 0 {
+		m.AdoptionPercent = float64(m.Confirmed) * 100 / float64(m.Fleet)
+	}
+	if settled := m.Devices - m.Pending; settled > 0 {
+		m.AckSuccessPercent = m.ConfirmRate * 100
+		m.CrashPercent = float64(m.Mismatched) * 100 / float64(settled)
+	}
+	return m
+}
+
+// statsd formats m as StatsD gauges named after prefix.
+func (m FleetMetrics) statsd(prefix string) string {
+	var b strings.Builder
+	gauge := func(name string, value float64) {
+		fmt.Fprintf(&b, "%s.%s:%g|g\n", prefix, name, value)
+	}
+	gauge("fleet.devices", float64(m.Fleet))
+	gauge("rollout.devices", float64(m.Devices))
+	gauge("rollout.confirmed", float64(m.Confirmed))
+	gauge("rollout.mismatched", float64(m.Mismatched))
+	gauge("rollout.pending", float64(m.Pending))
+	gauge("rollout.adoption_percent", m.AdoptionPercent)
+	gauge("rollout.ack_success_percent", m.AckSuccessPercent)
+	gauge("rollout.crash_percent", m.CrashPercent)
+	return b.String()
+}
+
+// metricsPusher pushes the fleet metrics to the StatsD sink at
+// config.MetricsPushAddr every config.MetricsPushInterval. It is disabled
+// without an address.
+func metricsPusher() {
+	if config.MetricsPushAddr == "" {
+		return
+	}
+	slog.Info("📈 Pushing rollout metrics", "addr", config.MetricsPushAddr, "interval", config.MetricsPushInterval)
+
+	ticker := time.NewTicker(config.MetricsPushInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		pushFleetMetrics(fleetMetrics(time.Now()))
+	}
+}
+
+// pushFleetMetrics sends m in one datagram, retrying network errors. A push
+// that still fails is logged and the next interval sends fresh values.
+func pushFleetMetrics(m FleetMetrics) {
+	payload := []byte(m.statsd(config.MetricsPushPrefix))
+	_, err := retryTransient(context.Background(), "metrics push", func(int) (string, error) {
+		conn, err := net.DialTimeout("udp", config.MetricsPushAddr, metricsPushTimeout)
+		if err != nil {
+			return err.Error(), err
+		}
+		defer conn.Close()
+		conn.SetWriteDeadline(time.Now().Add(metricsPushTimeout))
+		if _, err := conn.Write(payload); err != nil {
+			return err.Error(), err
+		}
+		return "", nil
+	})
+	if err != nil {
+		slog.Warn("⚠️  Could not push rollout metrics", "event", "metrics_push_failed", "addr", config.MetricsPushAddr, "error", err)
+		return
+	}
+	slog.Debug("📈 Pushed rollout metrics", "commit", m.Commit, "devices", m.Devices, "adoption", m.AdoptionPercent)
+}
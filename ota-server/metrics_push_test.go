@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPushFleetMetrics(t *testing.T) {
+	useTestFirmware(t, testImage("1.0.0", 'A', 1024))
+	now := time.Now()
+	settled := now.Add(-2 * rolloutConfirmGrace)
+	state.Lock()
+	saved := state.Rollouts
+	state.Rollouts = []*Rollout{
+		{Commit: "0123abcd", Downloaded: map[string]time.Time{"a": settled, "b": settled, "c": settled, "d": settled, "e": settled}},
+		{Commit: testCommitA[:8],
+			Downloaded: map[string]time.Time{"a": settled, "b": settled, "c": settled, "d": settled, "f": now},
+			Confirmed:  map[string]time.Time{"a": now, "b": now},
+			Mismatched: map[string]time.Time{"c": now}},
+	}
+	state.Unlock()
+	t.Cleanup(func() {
+		state.Lock()
+		state.Rollouts = saved
+		state.Unlock()
+	})
+
+	sink, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	config.MetricsPushAddr, config.MetricsPushPrefix = sink.LocalAddr().String(), "beacons"
+
+	pushFleetMetrics(fleetMetrics(now))
+	buf := make([]byte, 4096)
+	sink.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := sink.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(buf[:n])), "\n") {
+		name, value, _ := strings.Cut(line, ":")
+		got[name] = value
+	}
+
+	// 6 devices in the fleet; of the current build's 5, one is pending and
+	// 2 of the 4 settled confirmed while one came back on another build
+	for name, want := range map[string]string{
+		"beacons.fleet.devices":               "6|g",
+		"beacons.rollout.devices":             "5|g",
+		"beacons.rollout.confirmed":           "2|g",
+		"beacons.rollout.mismatched":          "1|g",
+		"beacons.rollout.pending":             "1|g",
+		"beacons.rollout.adoption_percent":    "33.333333333333336|g",
+		"beacons.rollout.ack_success_percent": "50|g",
+		"beacons.rollout.crash_percent":       "25|g",
+	} {
+		if got[name] != want {
+			t.Errorf("%s = %q, want %q", name, got[name], want)
+		}
+	}
+}
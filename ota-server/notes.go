@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"time"
+)
+
+const maxNotesBytes = 64 << 10
+
+// FirmwareNotes is free-form operator knowledge about a firmware version.
+// Notes are dropped when a new version is published unless CarryForward is
+// set, in which case they are re-attached to the new version.
+type FirmwareNotes struct {
+	Version      string    `json:"version"`
+	Notes        string    `json:"notes"`
+	CarryForward bool      `json:"carryForward"`
+	UpdatedAt    time.Time `json:"updatedAt"`
+}
+
+func firmwareNotesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		state.RLock()
+		notes := state.Notes
+		state.RUnlock()
+		writeJSON(w, notes)
+
+	case http.MethodPut:
+		if !requireAdmin(w, r) {
+			return
+		}
+
+		var req struct {
+			Notes        string `json:"notes"`
+			CarryForward bool   `json:"carryForward"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxNotesBytes)).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		notes := FirmwareNotes{
+			Version:      getFirmwareVersion(filepath.Join(config.FirmwarePath, config.FirmwareFile)),
+			Notes:        req.Notes,
+			CarryForward: req.CarryForward,
+			UpdatedAt:    time.Now(),
+		}
+		state.Lock()
+		state.Notes = notes
+		state.Unlock()
+		saveState()
+
+		slog.Info("📝 Firmware notes updated", "event", "notes_updated", "version", notes.Version, "remote_addr", r.RemoteAddr)
+		writeJSON(w, notes)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// rollNotesForward clears or re-attaches the notes when version is
+// published. Callers must hold state.Lock.
+func rollNotesForward(version string) {
+	if state.Notes.Version == version || state.Notes.Notes == "" {
+		return
+	}
+	if !state.Notes.CarryForward {
+		slog.Info("📝 Clearing firmware notes for superseded version", "version", state.Notes.Version)
+		state.Notes = FirmwareNotes{}
+		return
+	}
+	state.Notes.Version = version
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	notifyTimeout     = 10 * time.Second
+	notifyOutputLines = 10
+)
+
+// Notification events.
+const (
+	notifyBuildFailed    = "build_failed"
+	notifyBuildRecovered = "build_recovered"
+	notifyMonitorStalled = "monitor_stalled"
+)
+
+// BuildNotification describes a build failure or the first success after
+// one, or a git monitor the watchdog had to restart. For the latter, Error
+// holds the reason and Commit the last commit checked out.
+type BuildNotification struct {
+	Event           string  `json:"event"`
+	Commit          string  `json:"commit"`
+	Error           string  `json:"error,omitempty"`
+	OutputTail      string  `json:"outputTail,omitempty"`
+	DurationSeconds float64 `json:"durationSeconds"`
+}
+
+// Summary is a one-line human-readable description of the notification.
+func (n BuildNotification) Summary() string {
+	commit := n.Commit[:min(8, len(n.Commit))]
+	switch n.Event {
+	case notifyBuildRecovered:
+		return fmt.Sprintf("✅ Firmware build recovered at %s (%.0fs)", commit, n.DurationSeconds)
+	case notifyMonitorStalled:
+		return fmt.Sprintf("🚨 Git monitor stalled at %s and was restarted: %s", commit, n.Error)
+	}
+	return fmt.Sprintf("❌ Firmware build failed at %s after %.0fs: %s", commit, n.DurationSeconds, n.Error)
+}
+
+// Notifier delivers build notifications somewhere people will see them.
+type Notifier interface {
+	Notify(ctx context.Context, n BuildNotification) error
+}
+
+// webhookNotifier POSTs notifications as JSON. The "text" field makes the
+// payload a valid Slack incoming-webhook message; other receivers can use
+// the structured fields.
+type webhookNotifier struct {
+	url string
+}
+
+func (wn webhookNotifier) Notify(ctx context.Context, n BuildNotification) error {
+	text := n.Summary()
+	if n.OutputTail != "" {
+		text += "\n```\n" + n.OutputTail + "\n```"
+	}
+	body, err := json.Marshal(struct {
+		Text string `json:"text"`
+		BuildNotification
+	}{text, n})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wn.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// notifiers returns the configured notification backends.
+func notifiers() []Notifier {
+	var backends []Notifier
+	if config.NotifyWebhook != "" {
+		backends = append(backends, webhookNotifier{url: config.NotifyWebhook})
+	}
+	return backends
+}
+
+// buildAlert tracks what has been notified, so a run of identical failures
+// produces one message and recovery is reported once.
+var buildAlert struct {
+	sync.Mutex
+	failing   bool
+	lastError string
+}
+
+// notifyBuildResult sends a notification for a failed build, unless the
+// last one already reported the same error, or for the first success
+// after a failure. Delivery runs in the background and never blocks the
+// build.
+func notifyBuildResult(record BuildRecord, buildErr error, output []byte) {
+	n := BuildNotification{Commit: record.Commit, DurationSeconds: record.DurationSeconds}
+
+	buildAlert.Lock()
+	switch {
+	case buildErr != nil:
+		if buildAlert.failing && buildAlert.lastError == buildErr.Error() {
+			buildAlert.Unlock()
+			return
+		}
+		buildAlert.failing, buildAlert.lastError = true, buildErr.Error()
+		n.Event, n.Error, n.OutputTail = notifyBuildFailed, buildErr.Error(), lastLines(string(output), notifyOutputLines)
+	case buildAlert.failing:
+		buildAlert.failing, buildAlert.lastError = false, ""
+		n.Event = notifyBuildRecovered
+	default:
+		buildAlert.Unlock()
+		return
+	}
+	buildAlert.Unlock()
+	sendNotification(n)
+}
+
+// notifyMonitorRestart reports a git monitor restart by the watchdog.
+func notifyMonitorRestart(reason string) {
+	state.RLock()
+	commit := state.LastGitCommit
+	state.RUnlock()
+	sendNotification(BuildNotification{Event: notifyMonitorStalled, Commit: commit, Error: reason})
+}
+
+// sendNotification delivers n to every backend in the background.
+func sendNotification(n BuildNotification) {
+	for _, notifier := range notifiers() {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+			defer cancel()
+			if err := notifier.Notify(ctx, n); err != nil {
+				slog.Warn("⚠️  Could not send notification", "notification", n.Event, "error", err)
+			} else {
+				slog.Info("📣 Notification sent", "notification", n.Event, "commit", n.Commit)
+			}
+		}()
+	}
+}
+
+func lastLines(s string, n int) string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	return strings.Join(lines[max(0, len(lines)-n):], "\n")
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMonitorRestartNotification(t *testing.T) {
+	useTestFirmware(t, testImage("1.0.0", 'A', 1024))
+	received := make(chan map[string]any, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Error(err)
+		}
+		received <- payload
+	}))
+	defer hook.Close()
+	config.NotifyWebhook = hook.URL
+
+	notifyMonitorRestart("inactive for 3h0m0s")
+	select {
+	case payload := <-received:
+		if payload["event"] != notifyMonitorStalled || payload["error"] != "inactive for 3h0m0s" ||
+			payload["commit"] != testCommitA {
+			t.Errorf("unexpected payload %v", payload)
+		}
+		if text, _ := payload["text"].(string); !strings.Contains(text, "Git monitor stalled at "+testCommitA[:8]) {
+			t.Errorf("unexpected text %q", text)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no notification sent")
+	}
+}
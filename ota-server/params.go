@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Request parameters that pick a stored file are checked against these
+// before anything is looked up, so a value like "../../etc/passwd" is
+// answered with 400 instead of reaching a path. Lookups then go through
+// allowlists (retained versions, history, targets), never the raw value.
+var (
+	// An abbreviated or full commit hash
+	commitParamPattern = regexp.MustCompile(`^[0-9a-f]{7,40}$`)
+
+	// A project version as downloadFilename writes it, e.g. 1.4.0-rc.1+ab
+	versionParamPattern = regexp.MustCompile(`^[0-9A-Za-z][0-9A-Za-z.+_-]{0,63}$`)
+)
+
+// parseCommitParam lowercases value and reports whether it is a commit
+// hash of 7 to 40 hex digits.
+func parseCommitParam(value string) (string, bool) {
+	value = strings.ToLower(value)
+	return value, commitParamPattern.MatchString(value)
+}
+
+// requireCommitParam is parseCommitParam for handlers: it answers 400 for
+// an invalid value of the named parameter.
+func requireCommitParam(w http.ResponseWriter, name, value string) (string, bool) {
+	commit, ok := parseCommitParam(value)
+	if !ok {
+		http.Error(w, name+" must be a commit hash of 7 to 40 hex digits", http.StatusBadRequest)
+	}
+	return commit, ok
+}
+
+// requireTargetParam answers 400 unless value could be a target name.
+func requireTargetParam(w http.ResponseWriter, name, value string) bool {
+	if !targetNamePattern.MatchString(value) {
+		http.Error(w, name+" must be a target name (lowercase letters, digits, - and _)", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
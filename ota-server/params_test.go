@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseCommitParam(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+		valid bool
+	}{
+		{value: "86305f5", want: "86305f5", valid: true},
+		{value: "86305F572F585DD22F1AA130F2CED714DBD02D5C", want: "86305f572f585dd22f1aa130f2ced714dbd02d5c", valid: true},
+		{value: "86305f"},
+		{value: "86305f572f585dd22f1aa130f2ced714dbd02d5c0"},
+		{value: "../../etc/passwd"},
+		{value: "86305f5/../../etc/passwd"},
+		{value: "86305f5\x00"},
+		{value: "-86305f5"},
+		{value: "main"},
+	}
+	for _, tt := range tests {
+		got, valid := parseCommitParam(tt.value)
+		if valid != tt.valid || (valid && got != tt.want) {
+			t.Errorf("parseCommitParam(%q) = %q, %v; want %q, %v", tt.value, got, valid, tt.want, tt.valid)
+		}
+	}
+}
+
+func TestTraversalPayloadsRejected(t *testing.T) {
+	useTestFirmware(t, testImage("1.0.0", 'A', 4096))
+	config.AdminToken = "secret"
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		method  string
+		target  string
+		header  http.Header
+		want    int
+	}{
+		{name: "pinned commit", handler: variantFirmwareHandler,
+			target: "/beacon_firmware.bin?commit=../../etc/passwd", want: http.StatusBadRequest},
+		{name: "encoded pinned commit", handler: variantFirmwareHandler,
+			target: "/beacon_firmware.bin?commit=%2e%2e%2f%2e%2e%2fetc%2fpasswd", want: http.StatusBadRequest},
+		{name: "commit prefix with a path", handler: variantFirmwareHandler,
+			target: "/beacon_firmware.bin?commit=86305f5/../../../etc/passwd", want: http.StatusBadRequest},
+		{name: "variant query", handler: variantFirmwareHandler,
+			target: "/beacon_firmware.bin?variant=../../etc/passwd", want: http.StatusBadRequest},
+		{name: "variant header", handler: variantFirmwareHandler, target: "/beacon_firmware.bin",
+			header: http.Header{"X-Board-Variant": {"../.state"}}, want: http.StatusBadRequest},
+		{name: "target path", handler: targetFirmwareHandler,
+			target: "/firmware/..%2f..%2fetc%2fpasswd.bin", want: http.StatusBadRequest},
+		{name: "commit in a versioned name", handler: versionedFirmwareHandler,
+			target: "/firmware/versions/beacon_firmware-1.0.0-..%2f..%2fetc%2fpasswd.bin", want: http.StatusBadRequest},
+		{name: "version in a versioned name", handler: versionedFirmwareHandler,
+			target: "/firmware/versions/beacon_firmware-..%2f..%2fx-86305f5.bin", want: http.StatusBadRequest},
+		{name: "delta source", handler: deltaHandler,
+			target: "/delta?from=../../etc/passwd", want: http.StatusBadRequest},
+		{name: "rollout path", handler: rolloutHandler,
+			target: "/rollout/..%2f..%2fetc%2fpasswd", want: http.StatusBadRequest},
+		{name: "saved build log", handler: logsHandler,
+			target: "/logs?commit=../../../etc/shadow", want: http.StatusBadRequest},
+		{name: "rollback target", handler: rollbackHandler, method: http.MethodPost,
+			target: "/rollback?commit=../../beacon_firmware", want: http.StatusBadRequest},
+
+		// Well-formed values get past validation and are looked up
+		{name: "unknown pinned commit", handler: variantFirmwareHandler,
+			target: "/beacon_firmware.bin?commit=86305f5", want: http.StatusNotFound},
+		{name: "unknown target", handler: targetFirmwareHandler,
+			target: "/firmware/passwd.bin", want: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			r := httptest.NewRequest(method, tt.target, nil)
+			for key, values := range tt.header {
+				r.Header[key] = values
+			}
+			r.Header.Set("Authorization", "Bearer secret")
+			w := httptest.NewRecorder()
+			tt.handler(w, r)
+			if w.Code != tt.want {
+				t.Errorf("%s %s: status %d (%q), want %d", method, tt.target, w.Code, w.Body.String(), tt.want)
+			}
+		})
+	}
+}
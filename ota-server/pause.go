@@ -0,0 +1,76 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Maintenance is the maintenance mode state shown in /status and returned
+// by /maintenance.
+type Maintenance struct {
+	Paused bool      `json:"paused"`
+	Since  time.Time `json:"since"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// buildsPaused reports whether maintenance mode is on. While it is, the git
+// monitor neither fetches nor builds and queued builds are dropped.
+func buildsPaused() bool {
+	state.RLock()
+	defer state.RUnlock()
+	return state.Maintenance.Paused
+}
+
+// maintenanceHandler shows maintenance mode on GET and switches it on POST:
+// enabled=true or false sets it, without enabled it toggles. An optional
+// reason is shown on the dashboard.
+func maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		state.RLock()
+		current := state.Maintenance
+		state.RUnlock()
+		writeJSON(w, current)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	if !parseSmallForm(w, r) {
+		return
+	}
+
+	state.Lock()
+	paused := !state.Maintenance.Paused
+	if value := r.FormValue("enabled"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			state.Unlock()
+			http.Error(w, "enabled must be true or false", http.StatusBadRequest)
+			return
+		}
+		paused = parsed
+	}
+	if paused != state.Maintenance.Paused {
+		state.Maintenance = Maintenance{}
+		if paused {
+			state.Maintenance = Maintenance{Paused: true, Since: time.Now(), Reason: r.FormValue("reason")}
+		}
+	}
+	current := state.Maintenance
+	state.Unlock()
+	saveState()
+
+	if current.Paused {
+		slog.Warn("⏸️  Maintenance mode on, automatic builds paused", "event", "maintenance_on", "reason", current.Reason,
+			"remote_addr", r.RemoteAddr)
+	} else {
+		slog.Info("▶️  Maintenance mode off, automatic builds resumed", "event", "maintenance_off", "remote_addr", r.RemoteAddr)
+	}
+	writeJSON(w, current)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// The state file lives next to the firmware, so it survives container
+// restarts along with the images it describes.
+const stateFile = ".state.json"
+
+// PublishPin records that an operator published an image by hand, with a
+// rollback or an upload, so a restart keeps serving it instead of
+// rebuilding the checkout over it. It holds until a build publishes again,
+// which on startup means until the checkout has moved past Head.
+type PublishPin struct {
+	Reason string    `json:"reason"` // buildReasonRollback or buildReasonUpload
+	Head   string    `json:"head"`   // checked-out commit when it was pinned
+	At     time.Time `json:"at"`
+}
+
+// pinPublished pins the image just published by hand. Callers must not
+// hold state, as it runs git.
+func pinPublished(reason string) {
+	pin := PublishPin{Reason: reason, Head: getCurrentCommit(), At: time.Now()}
+	state.Lock()
+	state.Pin = pin
+	state.Unlock()
+}
+
+// persistedState is the part of ServerState that outlives a restart.
+// FirmwareSHA256 identifies the image the rest of it describes.
+type persistedState struct {
+	LastGitCommit   string            `json:"lastGitCommit"`
+	LastBuildTime   time.Time         `json:"lastBuildTime"`
+	FirmwareSize    int64             `json:"firmwareSize"`
+	FirmwareSHA256  string            `json:"firmwareSha256"`
+	FirmwareVersion string            `json:"firmwareVersion"`
+	MinVersion      string            `json:"minVersion,omitempty"`
+	Toolchain       Toolchain         `json:"toolchain"`
+	History         []BuildRecord     `json:"history"`
+	Deltas          []DeltaInfo       `json:"deltas,omitempty"`
+	StableCommit    string            `json:"stableCommit,omitempty"`
+	CanaryCommit    string            `json:"canaryCommit,omitempty"`
+	Slots           map[string]string `json:"slots,omitempty"`
+	ActiveSlot      string            `json:"activeSlot,omitempty"`
+	Channels        []ChannelStatus   `json:"channels,omitempty"`
+	Maintenance     Maintenance       `json:"maintenance"`
+	Rollouts        []*Rollout        `json:"rollouts,omitempty"`
+	Pin             PublishPin        `json:"pin"`
+	Notes           FirmwareNotes     `json:"notes"`
+
+	Licenses map[string]*VersionLicense `json:"licenses,omitempty"`
+	Upload   *UploadInfo                `json:"upload,omitempty"`
+}
+
+// saveMu serializes saveState, so a snapshot is always renamed into place
+// before the next one is taken and an older snapshot can't overwrite a
+// newer one.
+var saveMu sync.Mutex
+
+// saveState writes the persisted fields of ServerState to disk, replacing
+// the previous file atomically.
+func saveState() {
+	saveMu.Lock()
+	defer saveMu.Unlock()
+
+	state.RLock()
+	saved := persistedState{
+		LastGitCommit:   state.LastGitCommit,
+		LastBuildTime:   state.LastBuildTime,
+		FirmwareSize:    state.FirmwareSize,
+		FirmwareSHA256:  state.FirmwareChecksum.SHA256,
+		FirmwareVersion: state.FirmwareVersion,
+		MinVersion:      state.MinVersion,
+		Toolchain:       state.Toolchain,
+		History:         state.History,
+		Deltas:          state.Deltas,
+		StableCommit:    state.StableCommit,
+		CanaryCommit:    state.CanaryCommit,
+		Slots:           state.Slots,
+		ActiveSlot:      state.ActiveSlot,
+		Channels:        state.Channels,
+		Maintenance:     state.Maintenance,
+		Rollouts:        state.Rollouts,
+		Pin:             state.Pin,
+		Notes:           state.Notes,
+		Licenses:        state.Licenses,
+		Upload:          state.Upload,
+	}
+	data, err := json.MarshalIndent(saved, "", "  ")
+	state.RUnlock()
+	if err != nil {
+		slog.Warn("⚠️  Could not encode server state", "error", err)
+		return
+	}
+
+	path := filepath.Join(config.FirmwarePath, stateFile)
+	if err := writeStateFile(path, data); err != nil {
+		slog.Warn("⚠️  Could not save server state", "path", path, "error", err)
+	}
+}
+
+// writeStateFile writes data to a temp file next to path and renames it
+// into place.
+func writeStateFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), stateFile+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// loadState restores the state saved by the previous run and reports
+// whether the published firmware is still the build of the checked-out
+// commit, or was pinned by a rollback or upload since which the checkout
+// hasn't moved, in which case the startup build can be skipped.
+func loadState() (upToDate bool) {
+	path := filepath.Join(config.FirmwarePath, stateFile)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false
+	}
+	var saved persistedState
+	if err == nil {
+		err = json.Unmarshal(data, &saved)
+	}
+	if err != nil {
+		slog.Warn("⚠️  Ignoring saved server state", "path", path, "error", err)
+		return false
+	}
+
+	// Hash the image fresh rather than trusting the saved checksum
+	digest, err := currentFirmwareDigest()
+	published := err == nil && digest.SHA256 == saved.FirmwareSHA256
+	var info CommitInfo
+	if published {
+		info = commitInfo(saved.LastGitCommit)
+		if saved.Upload != nil {
+			info = saved.Upload.commitInfo()
+		}
+	}
+	head := getCurrentCommit()
+	pinned := published && saved.Pin.Reason != "" && saved.Pin.Head == head
+
+	state.Lock()
+	state.History = saved.History
+	state.Deltas = saved.Deltas
+	state.StableCommit, state.CanaryCommit = saved.StableCommit, saved.CanaryCommit
+	state.Slots, state.ActiveSlot = saved.Slots, saved.ActiveSlot
+	restoreChannelStatus(saved.Channels)
+	state.Maintenance = saved.Maintenance
+	state.Rollouts = saved.Rollouts
+	state.Notes = saved.Notes
+	for version, license := range saved.Licenses {
+		if license.Devices == nil {
+			license.Devices = make(map[string]time.Time)
+		}
+		state.Licenses[version] = license
+	}
+	if pinned {
+		state.Pin = saved.Pin
+	}
+	if published {
+		state.LastGitCommit, state.LastCommitInfo = saved.LastGitCommit, info
+		state.LastBuildTime = saved.LastBuildTime
+		state.FirmwareSize = saved.FirmwareSize
+		state.FirmwareVersion = saved.FirmwareVersion
+		state.MinVersion = saved.MinVersion
+		state.Toolchain = saved.Toolchain
+		state.Upload = saved.Upload
+		state.Metrics.LastSuccessfulRun = saved.LastBuildTime
+	}
+	state.Unlock()
+	pruneBuildLogFiles()
+
+	upToDate = published && (saved.LastGitCommit == head || pinned)
+	if saved.Pin.Reason != "" && !pinned {
+		slog.Info("📌 Lifting pin on hand-published firmware", "event", "pin_lifted", "reason", saved.Pin.Reason,
+			"firmware_matches", published, "head", head[:min(8, len(head))])
+	}
+	slog.Info("💾 Restored server state", "builds", len(saved.History), "commit", saved.LastGitCommit,
+		"firmware_matches", published, "pinned", pinned, "up_to_date", upToDate)
+	return upToDate
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dockerPruneTimeout bounds each docker prune command, so a hung daemon
+// can't hold dockerHost and block builds.
+const dockerPruneTimeout = 10 * time.Minute
+
+// dockerHost serializes builds and maintenance on the Docker host. Builds
+// wait for it; maintenance only runs when it can take it immediately.
+var dockerHost sync.Mutex
+
+// pruneMonitor periodically removes dangling images and build cache older
+// than config.DockerPruneRetention. It is disabled unless
+// config.DockerPruneInterval is set (e.g. "24h"), and with the local build
+// backend, which leaves nothing in Docker to prune.
+func pruneMonitor() {
+	if config.DockerPruneInterval == 0 {
+		return
+	}
+	if config.BuildBackend != buildBackendDocker {
+		slog.Info("🧹 Docker prune skipped, builds don't use Docker", "backend", config.BuildBackend)
+		return
+	}
+	slog.Info("🧹 Docker prune scheduled", "interval", config.DockerPruneInterval, "retention", config.DockerPruneRetention)
+
+	ticker := time.NewTicker(config.DockerPruneInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		pruneDocker(config.DockerPruneRetention)
+	}
+}
+
+func pruneDocker(retention time.Duration) {
+	if !dockerHost.TryLock() {
+		slog.Warn("⚠️  Build in progress, skipping Docker prune")
+		return
+	}
+	defer dockerHost.Unlock()
+	runDockerPrune(retention)
+}
+
+// runDockerPrune removes dangling images and build cache older than
+// retention. It does nothing unless builds use Docker. Callers must hold
+// dockerHost.
+func runDockerPrune(retention time.Duration) {
+	if config.BuildBackend != buildBackendDocker {
+		return
+	}
+	slog.Info("🧹 Pruning Docker images and build cache...", "event", "docker_prune_started")
+	var reclaimed []string
+	for _, args := range [][]string{
+		{"image", "prune", "-f", "--filter", "until=" + retention.String()},
+		{"builder", "prune", "-f", "--filter", "until=" + retention.String()},
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), dockerPruneTimeout)
+		output, err := exec.CommandContext(ctx, "docker", args...).CombinedOutput()
+		cancel()
+		if err != nil {
+			slog.Error("❌ Docker prune command failed", "command", "docker "+strings.Join(args[:2], " "), "error", err, "output", string(output))
+			continue
+		}
+		if space := reclaimedSpace(string(output)); space != "" {
+			reclaimed = append(reclaimed, args[0]+": "+space)
+		}
+	}
+
+	summary := strings.Join(reclaimed, ", ")
+	state.Lock()
+	state.LastPruneTime = time.Now()
+	state.LastPruneReclaimed = summary
+	state.Unlock()
+
+	slog.Info("✅ Docker prune complete", "event", "docker_prune_completed", "reclaimed", summary)
+}
+
+// reclaimedSpace extracts the "Total reclaimed space" figure from docker
+// prune output.
+func reclaimedSpace(output string) string {
+	for _, line := range strings.Split(output, "\n") {
+		if _, space, ok := strings.Cut(line, "Total reclaimed space:"); ok {
+			return strings.TrimSpace(space)
+		}
+		if _, space, ok := strings.Cut(line, "Total:"); ok {
+			return strings.TrimSpace(space)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Buckets that have been idle this long are full again and can be dropped
+// once more than maxRateBuckets clients are tracked. A download that hasn't
+// fetched a range for resumeWindow can't be resumed for free any more.
+const (
+	rateBucketIdle = 10 * time.Minute
+	maxRateBuckets = 256
+	resumeWindow   = 30 * time.Minute
+)
+
+// resolveRateLimits validates the download limits and fills in the burst,
+// which defaults to the per-minute rate.
+func resolveRateLimits(cfg *Config) error {
+	if cfg.DownloadRate < 0 || cfg.DownloadBurst < 0 || cfg.GlobalDownloadRate < 0 {
+		return fmt.Errorf("download rate limits must not be negative")
+	}
+	if cfg.DownloadBurst == 0 {
+		cfg.DownloadBurst = max(cfg.DownloadRate, 1)
+	}
+	for i, cidr := range cfg.RateLimitExempt {
+		normalized, err := normalizeCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("rate limit exemption: %w", err)
+		}
+		cfg.RateLimitExempt[i] = normalized
+	}
+	return nil
+}
+
+// normalizeCIDR checks a network from the config. A bare address stands
+// for just that host.
+func normalizeCIDR(cidr string) (string, error) {
+	cidr = strings.TrimSpace(cidr)
+	if !strings.Contains(cidr, "/") {
+		if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+			cidr += "/32"
+		} else {
+			cidr += "/128"
+		}
+	}
+	if _, _, err := net.ParseCIDR(cidr); err != nil {
+		return "", err
+	}
+	return cidr, nil
+}
+
+// tokenBucket refills at rate tokens per second up to burst.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take spends a token if one is available. Otherwise it returns how long
+// until the next one.
+func (b *tokenBucket) take(now time.Time, rate, burst float64) (bool, time.Duration) {
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// downloadLimiter holds the per-client and global firmware download
+// buckets, and the downloads in progress by client and image ETag.
+var downloadLimiter = struct {
+	sync.Mutex
+	clients   map[string]*tokenBucket
+	global    *tokenBucket
+	downloads map[string]time.Time
+}{clients: make(map[string]*tokenBucket), downloads: make(map[string]time.Time)}
+
+// allowDownload applies the download rate limits to a firmware request,
+// answering 429 with Retry-After when the client or the server as a whole
+// is over its limit. Clients in config.RateLimitExempt aren't limited, and
+// neither are requests that resume a download (see resumesDownload); those
+// are checked against the image by allowResume once its ETag is known.
+func allowDownload(w http.ResponseWriter, r *http.Request) bool {
+	if resumesDownload(r) {
+		return true
+	}
+	return chargeDownload(w, r)
+}
+
+// allowResume charges a resumed download after all unless the client has
+// a download of the image with this etag in progress: ServeContent sends a
+// request whose If-Range doesn't match the whole image, and a client that
+// never started one mustn't get ranges for free. Every download it lets
+// through is recorded as in progress for the next resume.
+func allowResume(w http.ResponseWriter, r *http.Request, etag string) bool {
+	if config.DownloadRate == 0 && config.GlobalDownloadRate == 0 {
+		return true
+	}
+	ip := clientIP(r)
+	if resumesDownload(r) && !(r.Header.Get("If-Range") == etag && downloadInProgress(ip, etag)) && !chargeDownload(w, r) {
+		return false
+	}
+	markDownloadInProgress(ip, etag)
+	return true
+}
+
+// downloadInProgress reports whether ip fetched the image with etag within
+// resumeWindow.
+func downloadInProgress(ip, etag string) bool {
+	downloadLimiter.Lock()
+	defer downloadLimiter.Unlock()
+	last, ok := downloadLimiter.downloads[ip+" "+etag]
+	return ok && time.Since(last) < resumeWindow
+}
+
+// markDownloadInProgress marks ip's download of the image with etag as in
+// progress. At most maxRateBuckets downloads are tracked: expired ones are
+// dropped first, then the oldest, so many clients within resumeWindow
+// can't grow the map without bound.
+func markDownloadInProgress(ip, etag string) {
+	now := time.Now()
+	key := ip + " " + etag
+	downloadLimiter.Lock()
+	defer downloadLimiter.Unlock()
+	if _, ok := downloadLimiter.downloads[key]; !ok && len(downloadLimiter.downloads) >= maxRateBuckets {
+		oldestKey, oldest := "", now
+		for k, last := range downloadLimiter.downloads {
+			if now.Sub(last) >= resumeWindow {
+				delete(downloadLimiter.downloads, k)
+			} else if last.Before(oldest) || oldestKey == "" {
+				oldestKey, oldest = k, last
+			}
+		}
+		if len(downloadLimiter.downloads) >= maxRateBuckets {
+			delete(downloadLimiter.downloads, oldestKey)
+		}
+	}
+	downloadLimiter.downloads[key] = now
+}
+
+// resumesDownload reports whether r continues a download that was already
+// counted: a single range starting past the first byte, conditional on the
+// ETag of the image the download started with. "bytes=0-" and ranges
+// without an ETag If-Range fetch an image from scratch and are counted.
+func resumesDownload(r *http.Request) bool {
+	spec, ok := strings.CutPrefix(r.Header.Get("Range"), "bytes=")
+	if !ok || strings.Contains(spec, ",") || !strings.HasPrefix(r.Header.Get("If-Range"), `"`) {
+		return false
+	}
+	start, _, _ := strings.Cut(spec, "-")
+	offset, err := strconv.ParseInt(strings.TrimSpace(start), 10, 64)
+	return err == nil && offset > 0
+}
+
+// chargeDownload takes a token from the client's and the global bucket, or
+// answers 429. A client token taken before the global bucket refuses is
+// given back.
+func chargeDownload(w http.ResponseWriter, r *http.Request) bool {
+	if config.DownloadRate == 0 && config.GlobalDownloadRate == 0 {
+		return true
+	}
+	ip := clientIP(r)
+	if rateLimitExempt(ip) {
+		return true
+	}
+
+	now := time.Now()
+	downloadLimiter.Lock()
+	ok, wait, scope := true, time.Duration(0), ""
+	var bucket *tokenBucket
+	if config.DownloadRate > 0 {
+		bucket = downloadLimiter.clients[ip]
+		if bucket == nil {
+			if len(downloadLimiter.clients) >= maxRateBuckets {
+				pruneRateBuckets(now)
+			}
+			bucket = &tokenBucket{tokens: float64(config.DownloadBurst), last: now}
+			downloadLimiter.clients[ip] = bucket
+		}
+		ok, wait = bucket.take(now, float64(config.DownloadRate)/60, float64(config.DownloadBurst))
+		scope = "client"
+	}
+	if ok && config.GlobalDownloadRate > 0 {
+		if downloadLimiter.global == nil {
+			downloadLimiter.global = &tokenBucket{tokens: float64(config.GlobalDownloadRate), last: now}
+		}
+		ok, wait = downloadLimiter.global.take(now, float64(config.GlobalDownloadRate)/60, float64(config.GlobalDownloadRate))
+		scope = "global"
+		if !ok && bucket != nil {
+			// The download isn't happening, so it doesn't count for the client
+			bucket.tokens = math.Min(bucket.tokens+1, float64(config.DownloadBurst))
+		}
+	}
+	downloadLimiter.Unlock()
+	if ok {
+		return true
+	}
+
+	retry := int(math.Ceil(wait.Seconds()))
+	slog.Warn("🚦 Firmware download throttled", "event", "download_throttled", "scope", scope, "remote_addr", r.RemoteAddr,
+		"device", deviceID(r), "retry_after", retry)
+	w.Header().Set("Retry-After", fmt.Sprintf("%d", retry))
+	http.Error(w, "Too many firmware downloads, retry later", http.StatusTooManyRequests)
+	return false
+}
+
+// pruneRateBuckets drops buckets of clients that have gone quiet. Callers
+// must hold downloadLimiter.
+func pruneRateBuckets(now time.Time) {
+	for ip, bucket := range downloadLimiter.clients {
+		if now.Sub(bucket.last) > rateBucketIdle {
+			delete(downloadLimiter.clients, ip)
+		}
+	}
+}
+
+func clientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+func rateLimitExempt(ip string) bool {
+	return inNetworks(ip, config.RateLimitExempt)
+}
+
+// inNetworks reports whether ip is in one of the normalized CIDRs.
+func inNetworks(ip string, cidrs []string) bool {
+	addr := net.ParseIP(ip)
+	for _, cidr := range cidrs {
+		if _, network, err := net.ParseCIDR(cidr); err == nil && addr != nil && network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
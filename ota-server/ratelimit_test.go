@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRangedDownloadsRateLimited(t *testing.T) {
+	image := testImage("1.0.0", 'A', 8192)
+	useTestFirmware(t, image)
+	config.DownloadRate, config.DownloadBurst = 1, 1
+
+	manifest, err := chunkManifest(config.FirmwareFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head := httptest.NewRecorder()
+	serveFirmware(head, httptest.NewRequest(http.MethodHead, "/"+config.FirmwareFile, nil))
+	etag := head.Header().Get("ETag")
+	if etag == "" || manifest.ETag != etag {
+		t.Fatalf("chunk manifest etag %s doesn't match the firmware's %s", manifest.ETag, etag)
+	}
+
+	tests := []struct {
+		name   string
+		header http.Header
+		want   int
+	}{
+		{name: "full download", want: http.StatusTooManyRequests},
+		{name: "range from the first byte", header: http.Header{"Range": {"bytes=0-"}}, want: http.StatusTooManyRequests},
+		{name: "first chunk", header: http.Header{"Range": {"bytes=0-4095"}, "If-Range": {etag}},
+			want: http.StatusTooManyRequests},
+		{name: "resume without If-Range", header: http.Header{"Range": {"bytes=4096-"}}, want: http.StatusTooManyRequests},
+		{name: "resume with a date If-Range", header: http.Header{"Range": {"bytes=4096-"},
+			"If-Range": {"Mon, 02 Jan 2006 15:04:05 GMT"}}, want: http.StatusTooManyRequests},
+		{name: "resume of another image", header: http.Header{"Range": {"bytes=4096-"}, "If-Range": {`"0123456789abcdef-1"`}},
+			want: http.StatusTooManyRequests},
+		{name: "several ranges", header: http.Header{"Range": {"bytes=4096-4100,0-4095"}, "If-Range": {etag}},
+			want: http.StatusTooManyRequests},
+		{name: "resume", header: http.Header{"Range": {"bytes=4096-"}, "If-Range": {etag}}, want: http.StatusPartialContent},
+		{name: "later chunk", header: http.Header{"Range": {"bytes=4096-8191"}, "If-Range": {etag}},
+			want: http.StatusPartialContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Spend the client's only token on a full download first
+			downloadLimiter.Lock()
+			downloadLimiter.clients, downloadLimiter.global = map[string]*tokenBucket{}, nil
+			downloadLimiter.downloads = map[string]time.Time{}
+			downloadLimiter.Unlock()
+			first := httptest.NewRecorder()
+			serveFirmware(first, httptest.NewRequest(http.MethodGet, "/"+config.FirmwareFile, nil))
+			if first.Code != http.StatusOK {
+				t.Fatalf("first download: status %d", first.Code)
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "/"+config.FirmwareFile, nil)
+			for key, values := range tt.header {
+				r.Header[key] = values
+			}
+			w := httptest.NewRecorder()
+			serveFirmware(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestResumeWithoutDownloadCharged(t *testing.T) {
+	useTestFirmware(t, testImage("1.0.0", 'A', 8192))
+	config.DownloadRate, config.DownloadBurst, config.GlobalDownloadRate = 2, 2, 1
+	downloadLimiter.Lock()
+	downloadLimiter.clients, downloadLimiter.global = map[string]*tokenBucket{}, nil
+	downloadLimiter.downloads = map[string]time.Time{}
+	downloadLimiter.Unlock()
+
+	get := func(remoteAddr string, header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/"+config.FirmwareFile, nil)
+		r.RemoteAddr = remoteAddr
+		for key, values := range header {
+			r.Header[key] = values
+		}
+		w := httptest.NewRecorder()
+		serveFirmware(w, r)
+		return w
+	}
+
+	// The first client's download spends the only global token
+	first := get("192.0.2.1:1234", nil)
+	if first.Code != http.StatusOK {
+		t.Fatalf("first download: status %d", first.Code)
+	}
+	resume := http.Header{"Range": {"bytes=1-"}, "If-Range": {first.Header().Get("ETag")}}
+
+	if w := get("198.51.100.7:1234", resume); w.Code != http.StatusTooManyRequests {
+		t.Errorf("resume by a client that never started: status %d, want 429", w.Code)
+	}
+	if w := get("192.0.2.1:1234", resume); w.Code != http.StatusPartialContent {
+		t.Errorf("resume by the downloading client: status %d, want 206", w.Code)
+	}
+
+	// A download the global limit refuses doesn't cost the client a token
+	if w := get("192.0.2.1:1234", nil); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("second download: status %d, want 429", w.Code)
+	}
+	downloadLimiter.Lock()
+	tokens := downloadLimiter.clients["192.0.2.1"].tokens
+	downloadLimiter.Unlock()
+	if math.Round(tokens) != 1 {
+		t.Errorf("client has %.2f tokens left, want 1", tokens)
+	}
+}
+
+func TestDownloadsInProgressCapped(t *testing.T) {
+	downloadLimiter.Lock()
+	downloadLimiter.downloads = map[string]time.Time{}
+	now := time.Now()
+	for i := range maxRateBuckets {
+		downloadLimiter.downloads[fmt.Sprintf("192.0.2.%d \"etag\"", i)] = now.Add(time.Duration(i-maxRateBuckets) * time.Second)
+	}
+	downloadLimiter.Unlock()
+
+	markDownloadInProgress("198.51.100.7", `"etag"`)
+	downloadLimiter.Lock()
+	defer downloadLimiter.Unlock()
+	if n := len(downloadLimiter.downloads); n != maxRateBuckets {
+		t.Errorf("%d downloads tracked, want at most %d", n, maxRateBuckets)
+	}
+	if _, ok := downloadLimiter.downloads[`192.0.2.0 "etag"`]; ok {
+		t.Error("the oldest download wasn't evicted")
+	}
+	if _, ok := downloadLimiter.downloads[`198.51.100.7 "etag"`]; !ok {
+		t.Error("the new download wasn't recorded")
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+)
+
+// readyHandler is the readiness probe: 200 once there is a valid firmware
+// image to serve, 503 before that and while shutting down. /health only
+// says the process is alive. With HEALTH_CHECK_BACKEND a build backend
+// that is down makes it "degraded" rather than not ready, since devices
+// can still download the published firmware.
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	if err := checkReady(); err != nil {
+		http.Error(w, "Not ready: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if config.HealthCheckBackend {
+		if health := buildBackendHealth(); !health.OK {
+			w.Header().Set("X-Build-Backend", "degraded")
+			fmt.Fprintf(w, "Ready (degraded: %s)", health.Error)
+			return
+		}
+	}
+	fmt.Fprintf(w, "Ready")
+}
+
+func checkReady() error {
+	if shuttingDown.Load() {
+		return errors.New("shutting down")
+	}
+
+	obj, err := firmwareStore.Open(config.FirmwareFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return errors.New("no firmware built yet")
+	}
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+
+	// Only validate each published image once, not on every probe
+	state.RLock()
+	validated := state.ValidatedFirmware
+	state.RUnlock()
+	if validated == obj.FirmwareInfo {
+		return nil
+	}
+	if err := validateFirmwareImage(obj.Content, obj.Size); err != nil {
+		slog.Warn("⚠️  Published firmware failed validation", "name", obj.Name, "error", err)
+		return fmt.Errorf("invalid firmware: %w", err)
+	}
+
+	state.Lock()
+	state.ValidatedFirmware = obj.FirmwareInfo
+	state.Unlock()
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// A clone of a large project over a slow link can take a while
+const cloneTimeout = 10 * time.Minute
+
+// isGitCheckout reports whether config.ProjectPath is a git work tree.
+func isGitCheckout() bool {
+	output, err := exec.Command("git", "-C", config.ProjectPath, "rev-parse", "--is-inside-work-tree").Output()
+	return err == nil && strings.TrimSpace(string(output)) == "true"
+}
+
+// ensureRepository makes sure config.ProjectPath is a git checkout, cloning
+// config.GitRepoURL into it if it isn't and one is configured. It reports
+// whether it cloned. Until it succeeds the reason is kept in
+// state.RepositoryError, so the status page says the repository isn't
+// initialized rather than showing git failures. Callers must hold gitCheck
+// once the git monitor is running.
+func ensureRepository() (cloned bool, err error) {
+	defer func() {
+		state.Lock()
+		state.RepositoryError = ""
+		if err != nil {
+			state.RepositoryError = err.Error()
+		}
+		state.Unlock()
+	}()
+	if isGitCheckout() {
+		return false, nil
+	}
+	if config.GitRepoURL == "" {
+		return false, fmt.Errorf("%s is not a git checkout: mount the project there or set GIT_REPO_URL to clone it", config.ProjectPath)
+	}
+	if entries, err := os.ReadDir(config.ProjectPath); err == nil && len(entries) > 0 {
+		return false, fmt.Errorf("%s is not a git checkout and not empty, so %s can't be cloned into it", config.ProjectPath, redactedURL(config.GitRepoURL))
+	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+
+	slog.Info("📥 Cloning repository...", "event", "repo_clone_started", "url", redactedURL(config.GitRepoURL), "branch", config.GitBranch,
+		"path", config.ProjectPath)
+	ctx, cancel := context.WithTimeout(context.Background(), cloneTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, "git", "clone", "--quiet", "--branch", config.GitBranch, "--",
+		config.GitRepoURL, config.ProjectPath).CombinedOutput()
+	if err != nil {
+		return false, fmt.Errorf("git clone %s: %v: %s", redactedURL(config.GitRepoURL), err,
+			strings.TrimSpace(string(output)))
+	}
+	slog.Info("✅ Repository cloned", "event", "repo_cloned", "commit", getCurrentCommit())
+	return true, nil
+}
+
+// redactedURL hides credentials embedded in a repository URL.
+func redactedURL(raw string) string {
+	if u, err := url.Parse(raw); err == nil {
+		return u.Redacted()
+	}
+	return raw
+}
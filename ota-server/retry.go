@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	maxRetryAttempts = 3
+	retryBaseDelay   = 5 * time.Second
+
+	// How much of an attempt's output is searched for network errors
+	retryOutputTail = 16 << 10
+
+	// gitTimeout bounds each git command the monitor runs, so a hung remote
+	// or a stuck lock can't stall it until the watchdog restarts it
+	gitTimeout = 2 * time.Minute
+)
+
+// transientErrorPatterns mark a failed git or docker command (including a
+// builder image pull or a dependency download during the build) as a
+// network problem worth retrying. Compile errors match none of them, so a
+// broken build fails at once.
+var transientErrorPatterns = []string{
+	"could not resolve host",
+	"temporary failure in name resolution",
+	"no such host",
+	"connection timed out",
+	"connection refused",
+	"connection reset",
+	"network is unreachable",
+	"tls handshake timeout",
+	"i/o timeout",
+	"the remote end hung up unexpectedly",
+	"early eof",
+	"rpc failed",
+	"request canceled while waiting for connection",
+	"502 bad gateway",
+	"503 service unavailable",
+	"504 gateway timeout",
+	"toomanyrequests",
+}
+
+// isTransientFailure reports whether output, from a failed command, looks
+// like a network failure.
+func isTransientFailure(output string) bool {
+	output = strings.ToLower(output)
+	for _, pattern := range transientErrorPatterns {
+		if strings.Contains(output, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// retryTransient calls attempt until it succeeds, fails for a reason that
+// isn't transient, or has run maxRetryAttempts times, waiting
+// retryBaseDelay before the first retry and twice as long before each
+// next one. attempt returns the output to check for network errors. It
+// returns the number of attempts made and the last error, or ctx's error
+// if ctx ends during a wait.
+func retryTransient(ctx context.Context, what string, attempt func(n int) (output string, err error)) (int, error) {
+	delay := retryBaseDelay
+	for n := 1; ; n++ {
+		output, err := attempt(n)
+		if err == nil || n == maxRetryAttempts || ctx.Err() != nil || !isTransientFailure(output) {
+			if err == nil && n > 1 {
+				slog.Info("✅ Succeeded after retrying", "event", "retry_succeeded", "operation", what, "attempts", n)
+			}
+			return n, err
+		}
+		slog.Warn("🔁 Network error, retrying", "event", "retry", "operation", what, "attempt", n,
+			"delay", delay, "error", err)
+		select {
+		case <-ctx.Done():
+			return n, ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// gitFetch runs git fetch in the project with args, retrying network
+// failures.
+func gitFetch(args ...string) error {
+	var output []byte
+	_, err := retryTransient(context.Background(), "git fetch", func(int) (string, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), gitTimeout)
+		defer cancel()
+		var err error
+		output, err = exec.CommandContext(ctx, "git", append([]string{"-C", config.ProjectPath, "fetch"}, args...)...).CombinedOutput()
+		return string(output), err
+	})
+	if err != nil {
+		return fmt.Errorf("git fetch: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// runTargetBuildWithRetry runs runTargetBuild again when it fails with a
+// network error, such as a failed builder image pull. Timed-out and
+// aborted builds aren't retried. It also returns the number of attempts.
+func runTargetBuildWithRetry(ctx context.Context, target FirmwareTarget, out io.Writer) (timedOut bool, attempts int, err error) {
+	attempts, err = retryTransient(ctx, "build "+target.Name, func(n int) (string, error) {
+		if n > 1 {
+			fmt.Fprintf(out, "\n==> Network error, retrying build of %s (attempt %d of %d)\n", target.Name, n, maxRetryAttempts)
+		}
+		tail := &tailWriter{max: retryOutputTail}
+		var err error
+		timedOut, err = runTargetBuild(ctx, target, io.MultiWriter(out, tail))
+		if timedOut || errors.Is(err, errBuildAborted) {
+			return "", err
+		}
+		return string(tail.data), err
+	})
+	if err != nil && ctx.Err() != nil && !timedOut {
+		err = errBuildAborted
+	}
+	return timedOut, attempts, err
+}
+
+// tailWriter keeps the last max bytes written to it.
+type tailWriter struct {
+	max  int
+	data []byte
+}
+
+func (t *tailWriter) Write(p []byte) (int, error) {
+	t.data = append(t.data, p...)
+	if over := len(t.data) - t.max; over > 0 {
+		t.data = append([]byte(nil), t.data[over:]...)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// rollbackHandler republishes a retained build as the current firmware.
+// The target is ?commit=<hash>, or "previous" (the default) for the build
+// retained before the one currently served.
+func rollbackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	if !parseSmallForm(w, r) {
+		return
+	}
+
+	target := r.FormValue("commit")
+	if target == "" {
+		target = "previous"
+	}
+	if target != "previous" {
+		var ok bool
+		if target, ok = requireCommitParam(w, "commit", target); !ok {
+			return
+		}
+	}
+
+	// Claim the build slot so no build can publish while we swap
+	state.Lock()
+	if state.BuildInProgress {
+		state.Unlock()
+		http.Error(w, "Build in progress, try again when it completes", http.StatusConflict)
+		return
+	}
+	state.BuildInProgress = true
+	current := state.LastGitCommit
+	state.Unlock()
+
+	defer func() {
+		state.Lock()
+		state.BuildInProgress = false
+		buildDone.Broadcast()
+		state.Unlock()
+	}()
+
+	version, err := resolveRollbackTarget(target, current)
+	if err != nil {
+		http.Error(w, err.Error(), retainedLookupStatus(err))
+		return
+	}
+
+	startTime := time.Now()
+	err = rollbackTo(version)
+	record := BuildRecord{
+		Commit:          version.Commit,
+		Trigger:         buildReasonRollback,
+		StartTime:       startTime,
+		DurationSeconds: time.Since(startTime).Seconds(),
+		Success:         err == nil,
+	}
+	if err != nil {
+		record.Error = err.Error()
+	} else {
+		pinPublished(buildReasonRollback)
+	}
+	state.Lock()
+	record.FirmwareSize = state.FirmwareSize
+	appendBuildRecord(record)
+	state.Unlock()
+	saveState()
+
+	if err != nil {
+		slog.Error("❌ Rollback failed", "event", "rollback_failed", "commit", version.Commit, "error", err)
+		http.Error(w, "Rollback failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	slog.Info("⏪ Rolled back", "event", "rollback", "from", current[:min(8, len(current))],
+		"commit", version.Commit[:min(8, len(version.Commit))], "remote_addr", r.RemoteAddr)
+
+	writeJSON(w, version)
+}
+
+// resolveRollbackTarget finds the retained build named by target. While an
+// uploaded image is served (current is ""), "previous" is the newest
+// retained build.
+func resolveRollbackTarget(target, current string) (RetainedVersion, error) {
+	if target != "previous" {
+		return findRetainedVersion(target)
+	}
+
+	state.RLock()
+	defer state.RUnlock()
+	if current == "" && state.Upload != nil && len(state.RetainedVersions) > 0 {
+		return state.RetainedVersions[len(state.RetainedVersions)-1], nil
+	}
+	if current != "" {
+		i, err := retainedIndex(current)
+		if err != nil {
+			return RetainedVersion{}, err
+		}
+		if i > 0 {
+			return state.RetainedVersions[i-1], nil
+		}
+	}
+	return RetainedVersion{}, errors.New("no previous retained firmware to roll back to")
+}
+
+// rollbackTo publishes the archived build as the current firmware and
+// updates ServerState to describe it.
+func rollbackTo(version RetainedVersion) error {
+	archived, err := firmwareStore.Open(version.Name)
+	if err != nil {
+		return err
+	}
+	defer archived.Close()
+	info := commitInfo(version.Commit)
+	toolchain := historyToolchain(version.Commit)
+
+	firmwareSwap.Lock()
+	defer firmwareSwap.Unlock()
+	if err := firmwareStore.Put(config.FirmwareFile, archived.Content); err != nil {
+		return err
+	}
+	if err := signFirmware(config.FirmwareFile); err != nil {
+		return err
+	}
+	digest, err := currentFirmwareDigest()
+	if err != nil {
+		return err
+	}
+
+	embedded := readFirmwareVersion(archived.Content)
+	writeFirmwareMetadata(FirmwareMetadata{
+		Version:         embedded,
+		Commit:          version.Commit,
+		BuiltAt:         version.BuiltAt,
+		Size:            digest.Size,
+		SHA256:          digest.SHA256,
+		IDFVersion:      toolchain.IDFVersion,
+		CompilerVersion: toolchain.CompilerVersion,
+	})
+
+	state.Lock()
+	defer state.Unlock()
+	state.LastGitCommit, state.LastCommitInfo = version.Commit, info
+	state.Upload = nil
+	state.StableCommit, state.CanaryCommit = version.Commit, ""
+	state.FirmwareSize = digest.Size
+	state.FirmwareVersion = embedded
+	rollNotesForward(embedded)
+	return nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	maxRollouts       = 20
+	maxRolloutDevices = 5000
+
+	// Devices get this long to flash, reboot and confirm through /verify
+	// before an unconfirmed download counts against a rollout
+	rolloutConfirmGrace = 10 * time.Minute
+
+	// A rollout is flagged once this many devices have settled with fewer
+	// than lowConfirmRate of them confirmed
+	minRolloutDevices = 3
+	lowConfirmRate    = 0.8
+)
+
+// Rollout tracks which devices downloaded a build and what they reported
+// through /verify afterwards, by device key (see DeviceDownload.deviceKey).
+type Rollout struct {
+	Commit     string               `json:"commit"`
+	FirstSeen  time.Time            `json:"firstSeen"`
+	Downloaded map[string]time.Time `json:"downloaded"`
+	Confirmed  map[string]time.Time `json:"confirmed,omitempty"`
+	Mismatched map[string]time.Time `json:"mismatched,omitempty"`
+}
+
+// RolloutStats summarises a Rollout for /rollout and the dashboard.
+// Devices still within rolloutConfirmGrace of their download are pending
+// and left out of the confirm rate.
+type RolloutStats struct {
+	Commit      string    `json:"commit"`
+	FirstSeen   time.Time `json:"firstSeen"`
+	Devices     int       `json:"devices"`
+	Confirmed   int       `json:"confirmed"`
+	Mismatched  int       `json:"mismatched"`
+	Pending     int       `json:"pending"`
+	ConfirmRate float64   `json:"confirmRate"`
+	Low         bool      `json:"low"`
+	Unconfirmed []string  `json:"unconfirmed,omitempty"`
+}
+
+// rolloutFor returns the rollout of commit, starting one if needed and
+// dropping the oldest beyond maxRollouts. Callers must hold state.Lock.
+func rolloutFor(commit string) *Rollout {
+	commit = commit[:min(8, len(commit))]
+	for _, ro := range state.Rollouts {
+		if ro.Commit == commit {
+			return ro
+		}
+	}
+	ro := &Rollout{Commit: commit, FirstSeen: time.Now(), Downloaded: map[string]time.Time{}}
+	state.Rollouts = append(state.Rollouts, ro)
+	if over := len(state.Rollouts) - maxRollouts; over > 0 {
+		state.Rollouts = append([]*Rollout(nil), state.Rollouts[over:]...)
+	}
+	return ro
+}
+
+// requestDeviceKey identifies the device making r, like deviceKey.
+func requestDeviceKey(r *http.Request) string {
+	return DeviceDownload{RemoteAddr: r.RemoteAddr, DeviceID: deviceID(r)}.deviceKey()
+}
+
+// recordRolloutDownload counts a completed download of commit's build.
+func recordRolloutDownload(r *http.Request, commit string) {
+	if commit == "" {
+		return
+	}
+	key := requestDeviceKey(r)
+	state.Lock()
+	defer state.Unlock()
+	ro := rolloutFor(commit)
+	if _, seen := ro.Downloaded[key]; seen || len(ro.Downloaded) < maxRolloutDevices {
+		ro.Downloaded[key] = time.Now()
+	}
+}
+
+// recordRolloutVerify records a device's /verify report for commit's
+// build; its latest report counts. A device that confirms without a
+// recorded download (e.g. from before a restart, or a delta update) is
+// counted as having downloaded it.
+func recordRolloutVerify(r *http.Request, commit string, match bool) {
+	if commit == "" {
+		return
+	}
+	key := requestDeviceKey(r)
+	state.Lock()
+	defer state.Unlock()
+	ro := rolloutFor(commit)
+	if _, seen := ro.Downloaded[key]; !seen {
+		if len(ro.Downloaded) >= maxRolloutDevices {
+			return
+		}
+		ro.Downloaded[key] = time.Now()
+	}
+	if ro.Confirmed == nil {
+		ro.Confirmed, ro.Mismatched = map[string]time.Time{}, map[string]time.Time{}
+	}
+	delete(ro.Confirmed, key)
+	delete(ro.Mismatched, key)
+	if match {
+		ro.Confirmed[key] = time.Now()
+	} else {
+		ro.Mismatched[key] = time.Now()
+	}
+}
+
+// stats summarises the rollout as of now. Callers must hold state.RLock.
+func (ro *Rollout) stats(now time.Time) RolloutStats {
+	s := RolloutStats{
+		Commit:     ro.Commit,
+		FirstSeen:  ro.FirstSeen,
+		Devices:    len(ro.Downloaded),
+		Confirmed:  len(ro.Confirmed),
+		Mismatched: len(ro.Mismatched),
+	}
+	for key, at := range ro.Downloaded {
+		if _, ok := ro.Confirmed[key]; ok {
+			continue
+		}
+		if _, ok := ro.Mismatched[key]; !ok && now.Sub(at) < rolloutConfirmGrace {
+			s.Pending++
+			continue
+		}
+		s.Unconfirmed = append(s.Unconfirmed, key)
+	}
+	sort.Strings(s.Unconfirmed)
+	if settled := s.Devices - s.Pending; settled > 0 {
+		s.ConfirmRate = float64(s.Confirmed) / float64(settled)
+		s.Low = settled >= minRolloutDevices && s.ConfirmRate < lowConfirmRate
+	}
+	return s
+}
+
+// lowRollouts returns the rollouts with a low confirm rate, newest first.
+// Callers must hold state.RLock.
+func lowRollouts() []RolloutStats {
+	var low []RolloutStats
+	now := time.Now()
+	for i := len(state.Rollouts) - 1; i >= 0; i-- {
+		if s := state.Rollouts[i].stats(now); s.Low {
+			low = append(low, s)
+		}
+	}
+	return low
+}
+
+// rolloutHandler serves /rollout/<commit> with the stats of that build's
+// rollout, or /rollout with every tracked rollout, newest first.
+func rolloutHandler(w http.ResponseWriter, r *http.Request) {
+	commit := strings.ToLower(strings.Trim(strings.TrimPrefix(r.URL.Path, "/rollout"), "/"))
+	now := time.Now()
+
+	if commit != "" {
+		if _, ok := requireCommitParam(w, "commit", commit); !ok {
+			return
+		}
+	}
+
+	state.RLock()
+	all := make([]RolloutStats, 0, len(state.Rollouts))
+	var match *RolloutStats
+	for i := len(state.Rollouts) - 1; i >= 0 && match == nil; i-- {
+		ro := state.Rollouts[i]
+		switch {
+		case commit == "":
+			all = append(all, ro.stats(now))
+		case strings.HasPrefix(commit, ro.Commit) || strings.HasPrefix(ro.Commit, commit):
+			s := ro.stats(now)
+			match = &s
+		}
+	}
+	state.RUnlock()
+
+	switch {
+	case commit == "":
+		writeJSON(w, all)
+	case match != nil:
+		writeJSON(w, match)
+	default:
+		http.Error(w, "No downloads recorded for commit "+commit, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	selfTestStageTimeout = 2 * time.Minute
+
+	// Scratch directory on the firmware volume for the self-test build
+	selfTestOutputDir = ".selftest-build"
+)
+
+// SelfTestStage is the outcome of one step of the self-test.
+type SelfTestStage struct {
+	Name     string `json:"name"`
+	Passed   bool   `json:"passed"`
+	Detail   string `json:"detail"`
+	Duration string `json:"duration"`
+}
+
+// SelfTestReport is returned by POST /selftest.
+type SelfTestReport struct {
+	Passed bool            `json:"passed"`
+	Stages []SelfTestStage `json:"stages"`
+}
+
+// selfTestHandler exercises every part of the build pipeline without
+// touching the live firmware: git remote access, Docker, the builder image,
+// a real build of the checkout, firmware directory writes, and hashing.
+func selfTestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	slog.Info("🧪 Self-test requested", "event", "selftest", "remote_addr", r.RemoteAddr)
+
+	stages := []struct {
+		name    string
+		run     func(ctx context.Context) (string, error)
+		timeout time.Duration
+	}{
+		{"git", selfTestGit, selfTestStageTimeout},
+		{"docker", selfTestDocker, selfTestStageTimeout},
+		{"build", selfTestBuild, config.BuildTimeout},
+		{"firmware directory", selfTestFirmwareDir, selfTestStageTimeout},
+		{"hash", selfTestHash, selfTestStageTimeout},
+	}
+
+	report := SelfTestReport{Passed: true}
+	for _, stage := range stages {
+		ctx, cancel := context.WithTimeout(r.Context(), stage.timeout)
+		start := time.Now()
+		detail, err := stage.run(ctx)
+		cancel()
+
+		result := SelfTestStage{Name: stage.name, Passed: err == nil, Detail: detail, Duration: time.Since(start).Round(time.Millisecond).String()}
+		if err != nil {
+			result.Detail = err.Error()
+			report.Passed = false
+			slog.Error("❌ Self-test stage failed", "stage", stage.name, "error", err)
+		} else {
+			slog.Info("✅ Self-test stage passed", "stage", stage.name, "detail", detail)
+		}
+		report.Stages = append(report.Stages, result)
+	}
+
+	status := http.StatusOK
+	if !report.Passed {
+		status = http.StatusInternalServerError
+	}
+	writeJSONStatus(w, status, report)
+}
+
+// runStage runs a command and returns its trimmed output, folding the
+// output into the error on failure.
+func runStage(ctx context.Context, name string, args ...string) (string, error) {
+	output, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	out := strings.TrimSpace(string(output))
+	if err != nil {
+		return "", fmt.Errorf("%s %s: %v: %s", name, args[0], err, out)
+	}
+	return out, nil
+}
+
+func selfTestGit(ctx context.Context) (string, error) {
+	out, err := runStage(ctx, "git", "-C", config.ProjectPath, "ls-remote", "--heads", "origin", config.GitBranch)
+	if err != nil {
+		return "", err
+	}
+	if out == "" {
+		return "", fmt.Errorf("branch %s not found on origin", config.GitBranch)
+	}
+	commit, _, _ := strings.Cut(out, "\t")
+	return fmt.Sprintf("origin/%s at %s", config.GitBranch, commit[:min(8, len(commit))]), nil
+}
+
+func selfTestDocker(ctx context.Context) (string, error) {
+	if config.BuildBackend == buildBackendLocal {
+		return "local build backend, skipped", nil
+	}
+	image := config.Targets[0].Image
+	version, err := runStage(ctx, "docker", "info", "--format", "{{.ServerVersion}}")
+	if err != nil {
+		return "", err
+	}
+	if _, err := runStage(ctx, "docker", "image", "inspect", image); err != nil {
+		return "", fmt.Errorf("builder image %s missing (run make build-builder): %w", image, err)
+	}
+	return "Docker " + version + ", " + image + " image present", nil
+}
+
+// selfTestBuild builds the primary target from the checkout into a scratch
+// directory on the firmware volume and validates the image, so nothing is
+// published. It doesn't wait for a running build and is skipped instead.
+func selfTestBuild(ctx context.Context) (string, error) {
+	if !dockerHost.TryLock() {
+		return "build in progress, skipped", nil
+	}
+	defer dockerHost.Unlock()
+	scratch := filepath.Join(config.FirmwarePath, selfTestOutputDir)
+	defer os.RemoveAll(scratch)
+
+	target := config.Targets[0]
+	target.OutputDir = selfTestOutputDir
+	output := &tailWriter{max: retryOutputTail}
+	if _, err := runTargetBuild(ctx, target, output); err != nil {
+		return "", fmt.Errorf("build %s: %v: %s", target.Name, err, lastLines(string(output.data), notifyOutputLines))
+	}
+
+	image, err := os.Open(filepath.Join(scratch, target.Output))
+	if err != nil {
+		return "", err
+	}
+	defer image.Close()
+	info, err := image.Stat()
+	if err != nil {
+		return "", err
+	}
+	if err := validateFirmwareImage(image, info.Size()); err != nil {
+		return "", fmt.Errorf("build %s produced an invalid image: %w", target.Name, err)
+	}
+	commit := getCurrentCommit()
+	return fmt.Sprintf("built %s at %s, %d byte image is valid", target.Name, commit[:min(8, len(commit))], info.Size()), nil
+}
+
+func selfTestFirmwareDir(ctx context.Context) (string, error) {
+	probe, err := os.CreateTemp(config.FirmwarePath, ".selftest-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(probe.Name())
+	defer probe.Close()
+
+	if _, err := probe.WriteString("selftest"); err != nil {
+		return "", err
+	}
+	if err := probe.Sync(); err != nil {
+		return "", err
+	}
+	return config.FirmwarePath + " is writable", nil
+}
+
+func selfTestHash(ctx context.Context) (string, error) {
+	digest, err := currentFirmwareDigest()
+	if errors.Is(err, fs.ErrNotExist) {
+		return "no firmware built yet, skipped", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if _, err := chunkManifest(config.FirmwareFile); err != nil {
+		return "", err
+	}
+	return "sha256 " + digest.SHA256, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSelfTestBuild(t *testing.T) {
+	tests := []struct {
+		name    string
+		image   []byte
+		script  string
+		wantErr string
+	}{
+		{name: "valid image", image: testImage("2.0.0", 'B', 4096), script: `cp "$IMAGE" "$OUTPUT"`},
+		{name: "corrupt image", image: []byte("not firmware"), script: `cp "$IMAGE" "$OUTPUT"`,
+			wantErr: "invalid image"},
+		{name: "failed build", script: `echo "undefined reference to app_main"; exit 1`,
+			wantErr: "undefined reference to app_main"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			live := testImage("1.0.0", 'A', 4096)
+			dir := useTestFirmware(t, live)
+			imagePath := filepath.Join(t.TempDir(), "image.bin")
+			if err := os.WriteFile(imagePath, tt.image, 0644); err != nil {
+				t.Fatal(err)
+			}
+			config.BuildBackend = buildBackendLocal
+			config.Targets = []FirmwareTarget{{Name: "beacon", Output: config.FirmwareFile,
+				Command: []string{"sh", "-c", tt.script}, Env: []string{"IMAGE=" + imagePath}}}
+
+			detail, err := selfTestBuild(context.Background())
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("self-test build failed: %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+			case tt.wantErr == "" && !strings.Contains(detail, "image is valid"):
+				t.Errorf("detail %q doesn't report the image", detail)
+			}
+
+			if _, err := os.Stat(filepath.Join(dir, selfTestOutputDir)); !os.IsNotExist(err) {
+				t.Errorf("scratch directory left behind: %v", err)
+			}
+			published, err := os.ReadFile(filepath.Join(dir, config.FirmwareFile))
+			if err != nil || string(published) != string(live) {
+				t.Errorf("live firmware changed by the self-test")
+			}
+		})
+	}
+}
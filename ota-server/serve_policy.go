@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Policies for firmware requests that arrive while a build is running.
+const (
+	servePolicyServeOld = "serve-old" // serve the current file immediately
+	servePolicyHold     = "hold"      // wait for the build, then serve
+	servePolicyReject   = "reject"    // 503 with Retry-After
+)
+
+const defaultHoldTimeout = 2 * time.Minute
+
+// buildDone is broadcast whenever a build finishes, waking held downloads.
+var buildDone = sync.NewCond(state)
+
+// resolveServePolicy defaults and checks the build serve policy.
+func resolveServePolicy(cfg *Config) error {
+	switch cfg.BuildServePolicy {
+	case "":
+		cfg.BuildServePolicy = servePolicyServeOld
+	case servePolicyServeOld, servePolicyHold, servePolicyReject:
+	default:
+		return fmt.Errorf("build serve policy must be %q, %q or %q, got %q",
+			servePolicyServeOld, servePolicyHold, servePolicyReject, cfg.BuildServePolicy)
+	}
+	return nil
+}
+
+// waitForBuild blocks until no build is in progress, timeout elapses or ctx
+// is done, and reports whether the build finished.
+func waitForBuild(ctx context.Context, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	stop := context.AfterFunc(ctx, func() {
+		state.Lock()
+		buildDone.Broadcast()
+		state.Unlock()
+	})
+	defer stop()
+
+	state.Lock()
+	defer state.Unlock()
+	for state.BuildInProgress && ctx.Err() == nil {
+		buildDone.Wait()
+	}
+	return !state.BuildInProgress
+}
+
+// applyServePolicy enforces the build serve policy for a firmware request.
+// It returns false if the request has already been answered, or if the
+// client went away while it was held.
+func applyServePolicy(w http.ResponseWriter, r *http.Request) bool {
+	state.RLock()
+	building := state.BuildInProgress
+	state.RUnlock()
+	if !building {
+		return true
+	}
+
+	switch config.BuildServePolicy {
+	case servePolicyReject:
+		slog.Info("⏳ Rejecting firmware request: build in progress", "event", "download_rejected", "remote_addr", r.RemoteAddr)
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "Firmware build in progress, retry later", http.StatusServiceUnavailable)
+		return false
+	case servePolicyHold:
+		timeout := config.BuildHoldTimeout
+		slog.Info("⏳ Holding firmware request until build completes", "remote_addr", r.RemoteAddr, "timeout", timeout)
+		finished := waitForBuild(r.Context(), timeout)
+		if r.Context().Err() != nil {
+			slog.Info("🔌 Held firmware request abandoned by client", "remote_addr", r.RemoteAddr)
+			return false
+		}
+		if !finished {
+			slog.Warn("⚠️  Build still running, serving current firmware", "remote_addr", r.RemoteAddr, "waited", timeout)
+		}
+	}
+	return true
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHeldDownloads(t *testing.T) {
+	tests := []struct {
+		name       string
+		finish     bool // the build finishes while the request is held
+		disconnect bool // the client goes away while the request is held
+		timeout    time.Duration
+		want       int
+	}{
+		{name: "build finishes", finish: true, timeout: time.Minute, want: http.StatusOK},
+		{name: "hold times out", timeout: 50 * time.Millisecond, want: http.StatusOK},
+		{name: "client disconnects", disconnect: true, timeout: time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestFirmware(t, testImage("1.0.0", 'A', 4096))
+			config.BuildServePolicy, config.BuildHoldTimeout = servePolicyHold, tt.timeout
+			state.Lock()
+			state.BuildInProgress = true
+			state.Unlock()
+			t.Cleanup(func() {
+				state.Lock()
+				state.BuildInProgress = false
+				state.Unlock()
+			})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			w := httptest.NewRecorder()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				serveFirmware(w, httptest.NewRequest(http.MethodGet, "/"+config.FirmwareFile, nil).WithContext(ctx))
+			}()
+
+			time.Sleep(20 * time.Millisecond)
+			switch {
+			case tt.finish:
+				state.Lock()
+				state.BuildInProgress = false
+				buildDone.Broadcast()
+				state.Unlock()
+			case tt.disconnect:
+				cancel()
+			}
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("request still held")
+			}
+			if tt.disconnect {
+				if w.Body.Len() != 0 {
+					t.Errorf("abandoned request was answered with %d bytes", w.Body.Len())
+				}
+			} else if w.Code != tt.want {
+				t.Errorf("status %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
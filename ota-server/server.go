@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// Admin POSTs carry at most a few short form fields.
+const maxFormBytes = 4 << 10
+
+// newHTTPServer returns a server with the configured timeouts, so clients
+// that stall mid-request or sit on idle connections can't hold resources
+// forever. The write timeout has to cover a full firmware download by a
+// slow device; streaming handlers lift it with streamWithoutDeadline.
+func newHTTPServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: config.HTTPReadHeaderTimeout,
+		ReadTimeout:       config.HTTPReadTimeout,
+		WriteTimeout:      config.HTTPWriteTimeout,
+		IdleTimeout:       config.HTTPIdleTimeout,
+	}
+}
+
+// streamWithoutDeadline clears the write timeout for a response that stays
+// open until the client leaves, such as /events and /logs?follow=1.
+func streamWithoutDeadline(w http.ResponseWriter) {
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+}
+
+// parseSmallForm parses a form-encoded request body of at most
+// maxFormBytes, answering 413 or 400 and returning false when it can't.
+func parseSmallForm(w http.ResponseWriter, r *http.Request) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, maxFormBytes)
+	err := r.ParseForm()
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return false
+	case err != nil:
+		http.Error(w, "Invalid form: "+err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+	"time"
+)
+
+// The server's own release, set at build time with
+//
+//	go build -ldflags "-X main.serverVersion=1.4.0 -X main.serverCommit=$(git rev-parse --short HEAD)"
+//
+// Without -X, the commit falls back to the VCS stamp the go tool embeds
+// when building inside a git checkout.
+var (
+	serverVersion = "dev"
+	serverCommit  = ""
+)
+
+// serverStarted is when the process started, recorded first thing in main.
+var serverStarted time.Time
+
+// ServerInfo describes the running OTA server, not the firmware it serves.
+type ServerInfo struct {
+	Version       string `json:"version"`
+	Commit        string `json:"commit,omitempty"`
+	Started       string `json:"started"`
+	Uptime        string `json:"uptime"`
+	UptimeSeconds int64  `json:"uptimeSeconds"`
+}
+
+func serverInfo(now time.Time) ServerInfo {
+	uptime := now.Sub(serverStarted).Round(time.Second)
+	return ServerInfo{
+		Version:       serverVersion,
+		Commit:        serverBuildCommit(),
+		Started:       serverStarted.Format(time.RFC3339),
+		Uptime:        uptime.String(),
+		UptimeSeconds: int64(uptime.Seconds()),
+	}
+}
+
+// serverBuildCommit is serverCommit, or the embedded VCS revision (marked
+// "-dirty" for a modified tree) when it wasn't set.
+func serverBuildCommit() string {
+	if serverCommit != "" {
+		return serverCommit
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	var revision, modified string
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			modified = setting.Value
+		}
+	}
+	if revision = revision[:min(8, len(revision))]; revision != "" && modified == "true" {
+		revision += "-dirty"
+	}
+	return revision
+}
+
+// String is the dashboard's one-line summary, e.g. "1.4.0 (3f2a9c1e), up 2h5m0s".
+func (s ServerInfo) String() string {
+	if s.Commit == "" {
+		return fmt.Sprintf("%s, up %s", s.Version, s.Uptime)
+	}
+	return fmt.Sprintf("%s (%s), up %s", s.Version, s.Commit, s.Uptime)
+}
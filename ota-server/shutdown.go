@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// shuttingDown stops new builds from starting once a shutdown has begun.
+var shuttingDown atomic.Bool
+
+// serveUntilSignal runs the servers until SIGINT or SIGTERM, then stops
+// accepting connections, lets in-flight downloads finish and waits for a
+// running build, all within config.ShutdownTimeout. Servers with a
+// TLSConfig serve HTTPS.
+func serveUntilSignal(servers ...*http.Server) error {
+	errs := make(chan error, len(servers))
+	for _, server := range servers {
+		server.RegisterOnShutdown(state.Events.closeAll)
+		go func() {
+			if server.TLSConfig != nil {
+				errs <- server.ListenAndServeTLS("", "")
+			} else {
+				errs <- server.ListenAndServe()
+			}
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-signals:
+		slog.Info("🛑 Shutting down", "event", "shutdown", "signal", sig.String(), "grace_period", config.ShutdownTimeout)
+	}
+	shuttingDown.Store(true)
+
+	deadline := time.Now().Add(config.ShutdownTimeout)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	var shutdown sync.WaitGroup
+	for _, server := range servers {
+		shutdown.Add(1)
+		go func() {
+			defer shutdown.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				slog.Warn("⚠️  HTTP shutdown incomplete, dropping remaining connections", "addr", server.Addr, "error", err)
+				server.Close()
+			}
+		}()
+	}
+	shutdown.Wait()
+	slog.Info("✅ In-flight requests finished")
+
+	state.RLock()
+	building := state.BuildInProgress
+	state.RUnlock()
+	if building {
+		remaining := time.Until(deadline)
+		slog.Info("⏳ Waiting for the running build to finish...", "timeout", remaining.Round(time.Second))
+		if !waitForBuild(context.Background(), remaining) {
+			slog.Warn("⚠️  Exiting with a build still running")
+		}
+	}
+	// Keep rollout stats gathered since the last build
+	saveState()
+	slog.Info("👋 Shutdown complete")
+
+	return nil
+}
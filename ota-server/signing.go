@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// signingKey signs published firmware. It is nil, and signing disabled,
+// unless config.SigningKey names a key file.
+var signingKey ed25519.PrivateKey
+
+// loadSigningKey reads a PKCS#8 PEM Ed25519 private key, as written by
+// `openssl genpkey -algorithm ed25519`.
+func loadSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("%s: expected a PEM \"PRIVATE KEY\" block", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	ed, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 key (%T)", path, key)
+	}
+	return ed, nil
+}
+
+// signatureName is the store name of the detached signature for name.
+func signatureName(name string) string {
+	return name + ".sig"
+}
+
+// signFirmware writes a detached Ed25519 signature of the stored image
+// name as name.sig. It is a no-op while signing is disabled.
+func signFirmware(name string) error {
+	if signingKey == nil {
+		return nil
+	}
+	obj, err := firmwareStore.Open(name)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+
+	image, err := io.ReadAll(io.NewSectionReader(obj.Content, 0, obj.Size))
+	if err != nil {
+		return err
+	}
+	sig := ed25519.Sign(signingKey, image)
+	if err := firmwareStore.Put(signatureName(name), bytes.NewReader(sig)); err != nil {
+		return err
+	}
+	slog.Info("🔏 Signed firmware", "name", name)
+	return nil
+}
+
+// signedImageName maps a /firmware/<name>.sig request to a published image:
+// a target's output or name, or a retained archive.
+func signedImageName(name string) (string, bool) {
+	if target, _, ok := findTarget(strings.TrimSuffix(name, ".bin")); ok {
+		return target.Output, true
+	}
+	for _, t := range config.Targets {
+		if t.Output == name {
+			return name, true
+		}
+	}
+	state.RLock()
+	defer state.RUnlock()
+	for _, v := range state.RetainedVersions {
+		if v.Name == name {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// serveSignature serves the detached signature of a published image.
+func serveSignature(w http.ResponseWriter, r *http.Request, name string) {
+	image, ok := signedImageName(name)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	obj, err := firmwareStore.Open(signatureName(image))
+	if errors.Is(err, fs.ErrNotExist) {
+		http.Error(w, "No signature for "+image, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("❌ Failed to open signature", "name", image, "error", err)
+		http.Error(w, "Failed to read signature", http.StatusInternalServerError)
+		return
+	}
+	defer obj.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, signatureName(image), obj.ModTime, obj.Content)
+}
+
+// pubkeyHandler serves the public half of the signing key as PEM, or as
+// hex with ?format=hex for embedding in device code.
+func pubkeyHandler(w http.ResponseWriter, r *http.Request) {
+	if signingKey == nil {
+		http.Error(w, "Firmware signing is not configured", http.StatusNotFound)
+		return
+	}
+	pub := signingKey.Public().(ed25519.PublicKey)
+
+	if r.URL.Query().Get("format") == "hex" {
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintln(w, hex.EncodeToString(pub))
+		return
+	}
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		http.Error(w, "Failed to encode public key", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	pem.Encode(w, &pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// OTA partition labels from partitions_ota.csv. The bootloader runs one
+// slot while the other receives the next image.
+var otaSlots = [2]string{"ota_0", "ota_1"}
+
+// SlotAssignment is the build intended for one OTA partition.
+type SlotAssignment struct {
+	Label  string `json:"label"`
+	Commit string `json:"commit,omitempty"`
+	Active bool   `json:"active"`
+}
+
+// activeSlot returns the active slot label, defaulting to the first.
+// Callers must hold state.RLock.
+func activeSlot() string {
+	if state.ActiveSlot == "" {
+		return otaSlots[0]
+	}
+	return state.ActiveSlot
+}
+
+// inactiveSlot returns the slot that receives the next image. Callers must
+// hold state.RLock.
+func inactiveSlot() string {
+	if activeSlot() == otaSlots[0] {
+		return otaSlots[1]
+	}
+	return otaSlots[0]
+}
+
+func validSlot(label string) bool {
+	return label == otaSlots[0] || label == otaSlots[1]
+}
+
+// slotAssignments lists both slots for /status. Callers must hold
+// state.RLock.
+func slotAssignments() []SlotAssignment {
+	assignments := make([]SlotAssignment, 0, len(otaSlots))
+	for _, label := range otaSlots {
+		assignments = append(assignments, SlotAssignment{
+			Label:  label,
+			Commit: state.Slots[label],
+			Active: label == activeSlot(),
+		})
+	}
+	return assignments
+}
+
+// slotHolds reports whether either slot is assigned the build of commit,
+// which may be abbreviated. Callers must hold state.RLock.
+func slotHolds(commit string) bool {
+	for _, assigned := range state.Slots {
+		if assigned != "" && strings.HasPrefix(assigned, commit) {
+			return true
+		}
+	}
+	return false
+}
+
+// assignSlot tags a newly archived build for the inactive slot, so devices
+// flashing that partition get it. The active slot keeps its build until
+// /promote swaps them.
+func assignSlot(commit string) {
+	state.Lock()
+	if state.Slots == nil {
+		state.Slots = make(map[string]string)
+	}
+	slot := inactiveSlot()
+	state.Slots[slot] = commit
+	state.Unlock()
+	slog.Info("🅰️  Build assigned to OTA slot", "event", "slot_assigned", "slot", slot, "commit", commit[:min(8, len(commit))])
+}
+
+// slotFirmwareHandler serves /firmware?slot=<label>: the build assigned to
+// that partition. slot=inactive names whichever slot isn't active, for
+// devices that don't track their own partition.
+func slotFirmwareHandler(w http.ResponseWriter, r *http.Request) {
+	slot := r.URL.Query().Get("slot")
+	state.RLock()
+	if slot == "inactive" {
+		slot = inactiveSlot()
+	}
+	commit := state.Slots[slot]
+	state.RUnlock()
+
+	if !validSlot(slot) {
+		http.Error(w, "slot must be ota_0, ota_1 or inactive", http.StatusBadRequest)
+		return
+	}
+	if commit == "" {
+		http.Error(w, "No build assigned to slot "+slot, http.StatusNotFound)
+		return
+	}
+
+	// Serve it as the pinned archived build
+	query := r.URL.Query()
+	query.Set("commit", commit)
+	pinned := r.Clone(r.Context())
+	pinned.URL.RawQuery = query.Encode()
+	w.Header().Set("X-OTA-Slot", slot)
+	serveFirmware(w, pinned)
+}
+
+// promoteSlot makes slot the active one, so the next build goes to the
+// other partition.
+func promoteSlot(w http.ResponseWriter, r *http.Request, slot string) {
+	if !validSlot(slot) {
+		http.Error(w, "slot must be ota_0 or ota_1", http.StatusBadRequest)
+		return
+	}
+
+	state.Lock()
+	commit := state.Slots[slot]
+	if commit == "" {
+		state.Unlock()
+		http.Error(w, "No build assigned to slot "+slot, http.StatusConflict)
+		return
+	}
+	previous := activeSlot()
+	state.ActiveSlot = slot
+	state.Unlock()
+	saveState()
+
+	slog.Info("🔀 Active OTA slot changed", "event", "slot_promoted", "slot", slot, "previous", previous,
+		"commit", commit[:min(8, len(commit))], "remote_addr", r.RemoteAddr)
+	writeJSON(w, map[string]string{"active": slot, "previous": previous, "commit": commit})
+}
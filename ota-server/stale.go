@@ -0,0 +1,58 @@
+package main
+
+import (
+	"log/slog"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultStaleAfter = 24 * time.Hour
+
+// firmwareStale reports whether origin has had commits the served firmware
+// doesn't include for longer than config.StaleAfter. Callers must hold
+// state.RLock.
+func firmwareStale() bool {
+	return state.CommitsBehind > 0 && time.Since(state.OldestUnbuiltCommit) > config.StaleAfter
+}
+
+// updateStaleness counts the commits on origin/<branch> that the served
+// firmware doesn't include and notes when the oldest of them was made. It
+// reads the remote-tracking ref left by fetchUpdates, so it doesn't touch
+// the network.
+func updateStaleness() {
+	state.RLock()
+	served := state.LastGitCommit
+	state.RUnlock()
+	if served == "" {
+		// Nothing built yet; the first build will settle it
+		return
+	}
+
+	// Committer timestamps of unbuilt commits, oldest first
+	output, err := exec.Command("git", "-C", config.ProjectPath, "log", "--format=%ct", "--reverse",
+		served+"..refs/remotes/origin/"+config.GitBranch).Output()
+	if err != nil {
+		slog.Debug("🔍 Could not compare firmware with origin", "error", err)
+		return
+	}
+	times := strings.Fields(string(output))
+
+	state.Lock()
+	wasStale := firmwareStale()
+	state.CommitsBehind = len(times)
+	state.OldestUnbuiltCommit = time.Time{}
+	if len(times) > 0 {
+		if sec, err := strconv.ParseInt(times[0], 10, 64); err == nil {
+			state.OldestUnbuiltCommit = time.Unix(sec, 0)
+		}
+	}
+	stale, behind, oldest := firmwareStale(), state.CommitsBehind, state.OldestUnbuiltCommit
+	state.Unlock()
+
+	if stale && !wasStale {
+		slog.Warn("🕰️  Served firmware is stale", "event", "firmware_stale", "commits_behind", behind,
+			"oldest_unbuilt", oldest.Format(time.RFC3339), "threshold", config.StaleAfter)
+	}
+}
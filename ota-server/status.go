@@ -0,0 +1,121 @@
+package main
+
+import "time"
+
+// StatusResponse is the /status JSON document. Field names are relied on
+// by external dashboards; add new fields rather than renaming existing ones.
+type StatusResponse struct {
+	LastCommit             string                  `json:"lastCommit"`
+	LastCommitSubject      string                  `json:"lastCommitSubject"`
+	LastCommitAuthor       string                  `json:"lastCommitAuthor"`
+	LastCommitDate         string                  `json:"lastCommitDate"`
+	LastBuild              string                  `json:"lastBuild"`
+	LastCheck              string                  `json:"lastCheck"`
+	NextCheck              string                  `json:"nextCheck"`
+	NextCheckIn            string                  `json:"nextCheckIn"`
+	BuildInProgress        bool                    `json:"buildInProgress"`
+	FirmwareSize           int64                   `json:"firmwareSize"`
+	FirmwareSizeLimit      int64                   `json:"firmwareSizeLimit"`
+	FirmwareSizePercent    float64                 `json:"firmwareSizePercent"`
+	FirmwareSizeWarning    string                  `json:"firmwareSizeWarning,omitempty"`
+	BuildError             string                  `json:"buildError"`
+	FirmwareVersion        string                  `json:"firmwareVersion"`
+	FirmwareChecksum       string                  `json:"firmwareChecksum"`
+	FirmwareMD5            string                  `json:"firmwareMD5"`
+	IDFVersion             string                  `json:"idfVersion"`
+	CompilerVersion        string                  `json:"compilerVersion"`
+	ToolchainWarning       string                  `json:"toolchainWarning"`
+	MonitorLastActive      string                  `json:"monitorLastActive"`
+	MonitorRestarts        int                     `json:"monitorRestarts"`
+	LastPrune              string                  `json:"lastPrune"`
+	LastPruneReclaimed     string                  `json:"lastPruneReclaimed"`
+	BuildServePolicy       string                  `json:"buildServePolicy"`
+	Licenses               map[string]LicenseUsage `json:"licenses"`
+	RetainedVersions       []RetainedVersion       `json:"retainedVersions"`
+	DownloadsCompleted     int                     `json:"downloadsCompleted"`
+	DownloadsClientAborted int                     `json:"downloadsClientAborted"`
+	DownloadWriteErrors    int                     `json:"downloadWriteErrors"`
+	StableCommit           string                  `json:"stableCommit"`
+	CanaryCommit           string                  `json:"canaryCommit"`
+	CanaryPercent          int                     `json:"canaryPercent"`
+	Targets                []TargetStatus          `json:"targets"`
+	Devices                []DeviceDownload        `json:"devices"`
+	BuildQueue             []BuildRequest          `json:"buildQueue"`
+	DiskFree               []DiskSpace             `json:"diskFree"`
+	CommitsBehind          int                     `json:"commitsBehind"`
+	Stale                  bool                    `json:"stale"`
+	Slots                  []SlotAssignment        `json:"slots"`
+	Channels               []ChannelStatus         `json:"channels"`
+	BuildDurations         BuildDurations          `json:"buildDurations"`
+	Maintenance            Maintenance             `json:"maintenance"`
+	TargetBuildTime        TargetBuildTime         `json:"targetBuildTime"`
+	RepositoryError        string                  `json:"repositoryError,omitempty"`
+	Pin                    *PublishPin             `json:"pin,omitempty"`
+	Upload                 *UploadInfo             `json:"upload,omitempty"`
+	BuildBackend           *BackendHealth          `json:"buildBackend,omitempty"`
+
+	// The OTA server process itself, not the firmware
+	Server ServerInfo `json:"server"`
+}
+
+// newStatusResponse snapshots ServerState. Callers must hold state.RLock.
+func newStatusResponse() StatusResponse {
+	sizePercent, sizeWarning := firmwareSizeUsage(state.FirmwareSize)
+	status := StatusResponse{
+		LastCommit:             state.LastGitCommit,
+		LastCommitSubject:      state.LastCommitInfo.Subject,
+		LastCommitAuthor:       state.LastCommitInfo.Author,
+		LastCommitDate:         state.LastCommitInfo.Date.Format(time.RFC3339),
+		LastBuild:              state.LastBuildTime.Format(time.RFC3339),
+		LastCheck:              state.LastCheckTime.Format(time.RFC3339),
+		NextCheck:              state.NextCheckTime.Format(time.RFC3339),
+		NextCheckIn:            nextCheckIn(time.Now()),
+		BuildInProgress:        state.BuildInProgress,
+		FirmwareSize:           state.FirmwareSize,
+		FirmwareSizeLimit:      config.MaxFirmwareSize,
+		FirmwareSizePercent:    sizePercent,
+		FirmwareSizeWarning:    sizeWarning,
+		BuildError:             state.BuildError,
+		FirmwareVersion:        state.FirmwareVersion,
+		FirmwareChecksum:       state.FirmwareChecksum.SHA256,
+		FirmwareMD5:            state.FirmwareChecksum.MD5,
+		IDFVersion:             state.Toolchain.IDFVersion,
+		CompilerVersion:        state.Toolchain.CompilerVersion,
+		ToolchainWarning:       state.ToolchainWarning,
+		MonitorLastActive:      state.MonitorLastActive.Format(time.RFC3339),
+		MonitorRestarts:        state.MonitorRestarts,
+		LastPrune:              state.LastPruneTime.Format(time.RFC3339),
+		LastPruneReclaimed:     state.LastPruneReclaimed,
+		BuildServePolicy:       config.BuildServePolicy,
+		Licenses:               licenseUsage(),
+		RetainedVersions:       state.RetainedVersions,
+		DownloadsCompleted:     state.DownloadsCompleted,
+		DownloadsClientAborted: state.DownloadsClientAborted,
+		DownloadWriteErrors:    state.DownloadWriteErrors,
+		StableCommit:           state.StableCommit,
+		CanaryCommit:           state.CanaryCommit,
+		CanaryPercent:          config.CanaryPercent,
+		Targets:                append([]TargetStatus(nil), state.Targets...),
+		BuildQueue:             state.BuildQueue,
+		Devices:                latestDeviceDownloads(),
+		DiskFree:               buildDiskSpace(),
+		CommitsBehind:          state.CommitsBehind,
+		Stale:                  firmwareStale(),
+		Slots:                  slotAssignments(),
+		Channels:               append([]ChannelStatus(nil), state.Channels...),
+		BuildDurations:         buildDurations(),
+		Maintenance:            state.Maintenance,
+		TargetBuildTime:        targetBuildTime(),
+		RepositoryError:        state.RepositoryError,
+		Server:                 serverInfo(time.Now()),
+	}
+	if state.Pin.Reason != "" {
+		pin := state.Pin
+		status.Pin = &pin
+	}
+	if state.Upload != nil {
+		upload := *state.Upload
+		status.Upload = &upload
+	}
+	return status
+}
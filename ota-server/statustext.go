@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// acceptsPlainText reports whether the client asked for text/plain rather
+// than JSON, e.g. curl -H 'Accept: text/plain'.
+func acceptsPlainText(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/plain") && !acceptsJSON(r)
+}
+
+// buildState is the one-word build state of the text status.
+func buildState(status StatusResponse) string {
+	switch {
+	case status.BuildInProgress:
+		return "building"
+	case status.Maintenance.Paused:
+		return "paused"
+	case status.BuildError != "":
+		return "failed"
+	case status.LastCommit == "" && status.Upload == nil:
+		return "unbuilt"
+	}
+	return "idle"
+}
+
+// statusText renders status as "key: value" lines for shells and watch.
+// The keys, their order and the value formats are stable; every key is
+// always present, with "-" when there is no value, and the error is cut to
+// its first line.
+func statusText(status StatusResponse, now time.Time) []byte {
+	dash := func(value string) string {
+		if value == "" {
+			return "-"
+		}
+		return value
+	}
+	commit, built, age := "-", "-", "-"
+	if status.Upload != nil {
+		commit = "upload " + status.Upload.SHA256[:min(8, len(status.Upload.SHA256))]
+	} else if status.LastCommit != "" {
+		commit = status.LastCommit[:min(8, len(status.LastCommit))]
+		if status.LastCommitSubject != "" {
+			commit += " " + status.LastCommitSubject
+		}
+	}
+	if at, err := time.Parse(time.RFC3339, status.LastBuild); err == nil && at.Year() > 1 {
+		built, age = status.LastBuild, now.Sub(at).Round(time.Second).String()
+	}
+	size := "-"
+	if status.FirmwareSize > 0 {
+		size = fmt.Sprintf("%d bytes (%.1f%% of partition)", status.FirmwareSize, status.FirmwareSizePercent)
+	}
+	errorLine, _, _ := strings.Cut(strings.TrimSpace(status.BuildError), "\n")
+
+	var buf bytes.Buffer
+	for _, line := range [][2]string{
+		{"state", buildState(status)},
+		{"commit", commit},
+		{"version", dash(status.FirmwareVersion)},
+		{"size", size},
+		{"built", built},
+		{"age", age},
+		{"queued", strconv.Itoa(len(status.BuildQueue))},
+		{"warning", dash(status.FirmwareSizeWarning)},
+		{"error", dash(errorLine)},
+	} {
+		fmt.Fprintf(&buf, "%-8s %s\n", line[0]+":", line[1])
+	}
+	return buf.Bytes()
+}
+
+// statusTextHandler serves /status.txt, and /status to clients that accept
+// text/plain.
+func statusTextHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowGetOrHead(w, r) {
+		return
+	}
+	state.RLock()
+	body := statusText(newStatusResponse(), time.Now())
+	state.RUnlock()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Write(body)
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// FirmwareInfo describes a stored firmware image.
+type FirmwareInfo struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// FirmwareObject is an open firmware image. Info describes exactly the
+// bytes behind Content, even if the stored image is replaced meanwhile.
+type FirmwareObject struct {
+	FirmwareInfo
+	Content interface {
+		io.ReadSeeker
+		io.ReaderAt
+	}
+	closer io.Closer
+}
+
+func (o *FirmwareObject) Close() error {
+	if o.closer == nil {
+		return nil
+	}
+	return o.closer.Close()
+}
+
+// FirmwareStore is where published firmware images live. Missing images
+// are reported with errors matching fs.ErrNotExist.
+type FirmwareStore interface {
+	Open(name string) (*FirmwareObject, error)
+	Stat(name string) (FirmwareInfo, error)
+	Put(name string, r io.Reader) error
+	List() ([]FirmwareInfo, error)
+	Remove(name string) error
+}
+
+// firmwareStore is the store builds publish to and downloads are served
+// from. It is set in main according to FIRMWARE_STORE.
+var firmwareStore FirmwareStore
+
+// errMirrorReadOnly is returned for writes to a mirror, whose images only
+// change when mirrorSync pulls them from the primary.
+var errMirrorReadOnly = fmt.Errorf("mirror store is read-only: %w", errors.ErrUnsupported)
+
+// mirrorMode reports whether firmware is mirrored from another OTA server.
+// A mirror is a read-only follower: it serves what the primary published
+// and never builds, archives or prunes.
+func mirrorMode() bool {
+	_, ok := firmwareStore.(*cachedStore)
+	return ok
+}
+
+// refuseOnMirror answers 409 from endpoints that build or publish firmware
+// when this server is a mirror.
+func refuseOnMirror(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if mirrorMode() {
+			http.Error(w, "This server mirrors its firmware; build and publish on the primary OTA server", http.StatusConflict)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// Firmware stores selectable with config.FirmwareStore.
+const (
+	firmwareStoreLocal = "local"
+	firmwareStoreHTTP  = "http"
+)
+
+// resolveFirmwareStore defaults and checks the store and, for a mirror,
+// the primary's URL.
+func resolveFirmwareStore(cfg *Config) error {
+	switch cfg.FirmwareStore {
+	case "":
+		cfg.FirmwareStore = firmwareStoreLocal
+	case firmwareStoreLocal:
+	case firmwareStoreHTTP:
+		if _, err := url.ParseRequestURI(cfg.MirrorURL); err != nil {
+			return fmt.Errorf("mirror URL: %w", err)
+		}
+	default:
+		return fmt.Errorf("firmware store must be %q or %q, got %q", firmwareStoreLocal, firmwareStoreHTTP, cfg.FirmwareStore)
+	}
+	return nil
+}
+
+// newFirmwareStore builds the store selected by config.FirmwareStore:
+//   - "local" (default): images live in config.FirmwarePath
+//   - "http": images are mirrored from config.MirrorURL and cached in
+//     config.FirmwarePath
+func newFirmwareStore() FirmwareStore {
+	local := &localStore{dir: config.FirmwarePath}
+	if config.FirmwareStore == firmwareStoreHTTP {
+		return &cachedStore{backend: &httpStore{baseURL: strings.TrimSuffix(config.MirrorURL, "/")}, cache: local}
+	}
+	return local
+}
+
+// localStore keeps images as files in a directory. Put writes to a temp
+// file and renames it into place, so readers never see a partial image.
+type localStore struct {
+	dir string
+}
+
+func (s *localStore) path(name string) string {
+	return filepath.Join(s.dir, filepath.Base(name))
+}
+
+func (s *localStore) Open(name string) (*FirmwareObject, error) {
+	file, err := os.Open(s.path(name))
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &FirmwareObject{
+		FirmwareInfo: FirmwareInfo{Name: name, Size: info.Size(), ModTime: info.ModTime()},
+		Content:      file,
+		closer:       file,
+	}, nil
+}
+
+func (s *localStore) Stat(name string) (FirmwareInfo, error) {
+	info, err := os.Stat(s.path(name))
+	if err != nil {
+		return FirmwareInfo{}, err
+	}
+	return FirmwareInfo{Name: name, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (s *localStore) Put(name string, r io.Reader) error {
+	tmp, err := os.CreateTemp(s.dir, "."+filepath.Base(name)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(name))
+}
+
+func (s *localStore) List() ([]FirmwareInfo, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var infos []FirmwareInfo
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".bin") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		infos = append(infos, FirmwareInfo{Name: entry.Name(), Size: info.Size(), ModTime: info.ModTime()})
+	}
+	return infos, nil
+}
+
+func (s *localStore) Remove(name string) error {
+	return os.Remove(s.path(name))
+}
+
+// httpStore reads images from another OTA server. It is read-only, and
+// only knows the current image: the primary's retained builds are not
+// mirrored.
+type httpStore struct {
+	baseURL string
+}
+
+var mirrorClient = &http.Client{Timeout: 5 * time.Minute}
+
+func (s *httpStore) request(method, name string) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.baseURL+"/"+url.PathEscape(name), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := mirrorClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		resp.Body.Close()
+		return nil, fmt.Errorf("mirror %s: %w", name, fs.ErrNotExist)
+	case resp.StatusCode != http.StatusOK:
+		resp.Body.Close()
+		return nil, fmt.Errorf("mirror %s: %s", name, resp.Status)
+	}
+	return resp, nil
+}
+
+func infoFromResponse(name string, resp *http.Response) FirmwareInfo {
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return FirmwareInfo{Name: name, Size: resp.ContentLength, ModTime: modTime}
+}
+
+func (s *httpStore) Open(name string) (*FirmwareObject, error) {
+	resp, err := s.request(http.MethodGet, name)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	info := infoFromResponse(name, resp)
+	info.Size = int64(len(data))
+	return &FirmwareObject{FirmwareInfo: info, Content: bytes.NewReader(data)}, nil
+}
+
+func (s *httpStore) Stat(name string) (FirmwareInfo, error) {
+	resp, err := s.request(http.MethodHead, name)
+	if err != nil {
+		return FirmwareInfo{}, err
+	}
+	resp.Body.Close()
+	return infoFromResponse(name, resp), nil
+}
+
+func (s *httpStore) Put(name string, r io.Reader) error {
+	return errMirrorReadOnly
+}
+
+func (s *httpStore) Remove(name string) error {
+	return errMirrorReadOnly
+}
+
+func (s *httpStore) List() ([]FirmwareInfo, error) {
+	info, err := s.Stat(config.FirmwareFile)
+	if err != nil {
+		return nil, err
+	}
+	return []FirmwareInfo{info}, nil
+}
+
+// cachedStore fronts a remote backend with a local disk cache. Reads are
+// always served from the cache; Refresh pulls the backend's copy down.
+// Nothing else writes to it, so Put and Remove fail and List describes the
+// cache, which is what downloads are served from.
+type cachedStore struct {
+	backend FirmwareStore
+	cache   *localStore
+}
+
+func (s *cachedStore) Open(name string) (*FirmwareObject, error) {
+	obj, err := s.cache.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		if err := s.Refresh(name); err != nil {
+			return nil, err
+		}
+		return s.cache.Open(name)
+	}
+	return obj, err
+}
+
+func (s *cachedStore) Stat(name string) (FirmwareInfo, error) {
+	return s.cache.Stat(name)
+}
+
+func (s *cachedStore) Put(name string, r io.Reader) error {
+	return errMirrorReadOnly
+}
+
+func (s *cachedStore) List() ([]FirmwareInfo, error) {
+	return s.cache.List()
+}
+
+func (s *cachedStore) Remove(name string) error {
+	return errMirrorReadOnly
+}
+
+// Refresh copies the backend's image into the cache if it differs.
+func (s *cachedStore) Refresh(name string) error {
+	remote, err := s.backend.Stat(name)
+	if err != nil {
+		return err
+	}
+	if local, err := s.cache.Stat(name); err == nil && local.Size == remote.Size && !remote.ModTime.After(local.ModTime) {
+		return nil
+	}
+
+	obj, err := s.backend.Open(name)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+
+	if err := s.cache.Put(name, obj.Content); err != nil {
+		return err
+	}
+	slog.Info("🪞 Cached firmware from mirror", "name", name, "bytes", obj.Size)
+	return nil
+}
+
+// mirrorSync periodically refreshes the local cache from a remote store,
+// every config.MirrorSync.
+func mirrorSync() {
+	cached, ok := firmwareStore.(*cachedStore)
+	if !ok {
+		return
+	}
+	slog.Info("🪞 Mirror sync started", "name", config.FirmwareFile, "interval", config.MirrorSync)
+
+	for {
+		if err := cached.Refresh(config.FirmwareFile); err != nil {
+			slog.Error("❌ Mirror sync failed", "error", err)
+		}
+		time.Sleep(config.MirrorSync)
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memStore is an in-memory FirmwareStore, standing in for a remote
+// backend behind cachedStore.
+type memStore struct {
+	mu    sync.Mutex
+	files map[string][]byte
+	mtime map[string]time.Time
+	opens int
+}
+
+func newMemStore() *memStore {
+	return &memStore{files: map[string][]byte{}, mtime: map[string]time.Time{}}
+}
+
+func (s *memStore) Open(name string) (*FirmwareObject, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.files[name]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	s.opens++
+	return &FirmwareObject{
+		FirmwareInfo: FirmwareInfo{Name: name, Size: int64(len(data)), ModTime: s.mtime[name]},
+		Content:      bytes.NewReader(data),
+	}, nil
+}
+
+func (s *memStore) Stat(name string) (FirmwareInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.files[name]
+	if !ok {
+		return FirmwareInfo{}, fs.ErrNotExist
+	}
+	return FirmwareInfo{Name: name, Size: int64(len(data)), ModTime: s.mtime[name]}, nil
+}
+
+func (s *memStore) Put(name string, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Whole seconds, like the Last-Modified of a real primary
+	s.files[name], s.mtime[name] = data, time.Now().Truncate(time.Second)
+	return nil
+}
+
+func (s *memStore) List() ([]FirmwareInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var infos []FirmwareInfo
+	for name, data := range s.files {
+		infos = append(infos, FirmwareInfo{Name: name, Size: int64(len(data)), ModTime: s.mtime[name]})
+	}
+	return infos, nil
+}
+
+func (s *memStore) Remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.files[name]; !ok {
+		return fs.ErrNotExist
+	}
+	delete(s.files, name)
+	return nil
+}
+
+func readObject(t *testing.T, store FirmwareStore, name string) string {
+	t.Helper()
+	obj, err := store.Open(name)
+	if err != nil {
+		t.Fatalf("Open(%s): %v", name, err)
+	}
+	defer obj.Close()
+	data, err := io.ReadAll(obj.Content)
+	if err != nil {
+		t.Fatalf("read %s: %v", name, err)
+	}
+	if obj.Size != int64(len(data)) {
+		t.Errorf("Open(%s) size = %d, read %d bytes", name, obj.Size, len(data))
+	}
+	return string(data)
+}
+
+func listNames(t *testing.T, store FirmwareStore) []string {
+	t.Helper()
+	infos, err := store.List()
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestLocalStore(t *testing.T) {
+	store := &localStore{dir: t.TempDir()}
+
+	tests := []struct {
+		name    string
+		put     map[string]string
+		remove  []string
+		want    map[string]string
+		missing []string
+		listed  []string
+	}{
+		{
+			name:   "put and read back",
+			put:    map[string]string{"beacon_firmware.bin": "image one"},
+			want:   map[string]string{"beacon_firmware.bin": "image one"},
+			listed: []string{"beacon_firmware.bin"},
+		},
+		{
+			name:   "put replaces",
+			put:    map[string]string{"beacon_firmware.bin": "image two"},
+			want:   map[string]string{"beacon_firmware.bin": "image two"},
+			listed: []string{"beacon_firmware.bin"},
+		},
+		{
+			name:   "list skips files that aren't images",
+			put:    map[string]string{"beacon_firmware.bin.sig": "sig", "beacon_firmware-abc1234.bin": "archived"},
+			listed: []string{"beacon_firmware-abc1234.bin", "beacon_firmware.bin"},
+		},
+		{
+			name:    "remove",
+			remove:  []string{"beacon_firmware-abc1234.bin"},
+			missing: []string{"beacon_firmware-abc1234.bin"},
+			listed:  []string{"beacon_firmware.bin"},
+		},
+		{
+			name:    "names can't leave the directory",
+			put:     map[string]string{"../escaped.bin": "escaped"},
+			want:    map[string]string{"escaped.bin": "escaped"},
+			missing: []string{"../../escaped-elsewhere.bin"},
+			listed:  []string{"beacon_firmware.bin", "escaped.bin"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, content := range tt.put {
+				if err := store.Put(name, strings.NewReader(content)); err != nil {
+					t.Fatalf("Put(%s): %v", name, err)
+				}
+			}
+			for _, name := range tt.remove {
+				if err := store.Remove(name); err != nil {
+					t.Fatalf("Remove(%s): %v", name, err)
+				}
+			}
+			for name, content := range tt.want {
+				if got := readObject(t, store, name); got != content {
+					t.Errorf("Open(%s) = %q, want %q", name, got, content)
+				}
+			}
+			for _, name := range tt.missing {
+				if _, err := store.Stat(name); !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("Stat(%s) error = %v, want fs.ErrNotExist", name, err)
+				}
+			}
+			if got := listNames(t, store); strings.Join(got, ",") != strings.Join(tt.listed, ",") {
+				t.Errorf("List = %v, want %v", got, tt.listed)
+			}
+		})
+	}
+}
+
+// newFakePrimary serves files like a primary OTA server serves its
+// current image, answering 500 for "broken.bin".
+func newFakePrimary(t *testing.T, files map[string]string) *httptest.Server {
+	t.Helper()
+	modTime := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/")
+		if name == "broken.bin" {
+			http.Error(w, "boom", http.StatusInternalServerError)
+			return
+		}
+		content, ok := files[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, name, modTime, strings.NewReader(content))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestHTTPStore(t *testing.T) {
+	primary := newFakePrimary(t, map[string]string{"beacon_firmware.bin": "primary image"})
+	store := &httpStore{baseURL: primary.URL}
+
+	tests := []struct {
+		name     string
+		file     string
+		want     string
+		notExist bool
+		wantErr  bool
+	}{
+		{name: "current image", file: "beacon_firmware.bin", want: "primary image"},
+		{name: "missing image", file: "beacon_firmware-abc1234.bin", notExist: true},
+		{name: "primary error", file: "broken.bin", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, statErr := store.Stat(tt.file)
+			_, openErr := store.Open(tt.file)
+			switch {
+			case tt.notExist:
+				for _, err := range []error{statErr, openErr} {
+					if !errors.Is(err, fs.ErrNotExist) {
+						t.Errorf("error = %v, want fs.ErrNotExist", err)
+					}
+				}
+			case tt.wantErr:
+				for _, err := range []error{statErr, openErr} {
+					if err == nil || errors.Is(err, fs.ErrNotExist) {
+						t.Errorf("error = %v, want a non-NotExist error", err)
+					}
+				}
+			default:
+				if statErr != nil {
+					t.Fatalf("Stat: %v", statErr)
+				}
+				if info.Size != int64(len(tt.want)) || info.ModTime.IsZero() {
+					t.Errorf("Stat = %+v, want size %d and a modification time", info, len(tt.want))
+				}
+				if got := readObject(t, store, tt.file); got != tt.want {
+					t.Errorf("Open = %q, want %q", got, tt.want)
+				}
+			}
+		})
+	}
+
+	if err := store.Put("beacon_firmware.bin", strings.NewReader("x")); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("Put error = %v, want errors.ErrUnsupported", err)
+	}
+	if err := store.Remove("beacon_firmware.bin"); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("Remove error = %v, want errors.ErrUnsupported", err)
+	}
+}
+
+func TestCachedStore(t *testing.T) {
+	backend := newMemStore()
+	store := &cachedStore{backend: backend, cache: &localStore{dir: t.TempDir()}}
+	const name = "beacon_firmware.bin"
+
+	tests := []struct {
+		name      string
+		publish   string // put on the backend first, when set
+		refresh   bool
+		want      string
+		wantOpens int
+	}{
+		{name: "miss fetches from the backend", publish: "v1", want: "v1", wantOpens: 1},
+		{name: "hit is served from the cache", want: "v1", wantOpens: 1},
+		{name: "unchanged backend isn't fetched again", refresh: true, want: "v1", wantOpens: 1},
+		{name: "reads keep the cache until refreshed", publish: "v2 image", want: "v1", wantOpens: 1},
+		{name: "refresh pulls the new image", refresh: true, want: "v2 image", wantOpens: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.publish != "" {
+				backend.Put(name, strings.NewReader(tt.publish))
+			}
+			if tt.refresh {
+				if err := store.Refresh(name); err != nil {
+					t.Fatalf("Refresh: %v", err)
+				}
+			}
+			if got := readObject(t, store, name); got != tt.want {
+				t.Errorf("Open = %q, want %q", got, tt.want)
+			}
+			if backend.opens != tt.wantOpens {
+				t.Errorf("backend opened %d times, want %d", backend.opens, tt.wantOpens)
+			}
+		})
+	}
+
+	t.Run("read-only", func(t *testing.T) {
+		if err := store.Put("beacon_firmware-abc1234.bin", strings.NewReader("x")); !errors.Is(err, errors.ErrUnsupported) {
+			t.Errorf("Put error = %v, want errors.ErrUnsupported", err)
+		}
+		if err := store.Remove(name); !errors.Is(err, errors.ErrUnsupported) {
+			t.Errorf("Remove error = %v, want errors.ErrUnsupported", err)
+		}
+	})
+
+	t.Run("lists the cache", func(t *testing.T) {
+		backend.Put("beacon_firmware-abc1234.bin", strings.NewReader("only on the backend"))
+		if got := listNames(t, store); strings.Join(got, ",") != name {
+			t.Errorf("List = %v, want [%s]", got, name)
+		}
+	})
+
+	t.Run("missing everywhere", func(t *testing.T) {
+		if _, err := store.Open("beacon_firmware-fffffff.bin"); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Open error = %v, want fs.ErrNotExist", err)
+		}
+	})
+}
+
+func TestRefuseOnMirror(t *testing.T) {
+	saved := firmwareStore
+	t.Cleanup(func() { firmwareStore = saved })
+	called := false
+	handler := refuseOnMirror(func(w http.ResponseWriter, r *http.Request) { called = true })
+
+	tests := []struct {
+		name       string
+		store      FirmwareStore
+		wantStatus int
+		wantCalled bool
+	}{
+		{name: "local store", store: &localStore{dir: t.TempDir()}, wantStatus: http.StatusOK, wantCalled: true},
+		{name: "mirror", store: &cachedStore{backend: newMemStore(), cache: &localStore{dir: t.TempDir()}},
+			wantStatus: http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			firmwareStore, called = tt.store, false
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest(http.MethodPost, "/rollback", nil))
+			if rec.Code != tt.wantStatus || called != tt.wantCalled {
+				t.Errorf("status %d, handler called %v; want %d, %v", rec.Code, called, tt.wantStatus, tt.wantCalled)
+			}
+		})
+	}
+}
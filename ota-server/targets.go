@@ -0,0 +1,517 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FirmwareTarget is one firmware image built from the project. The first
+// target is the primary one: it is published as config.FirmwareFile and is
+// the image rollouts, rollbacks, archives and notes apply to.
+type FirmwareTarget struct {
+	Name       string   `json:"name"`
+	Output     string   `json:"output"`
+	Image      string   `json:"image"`
+	Entrypoint string   `json:"entrypoint"`
+	Workspace  string   `json:"workspace"`
+	Command    []string `json:"command"`
+	Env        []string `json:"env"`
+
+	// Checkout to build, relative to the project; empty for the project
+	// itself. Channel builds set it to their worktree.
+	Source string `json:"-"`
+	// Directory under the firmware volume the build writes Output to;
+	// buildOutputDir when empty. The self-test builds into a scratch one.
+	OutputDir string `json:"-"`
+}
+
+func (t FirmwareTarget) outputDir() string {
+	if t.OutputDir != "" {
+		return t.OutputDir
+	}
+	return buildOutputDir
+}
+
+// TargetStatus is the last build result of one target.
+type TargetStatus struct {
+	Name      string    `json:"name"`
+	Output    string    `json:"output"`
+	URL       string    `json:"url"`
+	LastBuild time.Time `json:"lastBuild"`
+	Commit    string    `json:"commit"`
+	Version   string    `json:"version"`
+	Size      int64     `json:"size"`
+	Error     string    `json:"error,omitempty"`
+
+	DurationSeconds float64 `json:"durationSeconds"`
+}
+
+var targetNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// resolveTargets fills in target defaults and checks the list. Without any
+// configured targets there is a single "beacon" target built by build.sh.
+func resolveTargets(cfg *Config) error {
+	if len(cfg.Targets) == 0 {
+		cfg.Targets = []FirmwareTarget{{Name: "beacon"}}
+	}
+	names, outputs := map[string]bool{}, map[string]bool{}
+	for i := range cfg.Targets {
+		t := &cfg.Targets[i]
+		if !targetNamePattern.MatchString(t.Name) {
+			return fmt.Errorf("target %d: invalid name %q", i, t.Name)
+		}
+		if t.Output == "" {
+			t.Output = t.Name + "_firmware.bin"
+			if i == 0 {
+				t.Output = cfg.FirmwareFile
+			}
+		}
+		if i == 0 {
+			cfg.FirmwareFile = t.Output
+		}
+		if cfg.BuildBackend == buildBackendLocal {
+			if len(t.Command) == 0 {
+				return fmt.Errorf("target %s: the local build backend needs a command", t.Name)
+			}
+		} else {
+			if t.Image == "" {
+				t.Image = "beacon-builder"
+			}
+			if len(t.Command) == 0 {
+				t.Command = []string{"/build.sh"}
+			}
+		}
+		if !strings.HasSuffix(t.Output, ".bin") || strings.Contains(t.Output, "/") {
+			return fmt.Errorf("target %s: output must be a plain .bin name, got %q", t.Name, t.Output)
+		}
+		if t.Workspace != "" && !targetNamePattern.MatchString(t.Workspace) {
+			return fmt.Errorf("target %s: invalid workspace %q", t.Name, t.Workspace)
+		}
+		if names[t.Name] || outputs[t.Output] {
+			return fmt.Errorf("target %s: duplicate name or output", t.Name)
+		}
+		names[t.Name], outputs[t.Output] = true, true
+	}
+	return nil
+}
+
+// TargetBuildTime compares the wall-clock time of the last build of all
+// targets with the sum of their individual build times, which is what a
+// sequential build would take.
+type TargetBuildTime struct {
+	Parallelism   int     `json:"parallelism"`
+	WallSeconds   float64 `json:"wallSeconds"`
+	SummedSeconds float64 `json:"summedSeconds"`
+}
+
+// targetBuildTime reports the timing of the last build. Callers must hold
+// state.RLock.
+func targetBuildTime() TargetBuildTime {
+	timing := TargetBuildTime{Parallelism: config.BuildParallelism, WallSeconds: state.TargetBuildWall.Seconds()}
+	for _, t := range state.Targets {
+		timing.SummedSeconds += t.DurationSeconds
+	}
+	return timing
+}
+
+// initTargetStatus seeds per-target status from the configured targets.
+func initTargetStatus() {
+	state.Lock()
+	defer state.Unlock()
+	state.Targets = make([]TargetStatus, len(config.Targets))
+	for i, t := range config.Targets {
+		state.Targets[i] = TargetStatus{Name: t.Name, Output: t.Output, URL: "/firmware/" + t.Name + ".bin"}
+		if info, err := firmwareStore.Stat(t.Output); err == nil {
+			state.Targets[i].Size = info.Size
+		}
+	}
+}
+
+// runTargetBuild runs target's build through the configured backend,
+// writing its output to out. A builder container is named so it can be killed if it exceeds
+// config.BuildTimeout or the build is aborted through ctx. Callers must
+// hold dockerHost.
+func runTargetBuild(parent context.Context, target FirmwareTarget, out io.Writer) (timedOut bool, err error) {
+	ctx, cancel := context.WithTimeout(parent, config.BuildTimeout)
+	defer cancel()
+
+	container := fmt.Sprintf("%s-build-%d", target.Name, time.Now().UnixNano())
+	cmd, err := buildCommand(ctx, target, container)
+	if err != nil {
+		return false, err
+	}
+	cmd.WaitDelay = 10 * time.Second
+	cmd.Stdout = out
+	cmd.Stderr = out
+	err = cmd.Run()
+
+	if ctx.Err() != nil {
+		// Killing the docker client leaves the container running
+		if config.BuildBackend == buildBackendDocker {
+			if killOut, killErr := exec.Command("docker", "kill", container).CombinedOutput(); killErr != nil {
+				slog.Warn("⚠️  Could not kill build container", "container", container, "error", killErr, "output", string(killOut))
+			}
+		}
+		if parent.Err() != nil {
+			return false, errBuildAborted
+		}
+		return true, fmt.Errorf("timed out after %v", config.BuildTimeout)
+	}
+	return false, err
+}
+
+// buildTargets builds every target from the checkout source, built at
+// commit, up to config.BuildParallelism at a time. The primary target is
+// built by buildPrimary, which also publishes it and reports its own
+// failure; every other target is built and published by buildExtraTarget.
+// Targets that share a workspace build in the same tree, so they run one
+// after another in config order; only targets in different workspaces
+// overlap. Extra targets' failures are returned by target name.
+func buildTargets(ctx context.Context, source, commit string, out io.Writer, buildPrimary func(out io.Writer)) map[string]error {
+	var groups [][]FirmwareTarget
+	workspaces := map[string]int{}
+	for _, target := range config.Targets {
+		target.Source = source
+		i, ok := workspaces[target.Workspace]
+		if !ok {
+			i = len(groups)
+			workspaces[target.Workspace] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], target)
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		failures = map[string]error{}
+		slots    = make(chan struct{}, config.BuildParallelism)
+	)
+	// The primary takes the first slot, so it starts first even when
+	// builds run one at a time
+	slots <- struct{}{}
+	for g, group := range groups {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i, target := range group {
+				if g == 0 && i == 0 {
+					buildPrimaryTarget(target, out, &mu, buildPrimary)
+					<-slots
+					continue
+				}
+				slots <- struct{}{}
+				err := buildExtraTarget(ctx, target, commit, out, &mu)
+				<-slots
+				if err != nil {
+					mu.Lock()
+					failures[target.Name] = err
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return failures
+}
+
+// buildPrimaryTarget runs buildPrimary with the shared output, prefixed
+// like the extra targets' when they build in parallel.
+func buildPrimaryTarget(target FirmwareTarget, out io.Writer, mu *sync.Mutex, buildPrimary func(out io.Writer)) {
+	if config.BuildParallelism > 1 {
+		lines := &prefixWriter{out: out, mu: mu, prefix: "[" + target.Name + "] "}
+		defer lines.flush()
+		out = lines
+	}
+	buildPrimary(out)
+}
+
+// buildExtraTarget builds and publishes one extra target. With parallel
+// builds its output is prefixed with the target name, one whole line at a
+// time under mu, so interleaved builds stay readable.
+func buildExtraTarget(ctx context.Context, target FirmwareTarget, commit string, out io.Writer, mu *sync.Mutex) error {
+	if ctx.Err() != nil {
+		return errBuildAborted
+	}
+	slog.Info("🔨 Building target...", "event", "target_build_started", "target", target.Name)
+	start := time.Now()
+	if config.BuildParallelism > 1 {
+		lines := &prefixWriter{out: out, mu: mu, prefix: "[" + target.Name + "] "}
+		defer lines.flush()
+		out = lines
+	} else {
+		fmt.Fprintf(out, "\n==> Building target %s\n", target.Name)
+	}
+
+	_, _, err := runTargetBuildWithRetry(ctx, target, out)
+	if err == nil {
+		err = publishTarget(target)
+	}
+	if err != nil {
+		slog.Error("❌ Target build failed", "event", "target_build_failed", "target", target.Name, "error", err)
+	} else {
+		slog.Info("✅ Target published", "event", "target_build_completed", "target", target.Name, "name", target.Output)
+	}
+
+	state.Lock()
+	recordTargetBuild(target.Name, commit, time.Since(start), err)
+	state.Unlock()
+	return err
+}
+
+// joinTargetErrors combines per-target failures into one error, in config
+// order.
+func joinTargetErrors(failures map[string]error) error {
+	var errs []error
+	for _, target := range config.Targets {
+		if err, ok := failures[target.Name]; ok {
+			errs = append(errs, fmt.Errorf("target %s: %w", target.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// prefixWriter prefixes each complete line with prefix and writes it to out
+// under mu, so several writers can share out line by line.
+type prefixWriter struct {
+	out    io.Writer
+	mu     *sync.Mutex
+	prefix string
+	buf    []byte
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		w.writeLine(w.buf[:i+1])
+		w.buf = w.buf[i+1:]
+	}
+}
+
+// flush writes a trailing partial line.
+func (w *prefixWriter) flush() {
+	if len(w.buf) > 0 {
+		w.writeLine(append(w.buf, '\n'))
+		w.buf = nil
+	}
+}
+
+func (w *prefixWriter) writeLine(line []byte) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	io.WriteString(w.out, w.prefix)
+	w.out.Write(line)
+}
+
+// publishTarget validates a built target image and swaps it into the store.
+func publishTarget(target FirmwareTarget) error {
+	file, err := os.Open(filepath.Join(config.FirmwarePath, buildOutputDir, target.Output))
+	if err != nil {
+		return fmt.Errorf("build output missing: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if err := validateFirmwareImage(file, info.Size()); err != nil {
+		return fmt.Errorf("refusing to publish invalid image: %w", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	built := sha256.New()
+	if err := firmwareStore.Put(target.Output, io.TeeReader(file, built)); err != nil {
+		return err
+	}
+	if err := verifyPublished(target.Output, hex.EncodeToString(built.Sum(nil))); err != nil {
+		return err
+	}
+	return signFirmware(target.Output)
+}
+
+// recordTargetBuild updates a target's status after a build. Callers must
+// hold state.Lock.
+func recordTargetBuild(name, commit string, duration time.Duration, err error) {
+	for i := range state.Targets {
+		t := &state.Targets[i]
+		if t.Name != name {
+			continue
+		}
+		t.LastBuild = time.Now()
+		t.DurationSeconds = duration.Seconds()
+		if err != nil {
+			t.Error = err.Error()
+			return
+		}
+		t.Error = ""
+		t.Commit = commit
+		if obj, err := firmwareStore.Open(t.Output); err == nil {
+			t.Size = obj.Size
+			t.Version = readFirmwareVersion(obj.Content)
+			obj.Close()
+		}
+		return
+	}
+}
+
+func findTarget(name string) (FirmwareTarget, int, bool) {
+	for i, t := range config.Targets {
+		if t.Name == name {
+			return t, i, true
+		}
+	}
+	return FirmwareTarget{}, 0, false
+}
+
+// targetFirmwareHandler serves /firmware/<name>.bin. The primary target
+// goes through serveFirmware so update windows, rollouts and licenses
+// apply; other targets are served as published.
+func targetFirmwareHandler(w http.ResponseWriter, r *http.Request) {
+	if image, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/firmware/"), ".sig"); ok {
+		serveSignature(w, r, image)
+		return
+	}
+	name, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/firmware/"), ".bin")
+	if ok && !requireTargetParam(w, "target", name) {
+		return
+	}
+	target, index, found := findTarget(name)
+	if !ok || !found {
+		http.NotFound(w, r)
+		return
+	}
+	if index == 0 {
+		serveFirmware(w, r)
+		return
+	}
+	servePublishedFirmware(w, r, name, target.Output)
+}
+
+// variantFirmwareHandler serves the firmware URL devices poll. Boards built
+// as separate targets name theirs with ?variant= or an X-Board-Variant
+// header; without either they get the primary target, the default variant.
+func variantFirmwareHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Vary", "X-Board-Variant")
+	variant := r.URL.Query().Get("variant")
+	if variant == "" {
+		variant = r.Header.Get("X-Board-Variant")
+	}
+	if variant == "" {
+		serveFirmware(w, r)
+		return
+	}
+	if !requireTargetParam(w, "variant", variant) {
+		return
+	}
+
+	target, index, found := findTarget(variant)
+	if !found {
+		names := make([]string, len(config.Targets))
+		for i, t := range config.Targets {
+			names[i] = t.Name
+		}
+		http.Error(w, fmt.Sprintf("Unknown variant %q; known variants: %s", variant, strings.Join(names, ", ")), http.StatusNotFound)
+		return
+	}
+	if index == 0 {
+		serveFirmware(w, r)
+		return
+	}
+	servePublishedFirmware(w, r, target.Name, target.Output)
+}
+
+// publishedCommit returns the commit the target or channel publishing
+// output was last built from, or "" if none has been.
+func publishedCommit(output string) string {
+	state.RLock()
+	defer state.RUnlock()
+	for _, t := range state.Targets {
+		if t.Output == output {
+			return t.Commit
+		}
+	}
+	for _, channel := range config.Channels {
+		if channel.Output != output {
+			continue
+		}
+		for _, c := range state.Channels {
+			if c.Name == channel.Name {
+				return c.Commit
+			}
+		}
+	}
+	return ""
+}
+
+// servePublishedFirmware serves an image as published, without the update
+// windows, rollouts and licenses of the primary firmware. label names it in
+// errors and logs.
+func servePublishedFirmware(w http.ResponseWriter, r *http.Request, label, output string) {
+	if !allowGetOrHead(w, r) || !allowDownload(w, r) {
+		return
+	}
+
+	file, err := firmwareStore.Open(output)
+	if errors.Is(err, fs.ErrNotExist) {
+		http.Error(w, "Firmware for "+label+" not built yet", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("❌ Failed to open published firmware", "name", output, "error", err)
+		http.Error(w, "Failed to read firmware", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	digest, err := firmwareDigest(file.FirmwareInfo, file.Content)
+	if err != nil {
+		slog.Error("❌ Failed to hash published firmware", "name", output, "error", err)
+		http.Error(w, "Failed to read firmware", http.StatusInternalServerError)
+		return
+	}
+	version := readFirmwareVersion(file.Content)
+	if version != "" {
+		w.Header().Set("X-Firmware-Version", version)
+	}
+	w.Header().Set("x-MD5", digest.MD5)
+	w.Header().Set("X-Firmware-SHA256", digest.SHA256)
+	w.Header().Set("X-Firmware-Size", fmt.Sprintf("%d", file.Size))
+	if !allowResume(w, r, digest.ETag()) {
+		return
+	}
+	w.Header().Set("ETag", digest.ETag())
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", contentDisposition(downloadFilename(output, version, publishedCommit(output))))
+
+	slog.Info("📤 Serving published firmware", "event", "download_started", "label", label, "bytes", file.Size, "remote_addr", r.RemoteAddr)
+
+	cw := &countingWriter{ResponseWriter: w}
+	http.ServeContent(cw, r, output, file.ModTime, file.Content)
+	if r.Method != http.MethodHead && cw.status != http.StatusNotModified {
+		outcome := classifyDownload(r, cw)
+		recordDownload(outcome)
+		recordDeviceDownload(r, output, version, cw.bytes, outcome)
+		logDownload(slog.With("name", output, "version", version, "remote_addr", r.RemoteAddr), outcome, cw)
+	}
+}
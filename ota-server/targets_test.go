@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPrimaryTargetBuildsInParallel(t *testing.T) {
+	useTestFirmware(t, testImage("1.0.0", 'A', 4096))
+	project, _ := testRepo(t, "1.0.0")
+	config.ProjectPath = project
+	imagePath := filepath.Join(t.TempDir(), "image.bin")
+	if err := os.WriteFile(imagePath, testImage("1.1.0", 'B', 4096), 0644); err != nil {
+		t.Fatal(err)
+	}
+	gatewayOutput := filepath.Join(config.FirmwarePath, buildOutputDir, "gateway.bin")
+
+	// The primary only finishes once the gateway has built, which it can't
+	// if the two run one after the other
+	config.BuildBackend, config.BuildParallelism = buildBackendLocal, 2
+	config.Targets = []FirmwareTarget{
+		{Name: "beacon", Output: config.FirmwareFile, Workspace: "build-beacon",
+			Command: []string{"sh", "-c", `for i in $(seq 100); do test -f "$GATEWAY" && exec cp "$IMAGE" "$OUTPUT"; sleep 0.05; done; exit 1`},
+			Env:     []string{"IMAGE=" + imagePath, "GATEWAY=" + gatewayOutput}},
+		{Name: "gateway", Output: "gateway.bin", Workspace: "build-gateway",
+			Command: []string{"sh", "-c", `cp "$IMAGE" "$OUTPUT"`},
+			Env:     []string{"IMAGE=" + imagePath}},
+	}
+	initTargetStatus()
+
+	if err := buildFirmware(BuildRequest{Reason: "manual"}); err != nil {
+		t.Fatalf("build failed: the primary target didn't overlap the gateway: %v", err)
+	}
+	state.RLock()
+	defer state.RUnlock()
+	for _, target := range state.Targets {
+		if target.Error != "" {
+			t.Errorf("target %s failed: %s", target.Name, target.Error)
+		}
+	}
+}
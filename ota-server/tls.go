@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Self-signed certificates live next to the firmware so a pinned
+// certificate survives restarts.
+const selfSignedDir = ".tls"
+
+// tlsMode describes how HTTPS is set up, for logging.
+func (c Config) tlsMode() string {
+	switch {
+	case c.TLSCert != "":
+		return "files:" + c.TLSPort
+	case c.TLSSelfSigned:
+		return "self-signed:" + c.TLSPort
+	}
+	return "off"
+}
+
+// newTLSConfig returns the HTTPS configuration, or nil when TLS is off.
+func newTLSConfig() (*tls.Config, error) {
+	certFile, keyFile := config.TLSCert, config.TLSKey
+	switch {
+	case certFile != "":
+	case config.TLSSelfSigned:
+		var err error
+		if certFile, keyFile, err = selfSignedCertificate(); err != nil {
+			return nil, fmt.Errorf("self-signed certificate: %w", err)
+		}
+	default:
+		return nil, nil
+	}
+
+	certs := &certReloader{certFile: certFile, keyFile: keyFile}
+	cert, err := certs.GetCertificate(nil)
+	if err != nil {
+		return nil, err
+	}
+	if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil {
+		fingerprint := sha256.Sum256(leaf.Raw)
+		slog.Info("🔐 TLS certificate loaded", "file", certFile, "subject", leaf.Subject.CommonName,
+			"expires", leaf.NotAfter.Format(time.RFC3339), "sha256", hex.EncodeToString(fingerprint[:]))
+	}
+	return &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: certs.GetCertificate}, nil
+}
+
+// certReloader serves a certificate from disk and reloads it when the file
+// changes, so renewed certificates are picked up without a restart.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	info, err := os.Stat(c.certFile)
+	if err == nil && info.ModTime().Equal(c.modTime) && c.cert != nil {
+		return c.cert, nil
+	}
+	cert, loadErr := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if loadErr != nil {
+		if c.cert != nil {
+			// Likely caught mid-renewal; keep serving the old pair
+			slog.Warn("⚠️  Could not reload TLS certificate, keeping the current one", "error", loadErr)
+			return c.cert, nil
+		}
+		return nil, loadErr
+	}
+	if err == nil {
+		c.modTime = info.ModTime()
+	}
+	c.cert = &cert
+	return c.cert, nil
+}
+
+// selfSignedCertificate returns the development certificate under
+// config.FirmwarePath, generating it the first time or once it expires.
+func selfSignedCertificate() (certFile, keyFile string, err error) {
+	dir := filepath.Join(config.FirmwarePath, selfSignedDir)
+	certFile, keyFile = filepath.Join(dir, "selfsigned.crt"), filepath.Join(dir, "selfsigned.key")
+
+	if pair, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil {
+		if leaf, err := x509.ParseCertificate(pair.Certificate[0]); err == nil && time.Now().Before(leaf.NotAfter) {
+			return certFile, keyFile, nil
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", "", err
+	}
+	hostname, _ := os.Hostname()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "esp32-ota-server"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if hostname != "" {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() {
+				template.IPAddresses = append(template.IPAddresses, ipNet.IP)
+			}
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return "", "", err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", "", err
+	}
+	err = errors.Join(
+		os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600),
+		os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644),
+	)
+	if err != nil {
+		return "", "", err
+	}
+	slog.Info("🔐 Generated self-signed TLS certificate for development", "file", certFile)
+	return certFile, keyFile, nil
+}
+
+// redirectToHTTPS sends plain HTTP requests to the same path on the HTTPS
+// port. 308 keeps POST bodies intact for admin requests. Probes stay on
+// HTTP so container health checks don't need to trust the certificate.
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/health" || r.URL.Path == "/ready" {
+		http.DefaultServeMux.ServeHTTP(w, r)
+		return
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(r.Host); err == nil {
+		host = h
+	}
+	if config.TLSPort != "443" {
+		host = net.JoinHostPort(host, config.TLSPort)
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"log/slog"
+	"strings"
+)
+
+// Toolchain records the ESP-IDF and compiler versions that produced a
+// firmware image. build.sh prints them as KEY=value lines.
+type Toolchain struct {
+	IDFVersion      string
+	CompilerVersion string
+}
+
+func (t Toolchain) String() string {
+	if t.IDFVersion == "" && t.CompilerVersion == "" {
+		return "unknown"
+	}
+	return t.IDFVersion + " / " + t.CompilerVersion
+}
+
+// maxBuildLineBytes is the longest build output line parseToolchain reads
+// past; compiler diagnostics can run well over bufio's default 64KB.
+const maxBuildLineBytes = 1 << 20
+
+// parseToolchain extracts the toolchain versions from build output.
+func parseToolchain(output []byte) Toolchain {
+	var t Toolchain
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	scanner.Buffer(nil, maxBuildLineBytes)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "IDF_VERSION":
+			t.IDFVersion = strings.TrimSpace(value)
+		case "COMPILER_VERSION":
+			t.CompilerVersion = strings.TrimSpace(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		slog.Warn("⚠️  Could not read toolchain versions from the whole build output", "error", err)
+	}
+	return t
+}
+
+// recordToolchain stores the toolchain of a successful build and warns when
+// it differs from the previous one. Callers must hold state.Lock.
+func recordToolchain(t Toolchain) {
+	prev := state.Toolchain
+	state.Toolchain = t
+	state.ToolchainWarning = ""
+	if prev == (Toolchain{}) || t == (Toolchain{}) || prev == t {
+		return
+	}
+	state.ToolchainWarning = "Toolchain changed: " + prev.String() + " -> " + t.String()
+	slog.Warn("⚠️  Toolchain changed", "from", prev.String(), "to", t.String())
+}
+
+// buildToolchain returns the toolchain recorded in the history for the
+// successful build of commit, which may be abbreviated. Callers must hold
+// state.RLock.
+func buildToolchain(commit string) Toolchain {
+	if commit == "" {
+		return Toolchain{}
+	}
+	for i := len(state.History) - 1; i >= 0; i-- {
+		record := state.History[i]
+		if record.Success && record.Commit != "" && strings.HasPrefix(record.Commit, commit) {
+			return Toolchain{IDFVersion: record.IDFVersion, CompilerVersion: record.CompilerVersion}
+		}
+	}
+	return Toolchain{}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseToolchain(t *testing.T) {
+	long := strings.Repeat("x", 100<<10)
+	output := "IDF_VERSION=v5.1.2\n" + long + "\nCOMPILER_VERSION=xtensa-esp32-elf-gcc 12.2.0\n"
+	want := Toolchain{IDFVersion: "v5.1.2", CompilerVersion: "xtensa-esp32-elf-gcc 12.2.0"}
+	if got := parseToolchain([]byte(output)); got != want {
+		t.Errorf("parseToolchain = %+v, want %+v", got, want)
+	}
+}
+
+func TestBuildToolchain(t *testing.T) {
+	state.Lock()
+	saved := state.History
+	state.History = []BuildRecord{
+		{Commit: "aaaaaaa1", Success: true, IDFVersion: "v5.0"},
+		{Commit: "bbbbbbb2", Success: false, IDFVersion: "v5.1"},
+	}
+	state.Unlock()
+	t.Cleanup(func() {
+		state.Lock()
+		state.History = saved
+		state.Unlock()
+	})
+
+	state.RLock()
+	defer state.RUnlock()
+	for commit, want := range map[string]string{"aaaaaaa": "v5.0", "bbbbbbb": "", "": ""} {
+		if got := buildToolchain(commit).IDFVersion; got != want {
+			t.Errorf("buildToolchain(%q) IDF version %q, want %q", commit, got, want)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// updateWindow is a daily local time-of-day range during which a group of
+// devices may download an update. A window whose end is before its start
+// wraps past midnight (e.g. 22:00-04:00).
+type updateWindow struct {
+	start time.Duration
+	end   time.Duration
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func parseUpdateWindow(s string) (updateWindow, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return updateWindow{}, fmt.Errorf("expected HH:MM-HH:MM, got %q", s)
+	}
+	start, err := parseClock(from)
+	if err != nil {
+		return updateWindow{}, err
+	}
+	end, err := parseClock(to)
+	if err != nil {
+		return updateWindow{}, err
+	}
+	if start == end {
+		// It would never be open, yet untilOpen reports 0 at its start
+		return updateWindow{}, fmt.Errorf("window %q is empty", s)
+	}
+	return updateWindow{start: start, end: end}, nil
+}
+
+// resolveUpdateWindows parses the group windows, e.g.
+// {"lobby": "01:00-05:00", "office": "22:00-04:00"}, and lowercases the
+// device IDs of the device to group mapping.
+func resolveUpdateWindows(cfg *Config) error {
+	cfg.groupWindows = make(map[string]updateWindow, len(cfg.UpdateWindows))
+	for group, spec := range cfg.UpdateWindows {
+		w, err := parseUpdateWindow(spec)
+		if err != nil {
+			return fmt.Errorf("update window for %s: %w", group, err)
+		}
+		cfg.groupWindows[strings.TrimSpace(group)] = w
+	}
+	groups := make(map[string]string, len(cfg.DeviceGroups))
+	for device, group := range cfg.DeviceGroups {
+		groups[strings.ToLower(strings.TrimSpace(device))] = strings.TrimSpace(group)
+	}
+	cfg.DeviceGroups = groups
+	forced := make([]string, 0, len(cfg.ForceUpdateFor))
+	for _, entry := range cfg.ForceUpdateFor {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			forced = append(forced, entry)
+		}
+	}
+	cfg.ForceUpdateFor = forced
+	return nil
+}
+
+func (w updateWindow) String() string {
+	clock := func(d time.Duration) string {
+		return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+	}
+	return clock(w.start) + "-" + clock(w.end)
+}
+
+func sinceMidnight(t time.Time) time.Duration {
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second
+}
+
+func (w updateWindow) contains(t time.Time) bool {
+	now := sinceMidnight(t)
+	if w.start <= w.end {
+		return now >= w.start && now < w.end
+	}
+	return now >= w.start || now < w.end
+}
+
+// untilOpen returns how long until the window next opens, or zero if it is
+// currently open.
+func (w updateWindow) untilOpen(t time.Time) time.Duration {
+	if w.contains(t) {
+		return 0
+	}
+	wait := w.start - sinceMidnight(t)
+	if wait < 0 {
+		wait += 24 * time.Hour
+	}
+	return wait
+}
+
+// deviceID returns the identifier a device supplied with its request, if any.
+func deviceID(r *http.Request) string {
+	if id := r.Header.Get("X-Device-ID"); id != "" {
+		return id
+	}
+	return r.URL.Query().Get("device")
+}
+
+// deviceGroup resolves the update group for a request: the server-side
+// device mapping wins, so a device can't pick a more convenient window,
+// and only unmapped devices may name their group themselves.
+func deviceGroup(r *http.Request) string {
+	if group, ok := config.DeviceGroups[strings.ToLower(deviceID(r))]; ok {
+		return group
+	}
+	if group := r.Header.Get("X-Device-Group"); group != "" {
+		return group
+	}
+	return r.URL.Query().Get("group")
+}
+
+// forceUpdateFor reports whether the requesting device is told to update
+// regardless of its window: for every device with ForceUpdate, otherwise
+// when its group or device ID is listed in ForceUpdateFor.
+func forceUpdateFor(r *http.Request) bool {
+	if config.ForceUpdate {
+		return true
+	}
+	group, id := deviceGroup(r), deviceID(r)
+	for _, entry := range config.ForceUpdateFor {
+		if (group != "" && entry == group) || (id != "" && strings.EqualFold(entry, id)) {
+			return true
+		}
+	}
+	return false
+}
+
+// updateWindowFor reports whether the requesting device may update now. When
+// it may not, the device's window and the wait until it opens are returned.
+func updateWindowFor(r *http.Request, now time.Time) (allowed bool, window updateWindow, wait time.Duration) {
+	if forceUpdateFor(r) {
+		return true, updateWindow{}, 0
+	}
+	window, ok := config.groupWindows[deviceGroup(r)]
+	if !ok {
+		return true, updateWindow{}, 0
+	}
+	wait = window.untilOpen(now)
+	return wait == 0, window, wait
+}
+
+// allowUpdateWindow answers 503 with Retry-After when the device's group
+// window is closed. Downloads check it before they are charged against
+// the rate limit, so a deferred device doesn't spend its tokens.
+func allowUpdateWindow(w http.ResponseWriter, r *http.Request) bool {
+	allowed, window, wait := updateWindowFor(r, time.Now())
+	if allowed {
+		return true
+	}
+	w.Header().Set("X-Update-Window", window.String())
+	w.Header().Set("Retry-After", fmt.Sprintf("%d", int(wait.Seconds())))
+	slog.Info("⏸️  Update deferred: outside window", "event", "update_deferred", "remote_addr", r.RemoteAddr,
+		"window", window.String(), "opens_in", wait.Round(time.Minute))
+	http.Error(w, "Update available but outside this device's update window", http.StatusServiceUnavailable)
+	return false
+}
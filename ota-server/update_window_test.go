@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestUpdateWindowFor(t *testing.T) {
+	savedConfig := config
+	t.Cleanup(func() { config = savedConfig })
+
+	at := func(clock string) time.Time {
+		ts, err := time.ParseInLocation("2006-01-02 15:04", "2024-05-01 "+clock, time.Local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ts
+	}
+
+	tests := []struct {
+		name     string
+		force    bool
+		forceFor []string
+		header   http.Header
+		query    string
+		now      string
+		allowed  bool
+		wantWait time.Duration
+	}{
+		{name: "no group", now: "12:00", allowed: true},
+		{name: "unknown group", header: http.Header{"X-Device-Group": {"garage"}}, now: "12:00", allowed: true},
+		{name: "inside window", header: http.Header{"X-Device-Group": {"lobby"}}, now: "02:30", allowed: true},
+		{name: "before window", header: http.Header{"X-Device-Group": {"lobby"}}, now: "00:30",
+			wantWait: 30 * time.Minute},
+		{name: "window closes at its end", header: http.Header{"X-Device-Group": {"lobby"}}, now: "05:00",
+			wantWait: 20 * time.Hour},
+		{name: "wrapping window before midnight", header: http.Header{"X-Device-Group": {"office"}}, now: "23:00",
+			allowed: true},
+		{name: "wrapping window after midnight", header: http.Header{"X-Device-Group": {"office"}}, now: "03:59",
+			allowed: true},
+		{name: "outside wrapping window", header: http.Header{"X-Device-Group": {"office"}}, now: "12:00",
+			wantWait: 10 * time.Hour},
+		{name: "group from query", query: "?group=lobby", now: "12:00", wantWait: 13 * time.Hour},
+		{name: "group from device mapping", header: http.Header{"X-Device-ID": {"24:6F:28:AA:BB:CC"}}, now: "12:00",
+			wantWait: 13 * time.Hour},
+		{name: "device mapping from query", query: "?device=24:6f:28:dd:ee:ff", now: "12:00",
+			wantWait: 10 * time.Hour},
+		{name: "mapping beats the device's group", header: http.Header{"X-Device-ID": {"24:6f:28:aa:bb:cc"},
+			"X-Device-Group": {"office"}}, now: "23:00", wantWait: 2 * time.Hour},
+		{name: "mapping beats the group query", query: "?device=24:6f:28:aa:bb:cc&group=office", now: "23:00",
+			wantWait: 2 * time.Hour},
+		{name: "unmapped device names its group", header: http.Header{"X-Device-ID": {"24:6f:28:00:00:01"},
+			"X-Device-Group": {"office"}}, now: "23:00", allowed: true},
+		{name: "forced update", force: true, header: http.Header{"X-Device-Group": {"lobby"}}, now: "12:00",
+			allowed: true},
+		{name: "forced group", forceFor: []string{"lobby"}, header: http.Header{"X-Device-Group": {"lobby"}},
+			now: "12:00", allowed: true},
+		{name: "forced device", forceFor: []string{" 24:6f:28:aa:bb:cc"}, header: http.Header{"X-Device-ID": {"24:6F:28:AA:BB:CC"}},
+			now: "12:00", allowed: true},
+		{name: "other group forced", forceFor: []string{"office"}, header: http.Header{"X-Device-Group": {"lobby"}},
+			now: "12:00", wantWait: 13 * time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config = defaultConfig()
+			config.ForceUpdate, config.ForceUpdateFor = tt.force, tt.forceFor
+			config.UpdateWindows = map[string]string{"lobby": "01:00-05:00", "office": "22:00-04:00"}
+			config.DeviceGroups = map[string]string{"24:6F:28:AA:BB:CC": "lobby", "24:6f:28:dd:ee:ff": "office"}
+			if err := resolveUpdateWindows(&config); err != nil {
+				t.Fatal(err)
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "/version"+tt.query, nil)
+			for key, values := range tt.header {
+				for _, v := range values {
+					r.Header.Add(key, v)
+				}
+			}
+			allowed, _, wait := updateWindowFor(r, at(tt.now))
+			if allowed != tt.allowed || wait != tt.wantWait {
+				t.Errorf("got allowed=%v wait=%s, want allowed=%v wait=%s", allowed, wait, tt.allowed, tt.wantWait)
+			}
+		})
+	}
+}
+
+func TestDeferredDownloadNotCharged(t *testing.T) {
+	useTestFirmware(t, testImage("1.0.0", 'A', 8192))
+	config.DownloadRate, config.DownloadBurst = 1, 1
+	closed := time.Now().Add(2 * time.Hour)
+	config.UpdateWindows = map[string]string{"lobby": closed.Format("15:04") + "-" + closed.Add(time.Hour).Format("15:04")}
+	if err := resolveUpdateWindows(&config); err != nil {
+		t.Fatal(err)
+	}
+	downloadLimiter.Lock()
+	downloadLimiter.clients, downloadLimiter.global = map[string]*tokenBucket{}, nil
+	downloadLimiter.downloads = map[string]time.Time{}
+	downloadLimiter.Unlock()
+
+	deferred := httptest.NewRequest(http.MethodGet, "/"+config.FirmwareFile, nil)
+	deferred.Header.Set("X-Device-Group", "lobby")
+	w := httptest.NewRecorder()
+	serveFirmware(w, deferred)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("deferred download: status %d, want 503", w.Code)
+	}
+
+	// The client's only token is still there once its window opens
+	config.ForceUpdate = true
+	w = httptest.NewRecorder()
+	serveFirmware(w, deferred)
+	if w.Code != http.StatusOK {
+		t.Errorf("download after the deferral: status %d, want 200", w.Code)
+	}
+}
+
+func TestResolveUpdateWindowsRejectsBadSpecs(t *testing.T) {
+	for _, spec := range []string{"01:00", "1am-5am", "01:00-25:00", "-05:00", "03:00-03:00"} {
+		cfg := defaultConfig()
+		cfg.UpdateWindows = map[string]string{"lobby": spec}
+		if err := resolveUpdateWindows(&cfg); err == nil {
+			t.Errorf("window %q accepted", spec)
+		}
+	}
+}
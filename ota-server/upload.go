@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// Room for the multipart framing around the largest image
+	uploadFramingBytes = 64 << 10
+
+	// A slow operator link shouldn't hit the server's read timeout
+	uploadTimeout = 5 * time.Minute
+)
+
+// errUploadTruncated is returned for bodies that end early, so a flaky
+// connection can't publish part of an image.
+var errUploadTruncated = errors.New("upload truncated")
+
+// UploadResult is the response to a firmware upload.
+type UploadResult struct {
+	Version string `json:"version"`
+	Size    int64  `json:"size"`
+	SHA256  string `json:"sha256"`
+}
+
+// UploadInfo describes an uploaded image while it is served. Uploads have
+// no commit, so LastGitCommit is empty and this identifies the image.
+type UploadInfo struct {
+	SHA256 string    `json:"sha256"`
+	At     time.Time `json:"at"`
+	By     string    `json:"by"`
+}
+
+// commitInfo stands in for the commit details shown with the firmware.
+func (u UploadInfo) commitInfo() CommitInfo {
+	return CommitInfo{Subject: "Uploaded firmware", Author: u.By, Date: u.At}
+}
+
+// uploadFirmwareHandler publishes a prebuilt image instead of building one:
+// PUT /firmware with the image as the body, or POST /firmware with a
+// multipart "firmware" file. The image is streamed to a temp file, checked
+// against the expected SHA256 when one is given (X-Firmware-SHA256 header,
+// ?sha256= or a "sha256" field before the file) and validated like build
+// output before it is swapped in. Uploads have no commit: the image's
+// SHA256 is recorded in UploadInfo and the history entry instead, and the
+// upload is pinned so it survives restarts.
+func uploadFirmwareHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	if mirrorMode() {
+		http.Error(w, "This server mirrors its firmware; upload to the primary OTA server", http.StatusConflict)
+		return
+	}
+
+	// Claim the build slot so no build can publish while we do
+	state.Lock()
+	if state.BuildInProgress {
+		state.Unlock()
+		http.Error(w, "Build in progress, try again when it completes", http.StatusConflict)
+		return
+	}
+	state.BuildInProgress = true
+	state.Unlock()
+	defer func() {
+		state.Lock()
+		state.BuildInProgress = false
+		buildDone.Broadcast()
+		state.Unlock()
+		saveState()
+	}()
+
+	startTime := time.Now()
+	http.NewResponseController(w).SetReadDeadline(startTime.Add(uploadTimeout))
+	r.Body = http.MaxBytesReader(w, r.Body, config.MaxFirmwareSize+uploadFramingBytes)
+	tmpPath, sum, size, err := receiveUpload(r)
+	if tmpPath != "" {
+		defer os.Remove(tmpPath)
+	}
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		http.Error(w, "Firmware too large", http.StatusRequestEntityTooLarge)
+		return
+	case err != nil:
+		slog.Warn("⚠️  Rejected firmware upload", "event", "upload_rejected", "error", err, "remote_addr", r.RemoteAddr)
+		http.Error(w, "Upload rejected: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	file, err := os.Open(tmpPath)
+	if err != nil {
+		http.Error(w, "Failed to read upload", http.StatusInternalServerError)
+		return
+	}
+	err = validateFirmwareImage(file, size)
+	version := readFirmwareVersion(file)
+	file.Close()
+	if err != nil {
+		slog.Warn("⚠️  Rejected firmware upload", "event", "upload_rejected", "error", err, "remote_addr", r.RemoteAddr)
+		http.Error(w, "Invalid firmware image: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if version == "" {
+		version = "manual-upload"
+	}
+
+	if err := publishFirmware(tmpPath, "", version, Toolchain{}); err != nil {
+		slog.Error("❌ Could not publish uploaded firmware", "event", "upload_failed", "error", err)
+		http.Error(w, "Publish failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	record := BuildRecord{
+		Trigger:         buildReasonUpload,
+		StartTime:       startTime,
+		DurationSeconds: time.Since(startTime).Seconds(),
+		Success:         true,
+		FirmwareSize:    size,
+		SHA256:          sum,
+	}
+	upload := &UploadInfo{SHA256: sum, At: startTime, By: clientIP(r)}
+	state.Lock()
+	state.Upload = upload
+	state.LastBuildTime = time.Now()
+	state.LastCommitInfo = upload.commitInfo()
+	state.BuildError = ""
+	state.FirmwareSize = size
+	// Like a rollback, an upload goes to every device
+	state.CanaryCommit = ""
+	rollNotesForward(version)
+	appendBuildRecord(record)
+	state.Unlock()
+
+	finishPublish(tmpPath, "")
+	pinPublished(buildReasonUpload)
+	state.Events.publish(BuildEvent{Type: eventBuildCompleted})
+	slog.Info("📤 Firmware uploaded", "event", "upload_published", "version", version, "bytes", size, "sha256", sum,
+		"remote_addr", r.RemoteAddr)
+
+	writeJSONStatus(w, http.StatusCreated, UploadResult{Version: version, Size: size, SHA256: sum})
+}
+
+// receiveUpload streams the image in r to a temp file in the build output
+// directory and returns its path, SHA256 and size. A body shorter than its
+// Content-Length, a multipart body without its closing boundary and a
+// checksum mismatch are all errors; the temp file is returned for removal
+// even then.
+func receiveUpload(r *http.Request) (tmpPath, sum string, size int64, err error) {
+	expected := r.Header.Get("X-Firmware-SHA256")
+	if expected == "" {
+		expected = r.URL.Query().Get("sha256")
+	}
+
+	body := io.Reader(r.Body)
+	var form *multipart.Reader
+	if r.Method == http.MethodPost {
+		if form, err = r.MultipartReader(); err != nil {
+			return "", "", 0, fmt.Errorf("expected a multipart form: %w", err)
+		}
+		body = nil
+		for body == nil {
+			part, err := form.NextPart()
+			if err == io.EOF {
+				return "", "", 0, errors.New(`no "firmware" file in the form`)
+			}
+			if err != nil {
+				return "", "", 0, fmt.Errorf("%w: %v", errUploadTruncated, err)
+			}
+			switch part.FormName() {
+			case "sha256":
+				value, _ := io.ReadAll(io.LimitReader(part, 128))
+				expected = strings.TrimSpace(string(value))
+			case "firmware":
+				body = part
+			}
+		}
+	}
+
+	outDir := filepath.Join(config.FirmwarePath, buildOutputDir)
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return "", "", 0, err
+	}
+	tmp, err := os.CreateTemp(outDir, "upload-*.bin")
+	if err != nil {
+		return "", "", 0, err
+	}
+	defer tmp.Close()
+	hash := sha256.New()
+	size, err = io.Copy(io.MultiWriter(tmp, hash), body)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = fmt.Errorf("%w after %d bytes", errUploadTruncated, size)
+	}
+	if err == nil && form == nil && r.ContentLength >= 0 && size != r.ContentLength {
+		err = fmt.Errorf("%w: got %d of %d bytes", errUploadTruncated, size, r.ContentLength)
+	}
+	if err == nil && form != nil {
+		// The form must end properly, or the file part may be cut short
+		if _, err = form.NextPart(); err == io.EOF {
+			err = nil
+		} else if err != nil {
+			err = fmt.Errorf("%w: %v", errUploadTruncated, err)
+		} else {
+			err = errors.New(`unexpected form field after "firmware"`)
+		}
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	sum = hex.EncodeToString(hash.Sum(nil))
+	if err == nil && expected != "" && !strings.EqualFold(expected, sum) {
+		err = fmt.Errorf("checksum mismatch: got %s, expected %s", sum, expected)
+	}
+	return tmp.Name(), sum, size, err
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// cutReader returns data and then fails like a connection dropped mid-body.
+type cutReader struct {
+	data *bytes.Reader
+}
+
+func (r *cutReader) Read(p []byte) (int, error) {
+	n, err := r.data.Read(p)
+	if err == io.EOF {
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// multipartUpload returns a POST /firmware body with image as the
+// "firmware" file, and its content type.
+func multipartUpload(t *testing.T, image []byte) ([]byte, string) {
+	t.Helper()
+	var buf bytes.Buffer
+	form := multipart.NewWriter(&buf)
+	part, err := form.CreateFormFile("firmware", "beacon.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(image)
+	form.Close()
+	return buf.Bytes(), form.FormDataContentType()
+}
+
+func TestUploadFirmwareTruncated(t *testing.T) {
+	published := testImage("1.0.0", 'A', 64<<10)
+	upload := testImage("2.0.0", 'B', 64<<10)
+	form, formType := multipartUpload(t, upload)
+
+	tests := []struct {
+		name       string
+		method     string
+		body       io.Reader
+		length     int64 // Content-Length, -1 for unknown
+		header     http.Header
+		wantStatus int
+	}{
+		{
+			name:   "body shorter than its Content-Length",
+			method: http.MethodPut, body: bytes.NewReader(upload[:40<<10]), length: int64(len(upload)),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "connection dropped mid-body",
+			method: http.MethodPut, body: &cutReader{bytes.NewReader(upload[:40<<10])}, length: -1,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "image cut short without a Content-Length",
+			method: http.MethodPut, body: bytes.NewReader(upload[:40<<10]), length: -1,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "multipart form without its closing boundary",
+			method: http.MethodPost, body: bytes.NewReader(form[:len(form)-60]), length: -1,
+			header:     http.Header{"Content-Type": {formType}},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "checksum mismatch",
+			method: http.MethodPut, body: bytes.NewReader(upload), length: int64(len(upload)),
+			header:     http.Header{"X-Firmware-Sha256": {sha256Hex(published)}},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "complete multipart upload",
+			method: http.MethodPost, body: bytes.NewReader(form), length: int64(len(form)),
+			header:     http.Header{"Content-Type": {formType}, "X-Firmware-Sha256": {sha256Hex(upload)}},
+			wantStatus: http.StatusCreated,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := useTestFirmware(t, published)
+			config.AdminToken = "secret"
+
+			r := httptest.NewRequest(tt.method, "/firmware", tt.body)
+			r.ContentLength = tt.length
+			for key, values := range tt.header {
+				r.Header[key] = values
+			}
+			r.Header.Set("Authorization", "Bearer secret")
+			w := httptest.NewRecorder()
+			uploadFirmwareHandler(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status %d (%s), want %d", w.Code, strings.TrimSpace(w.Body.String()), tt.wantStatus)
+			}
+			want := published
+			if tt.wantStatus == http.StatusCreated {
+				want = upload
+				if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+					t.Errorf("Content-Type %q, want application/json", ct)
+				}
+			}
+			served, err := os.ReadFile(filepath.Join(dir, config.FirmwareFile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(served, want) {
+				t.Errorf("published firmware has sha256 %s, want %s", sha256Hex(served), sha256Hex(want))
+			}
+			leftovers, _ := filepath.Glob(filepath.Join(dir, buildOutputDir, "upload-*"))
+			if len(leftovers) > 0 {
+				t.Errorf("temp files left behind: %v", leftovers)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// FlashVerification is the /verify answer to a device checking what it
+// flashed.
+type FlashVerification struct {
+	Match    bool   `json:"match"`
+	Expected string `json:"expected"`
+	Reported string `json:"reported"`
+	Name     string `json:"name"`
+	Version  string `json:"version,omitempty"`
+}
+
+// verifyHandler compares the SHA256 a device computed over the image it
+// flashed with the image it should have got: the current firmware, the
+// stable build for devices held back by a canary rollout, or the target
+// named by ?variant=. Every answer is logged so corrupt flashes show up
+// across the fleet, and count toward the build's rollout stats.
+func verifyHandler(w http.ResponseWriter, r *http.Request) {
+	reported := strings.ToLower(r.URL.Query().Get("sha256"))
+	if decoded, err := hex.DecodeString(reported); err != nil || len(decoded) != 32 {
+		http.Error(w, "sha256 must be 64 hex digits", http.StatusBadRequest)
+		return
+	}
+
+	name, commit := config.FirmwareFile, ""
+	if variant := r.URL.Query().Get("variant"); variant != "" {
+		target, _, found := findTarget(variant)
+		if !found {
+			http.Error(w, "Unknown variant "+variant, http.StatusNotFound)
+			return
+		}
+		name = target.Output
+	} else if stable, ok := stableBuildFor(r); ok {
+		name, commit = stable.Name, stable.Commit
+	}
+
+	// Read the commit with the image so the report counts toward its rollout
+	firmwareSwap.RLock()
+	obj, err := firmwareStore.Open(name)
+	if commit == "" {
+		state.RLock()
+		commit = state.LastGitCommit
+		state.RUnlock()
+	}
+	firmwareSwap.RUnlock()
+	if err != nil {
+		http.Error(w, "Firmware not found", http.StatusNotFound)
+		return
+	}
+	defer obj.Close()
+	digest, err := firmwareDigest(obj.FirmwareInfo, obj.Content)
+	if err != nil {
+		slog.Error("❌ Failed to hash firmware", "name", name, "error", err)
+		http.Error(w, "Failed to read firmware", http.StatusInternalServerError)
+		return
+	}
+
+	result := FlashVerification{
+		Match:    reported == digest.SHA256,
+		Expected: digest.SHA256,
+		Reported: reported,
+		Name:     name,
+		Version:  readFirmwareVersion(obj.Content),
+	}
+	logger := slog.With("name", name, "version", result.Version, "device", deviceID(r), "remote_addr", r.RemoteAddr)
+	if result.Match {
+		logger.Info("✅ Device flash verified", "event", "flash_verified")
+	} else {
+		logger.Warn("⚠️  Device flash mismatch", "event", "flash_mismatch", "expected", result.Expected, "reported", reported)
+	}
+	recordRolloutVerify(r, commit, result.Match)
+	writeJSON(w, result)
+}
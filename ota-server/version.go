@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// VersionInfo is the JSON answer to /version for devices that ask for it.
+type VersionInfo struct {
+	Version         string    `json:"version"`
+	BuildTime       time.Time `json:"buildTime"`
+	Commit          string    `json:"commit"`
+	Size            int64     `json:"size"`
+	Current         string    `json:"current,omitempty"`
+	UpdateAvailable bool      `json:"updateAvailable"`
+}
+
+// readProjectVersion returns the release version of the checkout source,
+// relative to config.ProjectPath: its VERSION file if present, otherwise
+// the nearest git tag.
+func readProjectVersion(source string) string {
+	dir := filepath.Join(config.ProjectPath, source)
+	if data, err := os.ReadFile(filepath.Join(dir, "VERSION")); err == nil {
+		if v := strings.TrimSpace(string(data)); v != "" {
+			return v
+		}
+	}
+	output, err := exec.Command("git", "-C", dir, "describe", "--tags", "--always").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(output))
+}
+
+// wantsJSONVersion reports whether a /version request asked for the JSON
+// form. Plain-text remains the default for devices already in the field.
+func wantsJSONVersion(r *http.Request) bool {
+	q := r.URL.Query()
+	return q.Has("current") || q.Get("format") == "json" || acceptsJSON(r)
+}
+
+// compareVersions compares dotted numeric versions like "v1.2.3",
+// returning -1, 0 or 1. Versions that aren't numeric compare as different
+// whenever the strings differ, so a device is offered any other build.
+func compareVersions(a, b string) int {
+	pa, okA := parseVersion(a)
+	pb, okB := parseVersion(b)
+	if !okA || !okB {
+		if a == b {
+			return 0
+		}
+		return 1
+	}
+	for i := 0; i < max(len(pa), len(pb)); i++ {
+		var x, y int
+		if i < len(pa) {
+			x = pa[i]
+		}
+		if i < len(pb) {
+			y = pb[i]
+		}
+		if x != y {
+			if x > y {
+				return 1
+			}
+			return -1
+		}
+	}
+	return 0
+}
+
+func parseVersion(v string) ([]int, bool) {
+	v = strings.TrimPrefix(strings.TrimSpace(v), "v")
+	// Ignore pre-release/build suffixes such as "-3-gabc123"
+	v, _, _ = strings.Cut(v, "-")
+	if v == "" {
+		return nil, false
+	}
+	var parts []int
+	for _, field := range strings.Split(v, ".") {
+		n, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, false
+		}
+		parts = append(parts, n)
+	}
+	return parts, true
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	watchdogInterval   = 1 * time.Minute
+	monitorStallFactor = 3 // restart after this many missed check intervals
+)
+
+// monitorGeneration identifies the git monitor the watchdog currently
+// considers live. A replaced monitor that eventually unblocks sees a newer
+// generation and exits instead of polling alongside its replacement.
+var monitorGeneration atomic.Int64
+
+// superviseGitMonitor runs the git monitor and restarts it if it panics,
+// exits, or stops checking for longer than monitorStallFactor intervals.
+// initialBuild is passed to the first monitor only.
+func superviseGitMonitor(initialBuild bool) {
+	done := startGitMonitor(initialBuild)
+
+	ticker := time.NewTicker(watchdogInterval)
+	defer ticker.Stop()
+
+	for {
+		var reason string
+		select {
+		case <-done:
+			reason = "exited unexpectedly"
+		case <-ticker.C:
+			state.RLock()
+			idle := time.Since(state.MonitorLastActive)
+			overdue := time.Since(state.NextCheckTime)
+			scheduled := !state.NextCheckTime.IsZero()
+			state.RUnlock()
+			// Scheduled checks can be far apart, so judge them by how late
+			// the next one is rather than by how long the monitor was idle
+			if config.schedule != nil {
+				if !scheduled || overdue < (monitorStallFactor-1)*config.CheckInterval {
+					continue
+				}
+				reason = fmt.Sprintf("scheduled check overdue by %v", overdue.Round(time.Second))
+				break
+			}
+			if idle < monitorStallFactor*config.CheckInterval {
+				continue
+			}
+			reason = fmt.Sprintf("inactive for %v", idle.Round(time.Second))
+		}
+
+		slog.Error("🚨 Git monitor stalled, restarting it", "event", "monitor_restart", "reason", reason)
+		state.Lock()
+		state.MonitorRestarts++
+		state.Unlock()
+		notifyMonitorRestart(reason)
+		done = startGitMonitor(false)
+	}
+}
+
+// startGitMonitor launches a new monitor generation and returns a channel
+// that is closed when it stops.
+func startGitMonitor(initialBuild bool) <-chan struct{} {
+	generation := monitorGeneration.Add(1)
+	markMonitorActive()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer func() {
+			if r := recover(); r != nil {
+				slog.Error("💥 Git monitor panicked", "event", "monitor_panic", "panic", fmt.Sprint(r))
+			}
+		}()
+		gitMonitor(generation, initialBuild)
+	}()
+	return done
+}
+
+func markMonitorActive() {
+	state.Lock()
+	state.MonitorLastActive = time.Now()
+	state.Unlock()
+}
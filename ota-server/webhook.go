@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// GitHub caps webhook payloads at 25 MB; push events are far smaller.
+const maxWebhookPayload = 25 << 20
+
+// webhookHandler accepts GitHub push events and triggers an immediate
+// git check when the configured branch is pushed. Deliveries are verified
+// against config.WebhookSecret; the hourly poll keeps running as a fallback.
+func webhookHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	secret := config.WebhookSecret
+	if secret == "" {
+		slog.Warn("🔒 Rejected webhook: no webhook secret configured", "event", "webhook_rejected", "remote_addr", r.RemoteAddr)
+		http.Error(w, "Webhook disabled: GITHUB_WEBHOOK_SECRET not set", http.StatusForbidden)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookPayload))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, "Payload too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to read payload", http.StatusBadRequest)
+		return
+	}
+	if !validWebhookSignature(secret, body, r.Header.Get("X-Hub-Signature-256")) {
+		slog.Warn("🔒 Rejected webhook: invalid signature", "event", "webhook_rejected", "remote_addr", r.RemoteAddr,
+			"delivery", r.Header.Get("X-GitHub-Delivery"))
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	switch event := r.Header.Get("X-GitHub-Event"); event {
+	case "ping":
+		w.Write([]byte("pong\n"))
+		return
+	case "push":
+	default:
+		http.Error(w, "Ignoring event "+event, http.StatusAccepted)
+		return
+	}
+
+	var push struct {
+		Ref   string `json:"ref"`
+		After string `json:"after"`
+	}
+	if err := json.Unmarshal(body, &push); err != nil {
+		http.Error(w, "Invalid push payload", http.StatusBadRequest)
+		return
+	}
+	for _, c := range config.Channels {
+		if c.Branch != "" && push.Ref == "refs/heads/"+c.Branch {
+			slog.Info("🪝 Push received, checking channel", "event", "webhook_push", "channel", c.Name,
+				"commit", push.After[:min(8, len(push.After))])
+			go checkChannel(c)
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+	}
+	if push.Ref != "refs/heads/"+config.GitBranch {
+		slog.Info("🪝 Ignoring push to another branch", "ref", push.Ref, "branch", config.GitBranch)
+		http.Error(w, "Ignoring push to "+push.Ref, http.StatusAccepted)
+		return
+	}
+
+	slog.Info("🪝 Push received, checking for updates", "event", "webhook_push", "branch", config.GitBranch,
+		"commit", push.After[:min(8, len(push.After))])
+
+	go checkAndBuild()
+
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("Build check triggered\n"))
+}
+
+// validWebhookSignature checks a "sha256=<hex>" X-Hub-Signature-256 value.
+func validWebhookSignature(secret string, body []byte, header string) bool {
+	sig, ok := strings.CutPrefix(header, "sha256=")
+	if !ok {
+		return false
+	}
+	got, err := hex.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}